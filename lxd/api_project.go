@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -178,6 +179,9 @@ func projectCreateDefaultProfile(tx *db.ClusterTx, project string) error {
 	profile.Project = project
 	profile.Name = projecthelpers.Default
 	profile.Description = fmt.Sprintf("Default LXD profile for project %s", project)
+	profile.CreatedAt = time.Now().UTC()
+	profile.UpdatedAt = profile.CreatedAt
+	profile.SchemaVersion = db.ProfileSchemaVersion
 
 	_, err := tx.CreateProfile(profile)
 	if err != nil {
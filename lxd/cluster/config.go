@@ -7,6 +7,7 @@ import (
 	"io"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/scrypt"
@@ -123,6 +124,18 @@ func (c *Config) MAASController() (string, string) {
 	return url, key
 }
 
+// ProfilesAllowedConfigPrefixes returns the prefixes that the config keys of
+// profiles must start with, or nil if any key is allowed. Empty entries, such
+// as the one left by a trailing comma, are skipped.
+func (c *Config) ProfilesAllowedConfigPrefixes() []string {
+	value := c.m.GetString("profiles.allowed_config_prefixes")
+	if value == "" {
+		return nil
+	}
+
+	return splitProfilesAllowedConfigPrefixes(value)
+}
+
 // OfflineThreshold returns the configured heartbeat threshold, i.e. the
 // number of seconds before after which an unresponsive node is considered
 // offline..
@@ -237,38 +250,39 @@ func configGet(cluster *db.Cluster) (*Config, error) {
 
 // ConfigSchema defines available server configuration keys.
 var ConfigSchema = config.Schema{
-	"backups.compression_algorithm":  {Default: "gzip", Validator: validateCompression},
-	"cluster.offline_threshold":      {Type: config.Int64, Default: offlineThresholdDefault(), Validator: offlineThresholdValidator},
-	"cluster.images_minimal_replica": {Type: config.Int64, Default: "3", Validator: imageMinimalReplicaValidator},
-	"cluster.max_voters":             {Type: config.Int64, Default: "3", Validator: maxVotersValidator},
-	"cluster.max_standby":            {Type: config.Int64, Default: "2", Validator: maxStandByValidator},
-	"core.https_allowed_headers":     {},
-	"core.https_allowed_methods":     {},
-	"core.https_allowed_origin":      {},
-	"core.https_allowed_credentials": {Type: config.Bool},
-	"core.proxy_http":                {},
-	"core.proxy_https":               {},
-	"core.proxy_ignore_hosts":        {},
-	"core.trust_password":            {Hidden: true, Setter: passwordSetter},
-	"core.trust_ca_certificates":     {Type: config.Bool},
-	"candid.api.key":                 {},
-	"candid.api.url":                 {},
-	"candid.domains":                 {},
-	"candid.expiry":                  {Type: config.Int64, Default: "3600"},
-	"images.auto_update_cached":      {Type: config.Bool, Default: "true"},
-	"images.auto_update_interval":    {Type: config.Int64, Default: "6"},
-	"images.compression_algorithm":   {Default: "gzip", Validator: validateCompression},
-	"images.remote_cache_expiry":     {Type: config.Int64, Default: "10"},
-	"maas.api.key":                   {},
-	"maas.api.url":                   {},
-	"rbac.agent.url":                 {},
-	"rbac.agent.username":            {},
-	"rbac.agent.private_key":         {},
-	"rbac.agent.public_key":          {},
-	"rbac.api.expiry":                {Type: config.Int64, Default: "3600"},
-	"rbac.api.key":                   {},
-	"rbac.api.url":                   {},
-	"rbac.expiry":                    {Type: config.Int64, Default: "3600"},
+	"backups.compression_algorithm":    {Default: "gzip", Validator: validateCompression},
+	"cluster.offline_threshold":        {Type: config.Int64, Default: offlineThresholdDefault(), Validator: offlineThresholdValidator},
+	"cluster.images_minimal_replica":   {Type: config.Int64, Default: "3", Validator: imageMinimalReplicaValidator},
+	"cluster.max_voters":               {Type: config.Int64, Default: "3", Validator: maxVotersValidator},
+	"cluster.max_standby":              {Type: config.Int64, Default: "2", Validator: maxStandByValidator},
+	"core.https_allowed_headers":       {},
+	"core.https_allowed_methods":       {},
+	"core.https_allowed_origin":        {},
+	"core.https_allowed_credentials":   {Type: config.Bool},
+	"core.proxy_http":                  {},
+	"core.proxy_https":                 {},
+	"core.proxy_ignore_hosts":          {},
+	"core.trust_password":              {Hidden: true, Setter: passwordSetter},
+	"core.trust_ca_certificates":       {Type: config.Bool},
+	"candid.api.key":                   {},
+	"candid.api.url":                   {},
+	"candid.domains":                   {},
+	"candid.expiry":                    {Type: config.Int64, Default: "3600"},
+	"images.auto_update_cached":        {Type: config.Bool, Default: "true"},
+	"images.auto_update_interval":      {Type: config.Int64, Default: "6"},
+	"images.compression_algorithm":     {Default: "gzip", Validator: validateCompression},
+	"images.remote_cache_expiry":       {Type: config.Int64, Default: "10"},
+	"maas.api.key":                     {},
+	"maas.api.url":                     {},
+	"profiles.allowed_config_prefixes": {Validator: profilesAllowedConfigPrefixesValidator},
+	"rbac.agent.url":                   {},
+	"rbac.agent.username":              {},
+	"rbac.agent.private_key":           {},
+	"rbac.agent.public_key":            {},
+	"rbac.api.expiry":                  {Type: config.Int64, Default: "3600"},
+	"rbac.api.key":                     {},
+	"rbac.api.url":                     {},
+	"rbac.expiry":                      {Type: config.Int64, Default: "3600"},
 
 	// Keys deprecated since the implementation of the storage api.
 	"storage.lvm_fstype":           {Setter: deprecatedStorage, Default: "ext4"},
@@ -339,6 +353,41 @@ func maxStandByValidator(value string) error {
 	return nil
 }
 
+func profilesAllowedConfigPrefixesValidator(value string) error {
+	// The empty string is the only way to allow all keys, so reject
+	// prefixes that would match any key.
+	if value == "" {
+		return nil
+	}
+
+	for _, prefix := range strings.Split(value, ",") {
+		if strings.TrimSpace(prefix) == "*" {
+			return fmt.Errorf("Prefix '*' would allow all keys")
+		}
+	}
+
+	if len(splitProfilesAllowedConfigPrefixes(value)) == 0 {
+		return fmt.Errorf("Value must contain at least one prefix")
+	}
+
+	return nil
+}
+
+// Split a comma-separated list of profile config prefixes, skipping entries
+// which are empty once trimmed.
+func splitProfilesAllowedConfigPrefixes(value string) []string {
+	prefixes := []string{}
+	for _, prefix := range strings.Split(value, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if strings.TrimSuffix(prefix, "*") == "" {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes
+}
+
 func passwordSetter(value string) (string, error) {
 	// Nothing to do on unset
 	if value == "" {
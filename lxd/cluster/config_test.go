@@ -77,6 +77,37 @@ func TestConfigLoad_MaxVotersValidator(t *testing.T) {
 
 }
 
+// Empty entries of the allowed profile config prefixes are skipped.
+func TestConfig_ProfilesAllowedConfigPrefixes(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	config, err := cluster.ConfigLoad(tx)
+	require.NoError(t, err)
+
+	assert.Nil(t, config.ProfilesAllowedConfigPrefixes())
+
+	_, err = config.Patch(map[string]interface{}{"profiles.allowed_config_prefixes": "limits., , user.*,"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"limits.", "user.*"}, config.ProfilesAllowedConfigPrefixes())
+}
+
+// Allowed profile config prefixes can't match every key.
+func TestConfigLoad_ProfilesAllowedConfigPrefixesValidator(t *testing.T) {
+	tx, cleanup := db.NewTestClusterTx(t)
+	defer cleanup()
+
+	config, err := cluster.ConfigLoad(tx)
+	require.NoError(t, err)
+
+	_, err = config.Patch(map[string]interface{}{"profiles.allowed_config_prefixes": "limits., *"})
+	require.EqualError(t, err, "cannot set 'profiles.allowed_config_prefixes' to 'limits., *': Prefix '*' would allow all keys")
+
+	_, err = config.Patch(map[string]interface{}{"profiles.allowed_config_prefixes": " , "})
+	require.EqualError(t, err, "cannot set 'profiles.allowed_config_prefixes' to ' , ': Value must contain at least one prefix")
+}
+
 // If some previously set values are missing from the ones passed to Replace(),
 // they are deleted from the configuration.
 func TestConfig_ReplaceDeleteValues(t *testing.T) {
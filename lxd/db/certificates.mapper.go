@@ -83,7 +83,7 @@ func (c *ClusterTx) GetCertificates(filter CertificateFilter) ([]Certificate, er
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch certificates")
 	}
@@ -114,7 +114,7 @@ func (c *ClusterTx) GetCertificate(fingerprint string) (*Certificate, error) {
 // GetCertificateID return the ID of the certificate with the given key.
 func (c *ClusterTx) GetCertificateID(fingerprint string) (int64, error) {
 	stmt := c.stmt(certificateID)
-	rows, err := stmt.Query(fingerprint)
+	rows, err := stmt.QueryContext(c.ctx, fingerprint)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to get certificate ID")
 	}
@@ -176,7 +176,7 @@ func (c *ClusterTx) CreateCertificate(object Certificate) (int64, error) {
 	stmt := c.stmt(certificateCreate)
 
 	// Execute the statement.
-	result, err := stmt.Exec(args...)
+	result, err := stmt.ExecContext(c.ctx, args...)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to create certificate")
 	}
@@ -192,7 +192,7 @@ func (c *ClusterTx) CreateCertificate(object Certificate) (int64, error) {
 // DeleteCertificate deletes the certificate matching the given key parameters.
 func (c *ClusterTx) DeleteCertificate(fingerprint string) error {
 	stmt := c.stmt(certificateDelete)
-	result, err := stmt.Exec(fingerprint)
+	result, err := stmt.ExecContext(c.ctx, fingerprint)
 	if err != nil {
 		return errors.Wrap(err, "Delete certificate")
 	}
@@ -211,7 +211,7 @@ func (c *ClusterTx) DeleteCertificate(fingerprint string) error {
 // RenameCertificate renames the certificate matching the given key parameters.
 func (c *ClusterTx) RenameCertificate(fingerprint string, to string) error {
 	stmt := c.stmt(certificateRename)
-	result, err := stmt.Exec(to, fingerprint)
+	result, err := stmt.ExecContext(c.ctx, to, fingerprint)
 	if err != nil {
 		return errors.Wrap(err, "Rename certificate")
 	}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"sync/atomic"
+	"time"
 
 	driver "github.com/canonical/go-dqlite/driver"
 	"github.com/lxc/lxd/lxd/db/query"
@@ -191,11 +192,13 @@ INSERT INTO projects_config (project_id, key, value) VALUES (1, 'features.storag
 				return err
 			}
 
-			// Default profile
+			// Default profile, stamped with the current profile schema
+			// version (see db.ProfileSchemaVersion).
 			stmt = `
-INSERT INTO profiles (name, description, project_id) VALUES ('default', 'Default LXD profile', 1)
+INSERT INTO profiles (name, description, project_id, created_at, updated_at, schema_version) VALUES ('default', 'Default LXD profile', 1, ?, ?, 1)
 `
-			_, err = tx.Exec(stmt)
+			now := time.Now().UTC()
+			_, err = tx.Exec(stmt, now, now)
 			if err != nil {
 				return err
 			}
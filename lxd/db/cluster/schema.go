@@ -335,6 +335,12 @@ CREATE TABLE "profiles" (
     name TEXT NOT NULL,
     description TEXT,
     project_id INTEGER NOT NULL,
+    owner TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00',
+    schema_version INTEGER NOT NULL DEFAULT 0,
+    deprecated INTEGER NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00',
+    immutable INTEGER NOT NULL DEFAULT 0,
     UNIQUE (project_id, name),
     FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE
 );
@@ -392,6 +398,17 @@ CREATE VIEW profiles_devices_ref (project,
      JOIN profiles ON profiles.id=profiles_devices.profile_id
      JOIN projects ON projects.id=profiles.project_id;
 CREATE INDEX profiles_project_id_idx ON profiles (project_id);
+CREATE TABLE profiles_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    profile_id INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL DEFAULT '',
+    author TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    UNIQUE (profile_id, revision),
+    FOREIGN KEY (profile_id) REFERENCES profiles (id) ON DELETE CASCADE
+);
 CREATE VIEW profiles_used_by_ref (project,
     name,
     value) AS
@@ -553,5 +570,5 @@ CREATE TABLE storage_volumes_snapshots_config (
     UNIQUE (storage_volume_snapshot_id, key)
 );
 
-INSERT INTO schema (version, updated_at) VALUES (28, strftime("%s"))
+INSERT INTO schema (version, updated_at) VALUES (36, strftime("%s"))
 `
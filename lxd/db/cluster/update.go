@@ -65,6 +65,85 @@ var updates = map[int]schema.Update{
 	26: updateFromV25,
 	27: updateFromV26,
 	28: updateFromV27,
+	29: updateFromV28,
+	30: updateFromV29,
+	31: updateFromV30,
+	32: updateFromV31,
+	33: updateFromV32,
+	34: updateFromV33,
+	35: updateFromV34,
+	36: updateFromV35,
+}
+
+// Backfill the created_at column of profiles that still hold the zero time
+// sentinel set by updateFromV30, stamping them with the current time like
+// updateFromV33 does for updated_at.
+func updateFromV35(tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE profiles SET created_at = ? WHERE created_at = '0001-01-01 00:00:00+00:00'", time.Now().UTC())
+	return err
+}
+
+// Add immutable column to profiles.
+func updateFromV34(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE profiles ADD COLUMN immutable INTEGER NOT NULL DEFAULT 0;")
+	return err
+}
+
+// Add updated_at column to profiles. Existing profiles are stamped with the
+// current time, since their last modification time is unknown.
+func updateFromV33(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE profiles ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE profiles SET updated_at = ?", time.Now().UTC())
+	return err
+}
+
+// Add deprecated column to profiles.
+func updateFromV32(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE profiles ADD COLUMN deprecated INTEGER NOT NULL DEFAULT 0;")
+	return err
+}
+
+// Add schema_version column to profiles. Existing profiles get version 0,
+// which is lower than any actual version.
+func updateFromV31(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE profiles ADD COLUMN schema_version INTEGER NOT NULL DEFAULT 0;")
+	return err
+}
+
+// Add created_at column to profiles. Existing profiles get the zero time as
+// sentinel, since their creation time is unknown.
+func updateFromV30(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE profiles ADD COLUMN created_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';")
+	return err
+}
+
+// Add profiles_revisions table.
+func updateFromV29(tx *sql.Tx) error {
+	stmt := `
+CREATE TABLE profiles_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    profile_id INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL DEFAULT '',
+    author TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    UNIQUE (profile_id, revision),
+    FOREIGN KEY (profile_id) REFERENCES profiles (id) ON DELETE CASCADE
+);
+`
+	_, err := tx.Exec(stmt)
+	return err
+}
+
+// Add owner column to profiles.
+func updateFromV28(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE profiles ADD COLUMN owner TEXT NOT NULL DEFAULT '';")
+	return err
 }
 
 // Add expiry date to storage volume snapshots
@@ -717,3 +717,139 @@ func TestUpdateFromV26_WithVolumes(t *testing.T) {
 
 	assert.Equal(t, ids[0], 2)
 }
+
+func TestUpdateFromV28(t *testing.T) {
+	schema := cluster.Schema()
+	db, err := schema.ExerciseUpdate(29, func(db *sql.DB) {
+		_, err := db.Exec("INSERT INTO profiles VALUES (2, 'p1', '', 1)")
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	var owner string
+	err = db.QueryRow("SELECT owner FROM profiles WHERE name = 'p1'").Scan(&owner)
+	require.NoError(t, err)
+	assert.Equal(t, "", owner)
+}
+
+func TestUpdateFromV29(t *testing.T) {
+	schema := cluster.Schema()
+	db, err := schema.ExerciseUpdate(30, func(db *sql.DB) {
+		_, err := db.Exec("INSERT INTO profiles VALUES (2, 'p1', '', 1, '')")
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(
+		"INSERT INTO profiles_revisions (profile_id, revision, content, created_at) VALUES (2, 1, '', ?)",
+		time.Now())
+	require.NoError(t, err)
+
+	// Revision numbers are unique per profile.
+	_, err = db.Exec(
+		"INSERT INTO profiles_revisions (profile_id, revision, content, created_at) VALUES (2, 1, '', ?)",
+		time.Now())
+	require.Error(t, err)
+}
+
+func TestUpdateFromV30(t *testing.T) {
+	schema := cluster.Schema()
+	db, err := schema.ExerciseUpdate(31, func(db *sql.DB) {
+		_, err := db.Exec("INSERT INTO profiles VALUES (2, 'p1', '', 1, '')")
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	var createdAt time.Time
+	err = db.QueryRow("SELECT created_at FROM profiles WHERE name = 'p1'").Scan(&createdAt)
+	require.NoError(t, err)
+	assert.True(t, createdAt.IsZero())
+}
+
+func TestUpdateFromV31(t *testing.T) {
+	schema := cluster.Schema()
+	db, err := schema.ExerciseUpdate(32, func(db *sql.DB) {
+		_, err := db.Exec("INSERT INTO profiles VALUES (2, 'p1', '', 1, '', ?)", time.Now())
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	var version int
+	err = db.QueryRow("SELECT schema_version FROM profiles WHERE name = 'p1'").Scan(&version)
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+}
+
+func TestUpdateFromV32(t *testing.T) {
+	schema := cluster.Schema()
+	db, err := schema.ExerciseUpdate(33, func(db *sql.DB) {
+		_, err := db.Exec("INSERT INTO profiles VALUES (2, 'p1', '', 1, '', ?, 1)", time.Now())
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	var deprecated bool
+	err = db.QueryRow("SELECT deprecated FROM profiles WHERE name = 'p1'").Scan(&deprecated)
+	require.NoError(t, err)
+	assert.False(t, deprecated)
+}
+
+func TestUpdateFromV33(t *testing.T) {
+	schema := cluster.Schema()
+	before := time.Now().UTC()
+	db, err := schema.ExerciseUpdate(34, func(db *sql.DB) {
+		_, err := db.Exec("INSERT INTO profiles VALUES (2, 'p1', '', 1, '', ?, 1, 0)", time.Now())
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	var updatedAt time.Time
+	err = db.QueryRow("SELECT updated_at FROM profiles WHERE name = 'p1'").Scan(&updatedAt)
+	require.NoError(t, err)
+	assert.False(t, updatedAt.Before(before))
+}
+
+func TestUpdateFromV34(t *testing.T) {
+	schema := cluster.Schema()
+	db, err := schema.ExerciseUpdate(35, func(db *sql.DB) {
+		_, err := db.Exec("INSERT INTO profiles VALUES (2, 'p1', '', 1, '', ?, 1, 0, ?)", time.Now(), time.Now())
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	var immutable bool
+	err = db.QueryRow("SELECT immutable FROM profiles WHERE name = 'p1'").Scan(&immutable)
+	require.NoError(t, err)
+	assert.False(t, immutable)
+}
+
+func TestUpdateFromV35(t *testing.T) {
+	schema := cluster.Schema()
+	before := time.Now().UTC()
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	db, err := schema.ExerciseUpdate(36, func(db *sql.DB) {
+		_, err := db.Exec("INSERT INTO profiles VALUES (2, 'p1', '', 1, '', '0001-01-01 00:00:00+00:00', 1, 0, ?, 0)", time.Now())
+		require.NoError(t, err)
+		_, err = db.Exec("INSERT INTO profiles VALUES (3, 'p2', '', 1, '', ?, 1, 0, ?, 0)", createdAt, time.Now())
+		require.NoError(t, err)
+	})
+	require.NoError(t, err)
+	defer db.Close()
+
+	var p1CreatedAt time.Time
+	err = db.QueryRow("SELECT created_at FROM profiles WHERE name = 'p1'").Scan(&p1CreatedAt)
+	require.NoError(t, err)
+	assert.False(t, p1CreatedAt.Before(before))
+
+	var p2CreatedAt time.Time
+	err = db.QueryRow("SELECT created_at FROM profiles WHERE name = 'p2'").Scan(&p2CreatedAt)
+	require.NoError(t, err)
+	assert.True(t, p2CreatedAt.Equal(createdAt))
+}
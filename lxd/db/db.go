@@ -3,6 +3,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
@@ -136,6 +137,9 @@ type Cluster struct {
 	mu      sync.RWMutex
 	stmts   map[int]*sql.Stmt // Prepared statements by code.
 	closing bool              // True when daemon is shutting down, prevents retries
+
+	expanderOnce sync.Once
+	expander     *ProfileExpander // Shared by all instance config expansions.
 }
 
 // OpenCluster creates a new Cluster object for interacting with the dqlite
@@ -354,6 +358,31 @@ func (c *Cluster) Transaction(f func(*ClusterTx) error) error {
 	return c.transaction(f)
 }
 
+// TransactionCtx is like Transaction, but gives up as soon as the given
+// context is done, either while waiting for an exclusive lock acquired with
+// EnterExclusive to be released or while the transaction is running.
+func (c *Cluster) TransactionCtx(ctx context.Context, f func(*ClusterTx) error) error {
+	locked := make(chan struct{})
+	go func() {
+		c.mu.RLock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		// Release the lock as soon as we eventually get it.
+		go func() {
+			<-locked
+			c.mu.RUnlock()
+		}()
+		return ctx.Err()
+	}
+
+	defer c.mu.RUnlock()
+	return c.transactionCtx(ctx, f)
+}
+
 // EnterExclusive acquires a lock on the cluster db, so any successive call to
 // Transaction will block until ExitExclusive has been called.
 func (c *Cluster) EnterExclusive() error {
@@ -383,13 +412,18 @@ func (c *Cluster) ExitExclusive(f func(*ClusterTx) error) error {
 }
 
 func (c *Cluster) transaction(f func(*ClusterTx) error) error {
+	return c.transactionCtx(context.Background(), f)
+}
+
+func (c *Cluster) transactionCtx(ctx context.Context, f func(*ClusterTx) error) error {
 	clusterTx := &ClusterTx{
+		ctx:    ctx,
 		nodeID: c.nodeID,
 		stmts:  c.stmts,
 	}
 
 	return c.retry(func() error {
-		return query.Transaction(c.db, func(tx *sql.Tx) error {
+		return query.TransactionCtx(ctx, c.db, func(tx *sql.Tx) error {
 			clusterTx.tx = tx
 			return f(clusterTx)
 		})
@@ -4,6 +4,8 @@ package db
 
 import (
 	"fmt"
+
+	"github.com/lxc/lxd/lxd/instance/instancetype"
 )
 
 func dbDeviceTypeToString(t int) (string, error) {
@@ -59,3 +61,29 @@ func dbDeviceTypeToInt(t string) (int, error) {
 		return -1, fmt.Errorf("Invalid device type %s", t)
 	}
 }
+
+// deviceSupportsInstanceType returns whether a device with the given config can
+// be attached to an instance of the given type. This mirrors the instance type
+// checks performed by the device implementations when validating their config.
+func deviceSupportsInstanceType(config map[string]string, instType instancetype.Type) bool {
+	if instType == instancetype.Any || instType == instancetype.Container {
+		return true
+	}
+
+	switch config["type"] {
+	case "none", "disk":
+		return true
+	case "nic":
+		// NICs connected to a managed network are bridged.
+		if config["network"] != "" {
+			return true
+		}
+
+		switch config["nictype"] {
+		case "bridged", "macvlan", "p2p", "physical", "sriov":
+			return true
+		}
+	}
+
+	return false
+}
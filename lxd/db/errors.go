@@ -16,4 +16,16 @@ var (
 	// isn't found so we don't abuse sql.ErrNoRows any more than we
 	// already do.
 	ErrNoSuchObject = fmt.Errorf("No such object")
+
+	// ErrProfileNameReserved happens when trying to give a profile a name
+	// that is reserved, for example "default".
+	ErrProfileNameReserved = fmt.Errorf("Profile name is reserved")
+
+	// ErrProfileImmutable happens when trying to modify the content of a
+	// profile marked as immutable.
+	ErrProfileImmutable = fmt.Errorf("Profile is immutable")
+
+	// ErrETagMismatch happens when a conditional update is attempted
+	// against an entry that was modified in the meantime.
+	ErrETagMismatch = fmt.Errorf("ETag doesn't match")
 )
@@ -362,7 +362,7 @@ func (c *ClusterTx) GetInstances(filter InstanceFilter) ([]Instance, error) {
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch instances")
 	}
@@ -455,7 +455,7 @@ func (c *ClusterTx) GetInstance(project string, name string) (*Instance, error)
 // GetInstanceID return the ID of the instance with the given key.
 func (c *ClusterTx) GetInstanceID(project string, name string) (int64, error) {
 	stmt := c.stmt(instanceID)
-	rows, err := stmt.Query(project, name)
+	rows, err := stmt.QueryContext(c.ctx, project, name)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to get instance ID")
 	}
@@ -524,7 +524,7 @@ func (c *ClusterTx) CreateInstance(object Instance) (int64, error) {
 	stmt := c.stmt(instanceCreate)
 
 	// Execute the statement.
-	result, err := stmt.Exec(args...)
+	result, err := stmt.ExecContext(c.ctx, args...)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to create instance")
 	}
@@ -537,7 +537,7 @@ func (c *ClusterTx) CreateInstance(object Instance) (int64, error) {
 	// Insert config reference.
 	stmt = c.stmt(instanceCreateConfigRef)
 	for key, value := range object.Config {
-		_, err := stmt.Exec(id, key, value)
+		_, err := stmt.ExecContext(c.ctx, id, key, value)
 		if err != nil {
 			return -1, errors.Wrap(err, "Insert config for instance")
 		}
@@ -554,7 +554,7 @@ func (c *ClusterTx) CreateInstance(object Instance) (int64, error) {
 			return -1, errors.Wrapf(err, "Device type code for %s", typ)
 		}
 		stmt = c.stmt(instanceCreateDevicesRef)
-		result, err := stmt.Exec(id, name, typCode)
+		result, err := stmt.ExecContext(c.ctx, id, name, typCode)
 		if err != nil {
 			return -1, errors.Wrapf(err, "Insert device %s", name)
 		}
@@ -564,7 +564,7 @@ func (c *ClusterTx) CreateInstance(object Instance) (int64, error) {
 		}
 		stmt = c.stmt(instanceCreateDevicesConfigRef)
 		for key, value := range config {
-			_, err := stmt.Exec(deviceID, key, value)
+			_, err := stmt.ExecContext(c.ctx, deviceID, key, value)
 			if err != nil {
 				return -1, errors.Wrap(err, "Insert config for instance")
 			}
@@ -643,7 +643,7 @@ func (c *ClusterTx) InstanceProfilesRef(filter InstanceFilter) (map[string]map[s
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch string ref for instances")
 	}
@@ -736,7 +736,7 @@ func (c *ClusterTx) InstanceConfigRef(filter InstanceFilter) (map[string]map[str
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch  ref for instances")
 	}
@@ -836,7 +836,7 @@ func (c *ClusterTx) InstanceDevicesRef(filter InstanceFilter) (map[string]map[st
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch  ref for instances")
 	}
@@ -881,7 +881,7 @@ func (c *ClusterTx) InstanceDevicesRef(filter InstanceFilter) (map[string]map[st
 // RenameInstance renames the instance matching the given key parameters.
 func (c *ClusterTx) RenameInstance(project string, name string, to string) error {
 	stmt := c.stmt(instanceRename)
-	result, err := stmt.Exec(to, project, name)
+	result, err := stmt.ExecContext(c.ctx, to, project, name)
 	if err != nil {
 		return errors.Wrap(err, "Rename instance")
 	}
@@ -899,7 +899,7 @@ func (c *ClusterTx) RenameInstance(project string, name string, to string) error
 // DeleteInstance deletes the instance matching the given key parameters.
 func (c *ClusterTx) DeleteInstance(project string, name string) error {
 	stmt := c.stmt(instanceDelete)
-	result, err := stmt.Exec(project, name)
+	result, err := stmt.ExecContext(c.ctx, project, name)
 	if err != nil {
 		return errors.Wrap(err, "Delete instance")
 	}
@@ -923,7 +923,7 @@ func (c *ClusterTx) UpdateInstance(project string, name string, object Instance)
 	}
 
 	stmt := c.stmt(instanceUpdate)
-	result, err := stmt.Exec(object.Project, object.Name, object.Node, object.Type, object.Architecture, object.Ephemeral, object.CreationDate, object.Stateful, object.LastUseDate, object.Description, object.ExpiryDate, id)
+	result, err := stmt.ExecContext(c.ctx, object.Project, object.Name, object.Node, object.Type, object.Architecture, object.Ephemeral, object.CreationDate, object.Stateful, object.LastUseDate, object.Description, object.ExpiryDate, id)
 	if err != nil {
 		return errors.Wrap(err, "Update instance")
 	}
@@ -938,7 +938,7 @@ func (c *ClusterTx) UpdateInstance(project string, name string, object Instance)
 
 	// Delete current config.
 	stmt = c.stmt(instanceDeleteConfigRef)
-	_, err = stmt.Exec(id)
+	_, err = stmt.ExecContext(c.ctx, id)
 	if err != nil {
 		return errors.Wrap(err, "Delete current config")
 	}
@@ -949,7 +949,7 @@ func (c *ClusterTx) UpdateInstance(project string, name string, object Instance)
 		if value == "" {
 			continue
 		}
-		_, err := stmt.Exec(id, key, value)
+		_, err := stmt.ExecContext(c.ctx, id, key, value)
 		if err != nil {
 			return errors.Wrap(err, "Insert config for instance")
 		}
@@ -957,7 +957,7 @@ func (c *ClusterTx) UpdateInstance(project string, name string, object Instance)
 
 	// Delete current devices.
 	stmt = c.stmt(instanceDeleteDevicesRef)
-	_, err = stmt.Exec(id)
+	_, err = stmt.ExecContext(c.ctx, id)
 	if err != nil {
 		return errors.Wrap(err, "Delete current devices")
 	}
@@ -973,7 +973,7 @@ func (c *ClusterTx) UpdateInstance(project string, name string, object Instance)
 			return errors.Wrapf(err, "Device type code for %s", typ)
 		}
 		stmt = c.stmt(instanceCreateDevicesRef)
-		result, err := stmt.Exec(id, name, typCode)
+		result, err := stmt.ExecContext(c.ctx, id, name, typCode)
 		if err != nil {
 			return errors.Wrapf(err, "Insert device %s", name)
 		}
@@ -986,7 +986,7 @@ func (c *ClusterTx) UpdateInstance(project string, name string, object Instance)
 			if value == "" {
 				continue
 			}
-			_, err := stmt.Exec(deviceID, key, value)
+			_, err := stmt.ExecContext(c.ctx, deviceID, key, value)
 			if err != nil {
 				return errors.Wrap(err, "Insert config for instance")
 			}
@@ -995,7 +995,7 @@ func (c *ClusterTx) UpdateInstance(project string, name string, object Instance)
 
 	// Delete current profiles.
 	stmt = c.stmt(instanceDeleteProfilesRef)
-	_, err = stmt.Exec(id)
+	_, err = stmt.ExecContext(c.ctx, id)
 	if err != nil {
 		return errors.Wrap(err, "Delete current profiles")
 	}
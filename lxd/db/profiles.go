@@ -3,11 +3,26 @@
 package db
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/lxc/lxd/lxd/db/cluster"
+	"github.com/lxc/lxd/lxd/db/query"
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/shared"
 	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/units"
 	"github.com/pkg/errors"
 )
 
@@ -41,8 +56,8 @@ import (
 //go:generate mapper stmt -p db -e profile delete-devices-ref
 //go:generate mapper stmt -p db -e profile update struct=Profile
 //
-//go:generate mapper method -p db -e profile URIs
-//go:generate mapper method -p db -e profile List
+//go:generate mapper method -p db -e profile URIs name=getProfileURIs
+//go:generate mapper method -p db -e profile List name=getProfiles
 //go:generate mapper method -p db -e profile Get
 //go:generate mapper method -p db -e profile Exists struct=Profile
 //go:generate mapper method -p db -e profile ID struct=Profile
@@ -52,19 +67,30 @@ import (
 //go:generate mapper method -p db -e profile Create struct=Profile
 //go:generate mapper method -p db -e profile Rename
 //go:generate mapper method -p db -e profile Delete
-//go:generate mapper method -p db -e profile Update struct=Profile
+//go:generate mapper method -p db -e profile Update struct=Profile name=updateProfile
 
 // Profile is a value object holding db-related details about a profile.
 type Profile struct {
-	ID          int
-	Project     string `db:"primary=yes&join=projects.name"`
-	Name        string `db:"primary=yes"`
-	Description string `db:"coalesce=''"`
-	Config      map[string]string
-	Devices     map[string]map[string]string
-	UsedBy      []string
+	ID            int
+	Project       string `db:"primary=yes&join=projects.name"`
+	Name          string `db:"primary=yes"`
+	Description   string `db:"coalesce=''"`
+	Owner         string
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	SchemaVersion int
+	Deprecated    bool
+	Immutable     bool
+	Config        map[string]string
+	Devices       map[string]map[string]string
+	UsedBy        []string
 }
 
+// ProfileSchemaVersion is the current version of the format of profile
+// config and devices. Profiles written with an older version might need to
+// be migrated.
+const ProfileSchemaVersion = 1
+
 // ProfileToAPI is a convenience to convert a Profile db struct into
 // an API profile struct.
 func ProfileToAPI(profile *Profile) *api.Profile {
@@ -72,21 +98,4412 @@ func ProfileToAPI(profile *Profile) *api.Profile {
 		Name:   profile.Name,
 		UsedBy: profile.UsedBy,
 	}
-	p.Description = profile.Description
-	p.Config = profile.Config
-	p.Devices = profile.Devices
+	p.Description = profile.Description
+	p.Config = profile.Config
+	p.Devices = profile.Devices
+	p.CreatedAt = profile.CreatedAt
+	p.UpdatedAt = profile.UpdatedAt
+
+	return p
+}
+
+// ProfileChange describes the differences between two profiles.
+type ProfileChange struct {
+	Description *ProfileValueChange
+
+	ConfigAdded   map[string]string
+	ConfigRemoved map[string]string
+	ConfigChanged map[string]ProfileValueChange
+
+	DevicesAdded   map[string]map[string]string
+	DevicesRemoved map[string]map[string]string
+	DevicesChanged map[string]ProfileDeviceChange
+}
+
+// ProfileValueChange holds the old and new value of a changed field.
+type ProfileValueChange struct {
+	Old string
+	New string
+}
+
+// ProfileDeviceChange describes the differences between the config of two
+// devices with the same name.
+type ProfileDeviceChange struct {
+	Added   map[string]string
+	Removed map[string]string
+	Changed map[string]ProfileValueChange
+}
+
+// IsEmpty returns true if the change doesn't contain any difference.
+func (c ProfileChange) IsEmpty() bool {
+	return c.Description == nil &&
+		len(c.ConfigAdded) == 0 && len(c.ConfigRemoved) == 0 && len(c.ConfigChanged) == 0 &&
+		len(c.DevicesAdded) == 0 && len(c.DevicesRemoved) == 0 && len(c.DevicesChanged) == 0
+}
+
+// ProfileDiff returns the changes needed to go from profile a to profile b.
+//
+// The name and UsedBy fields are not compared.
+func ProfileDiff(a, b *api.Profile) ProfileChange {
+	change := ProfileChange{
+		DevicesAdded:   map[string]map[string]string{},
+		DevicesRemoved: map[string]map[string]string{},
+		DevicesChanged: map[string]ProfileDeviceChange{},
+	}
+
+	if a.Description != b.Description {
+		change.Description = &ProfileValueChange{Old: a.Description, New: b.Description}
+	}
+
+	change.ConfigAdded, change.ConfigRemoved, change.ConfigChanged = diffProfileConfig(a.Config, b.Config)
+
+	for name, device := range a.Devices {
+		other, ok := b.Devices[name]
+		if !ok {
+			change.DevicesRemoved[name] = device
+			continue
+		}
+
+		added, removed, changed := diffProfileConfig(device, other)
+		if len(added) > 0 || len(removed) > 0 || len(changed) > 0 {
+			change.DevicesChanged[name] = ProfileDeviceChange{
+				Added:   added,
+				Removed: removed,
+				Changed: changed,
+			}
+		}
+	}
+
+	for name, device := range b.Devices {
+		_, ok := a.Devices[name]
+		if !ok {
+			change.DevicesAdded[name] = device
+		}
+	}
+
+	return change
+}
+
+// Return the keys added, removed and changed when going from config a to
+// config b.
+func diffProfileConfig(a, b map[string]string) (map[string]string, map[string]string, map[string]ProfileValueChange) {
+	added := map[string]string{}
+	removed := map[string]string{}
+	changed := map[string]ProfileValueChange{}
+
+	for key, value := range a {
+		other, ok := b[key]
+		if !ok {
+			removed[key] = value
+			continue
+		}
+		if other != value {
+			changed[key] = ProfileValueChange{Old: value, New: other}
+		}
+	}
+
+	for key, value := range b {
+		_, ok := a[key]
+		if !ok {
+			added[key] = value
+		}
+	}
+
+	return added, removed, changed
+}
+
+// ProfileChecksum returns a checksum of the config and devices of the given
+// profile. Profiles with the same config and devices have the same checksum,
+// regardless of their name and description.
+func ProfileChecksum(profile *api.Profile) string {
+	h := sha256.New()
+
+	keys := make([]string, 0, len(profile.Config))
+	for key := range profile.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "config %q=%q\n", key, profile.Config[key])
+	}
+
+	devices := make([]string, 0, len(profile.Devices))
+	for name := range profile.Devices {
+		devices = append(devices, name)
+	}
+	sort.Strings(devices)
+	for _, name := range devices {
+		config := profile.Devices[name]
+		keys := make([]string, 0, len(config))
+		for key := range config {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(h, "device %q %q=%q\n", name, key, config[key])
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// ProfileETag returns a weak ETag for the given profile, derived from its
+// checksum, its description and its last modification time. Profiles with the
+// same description, config, devices and modification time have the same
+// ETag, regardless of their name.
+func ProfileETag(profile *api.Profile) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%q\n%d\n", ProfileChecksum(profile), profile.Description, profile.UpdatedAt.UnixNano())
+
+	return fmt.Sprintf("W/\"%x\"", h.Sum(nil))
+}
+
+// ProfileCanonicalText returns a stable text representation of the config and
+// devices of the given profile, suitable for text diffs.
+//
+// Config keys are emitted first, one key="value" line per key in sorted
+// order. Each device follows as a block starting with a [devices.<name>]
+// header line, with its own key="value" lines in sorted order. Devices are
+// sorted by name and values are Go-quoted, so they can't span several lines.
+func ProfileCanonicalText(profile *api.Profile) string {
+	var b strings.Builder
+
+	keys := make([]string, 0, len(profile.Config))
+	for key := range profile.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", key, strconv.Quote(profile.Config[key]))
+	}
+
+	devices := make([]string, 0, len(profile.Devices))
+	for name := range profile.Devices {
+		devices = append(devices, name)
+	}
+	sort.Strings(devices)
+	for _, name := range devices {
+		fmt.Fprintf(&b, "[devices.%s]\n", name)
+		config := profile.Devices[name]
+		keys := make([]string, 0, len(config))
+		for key := range config {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(&b, "%s=%s\n", key, strconv.Quote(config[key]))
+		}
+	}
+
+	return b.String()
+}
+
+// ParseProfileCanonicalText parses the config and devices of a profile from
+// the text format produced by ProfileCanonicalText. Empty lines are ignored.
+func ParseProfileCanonicalText(text string) (map[string]string, map[string]map[string]string, error) {
+	config := map[string]string{}
+	devices := map[string]map[string]string{}
+
+	var device map[string]string
+	for i, line := range strings.Split(text, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[devices.") && strings.HasSuffix(line, "]") {
+			name := strings.TrimSuffix(strings.TrimPrefix(line, "[devices."), "]")
+			if name == "" {
+				return nil, nil, fmt.Errorf("Line %d: Empty device name", i+1)
+			}
+			if devices[name] != nil {
+				return nil, nil, fmt.Errorf("Line %d: Duplicate device %q", i+1, name)
+			}
+			device = map[string]string{}
+			devices[name] = device
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, nil, fmt.Errorf("Line %d: Expected key=\"value\"", i+1)
+		}
+		key := parts[0]
+		value, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Line %d: Invalid value for key %q", i+1, key)
+		}
+
+		target := config
+		if device != nil {
+			target = device
+		}
+		_, ok := target[key]
+		if ok {
+			return nil, nil, fmt.Errorf("Line %d: Duplicate key %q", i+1, key)
+		}
+		target[key] = value
+	}
+
+	for name, device := range devices {
+		_, err := dbDeviceTypeToInt(device["type"])
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Device %q", name)
+		}
+	}
+
+	return config, devices, nil
+}
+
+// ProfileNameMaxLength is the maximum length of a profile name, in bytes.
+const ProfileNameMaxLength = 64
+
+// ValidateProfileName checks that the given name can be used for a profile.
+func ValidateProfileName(name string) error {
+	if name == "" {
+		return fmt.Errorf("No name provided")
+	}
+
+	if len(name) > ProfileNameMaxLength {
+		return fmt.Errorf("Profile names may not be longer than %d characters", ProfileNameMaxLength)
+	}
+
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("Profile names may not contain slashes")
+	}
+
+	if strings.IndexFunc(name, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) != -1 {
+		return fmt.Errorf("Profile names may not contain spaces or control characters")
+	}
+
+	if shared.StringInSlice(name, []string{".", ".."}) {
+		return fmt.Errorf("Invalid profile name '%s'", name)
+	}
+
+	return nil
+}
+
+// ValidateProfileNames checks all the given names with ValidateProfileName,
+// returning the validation error of each invalid name. Names appearing more
+// than once are also reported as invalid.
+func ValidateProfileNames(names []string) map[string]error {
+	errs := map[string]error{}
+	seen := map[string]bool{}
+
+	for _, name := range names {
+		if seen[name] {
+			if errs[name] == nil {
+				errs[name] = fmt.Errorf("Duplicate profile name '%s'", name)
+			}
+			continue
+		}
+		seen[name] = true
+
+		err := ValidateProfileName(name)
+		if err != nil {
+			errs[name] = err
+		}
+	}
+
+	return errs
+}
+
+// Names that can't be given to a profile via a rename, since every project
+// with profiles already has a profile with that name.
+var reservedProfileNames = []string{"default"}
+
+// ValidateProfileRename checks that the profile with the given name can be
+// renamed to the given new name within the given project.
+//
+// It returns ErrProfileNameReserved if either the current or the new name
+// is reserved, and an error if the new name is already in use in the
+// project. It should be called in the same transaction that renames the
+// profile, so the name can't be taken in between.
+func (c *ClusterTx) ValidateProfileRename(project, name, to string) error {
+	err := ValidateProfileName(to)
+	if err != nil {
+		return err
+	}
+
+	if shared.StringInSlice(name, reservedProfileNames) {
+		return errors.Wrapf(ErrProfileNameReserved, "The '%s' profile cannot be renamed", name)
+	}
+
+	if shared.StringInSlice(to, reservedProfileNames) {
+		return errors.Wrapf(ErrProfileNameReserved, "Invalid profile name '%s'", to)
+	}
+
+	_, err = c.GetProfile(project, to)
+	if err == nil {
+		return fmt.Errorf("Name '%s' already in use", to)
+	}
+	if err != ErrNoSuchObject {
+		return err
+	}
+
+	return nil
+}
+
+// profileConfigSchemaTypes maps the generic value checkers of the shared
+// package to the JSON Schema fragment describing the values they accept.
+//
+// Config values are always strings over the API, so the actual type of the
+// value is conveyed by the x-lxd-type annotation, while the pattern or enum
+// lets standard JSON Schema validators enforce the syntax.
+var profileConfigSchemaTypes = []struct {
+	checker func(string) error
+	schema  map[string]interface{}
+}{
+	{shared.IsBool, map[string]interface{}{
+		"x-lxd-type": "boolean",
+		"enum":       []string{"", "true", "false", "yes", "no", "1", "0", "on", "off"},
+	}},
+	{shared.IsInt64, map[string]interface{}{
+		"x-lxd-type": "integer",
+		"pattern":    "^(-?[0-9]+)?$",
+	}},
+	{shared.IsUint8, map[string]interface{}{
+		"x-lxd-type":    "integer",
+		"pattern":       "^[0-9]*$",
+		"x-lxd-minimum": 0,
+		"x-lxd-maximum": 255,
+	}},
+	{shared.IsUint32, map[string]interface{}{
+		"x-lxd-type":    "integer",
+		"pattern":       "^[0-9]*$",
+		"x-lxd-minimum": 0,
+		"x-lxd-maximum": 4294967295,
+	}},
+	{shared.IsPriority, map[string]interface{}{
+		"x-lxd-type":    "integer",
+		"pattern":       "^[0-9]*$",
+		"x-lxd-minimum": 0,
+		"x-lxd-maximum": 10,
+	}},
+	{shared.IsSize, map[string]interface{}{
+		"x-lxd-type": "size",
+	}},
+}
+
+// GetProfileConfigSchema returns a JSON Schema document describing the
+// well-known profile config keys, built from the validators registered in
+// shared.KnownInstanceConfigKeys.
+//
+// Keys whose validator is a custom function are described as plain strings,
+// while the free-form key namespaces accepted by shared.ConfigKeyChecker
+// (user.*, environment.*, ...) are matched by pattern.
+func GetProfileConfigSchema() ([]byte, error) {
+	properties := map[string]interface{}{}
+	for key, checker := range shared.KnownInstanceConfigKeys {
+		property := map[string]interface{}{
+			"type":       "string",
+			"x-lxd-type": "string",
+		}
+
+		pointer := reflect.ValueOf(checker).Pointer()
+		for _, known := range profileConfigSchemaTypes {
+			if reflect.ValueOf(known.checker).Pointer() != pointer {
+				continue
+			}
+
+			for name, value := range known.schema {
+				property[name] = value
+			}
+			break
+		}
+
+		properties[key] = property
+	}
+
+	free := map[string]interface{}{"type": "string", "x-lxd-type": "string"}
+	schema := map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"title":                "LXD profile configuration",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+		"patternProperties": map[string]interface{}{
+			"^user\\.":               free,
+			"^environment\\.":        free,
+			"^image\\.":              free,
+			"^volatile\\.":           free,
+			"^limits\\.kernel\\..+$": free,
+		},
+	}
+
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Encode profile config schema")
+	}
+
+	return data, nil
+}
+
+// ValidateProfileConfig checks that all keys of the given profile config
+// start with one of the given allowed prefixes, returning an error naming
+// every other key. A trailing "*" in a prefix is ignored, so "limits." and
+// "limits.*" are equivalent. Empty prefixes, including a bare "*", are skipped
+// rather than matching every key. If no prefix is given, no key is allowed.
+func ValidateProfileConfig(config map[string]string, allowedPrefixes []string) error {
+	disallowed := []string{}
+	for key := range config {
+		allowed := false
+		for _, prefix := range allowedPrefixes {
+			prefix = strings.TrimSuffix(prefix, "*")
+			if prefix == "" {
+				continue
+			}
+			if strings.HasPrefix(key, prefix) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			disallowed = append(disallowed, key)
+		}
+	}
+
+	if len(disallowed) == 0 {
+		return nil
+	}
+
+	sort.Strings(disallowed)
+
+	return fmt.Errorf("Config keys not allowed by policy: %s", strings.Join(disallowed, ", "))
+}
+
+// ValidateProfile runs all profile validators on the given profile, checking
+// its name, its config keys and limits, its devices and that no two disk
+// devices are mounted on the same path. It returns a description of each
+// problem found.
+func ValidateProfile(p *api.Profile) []string {
+	problems := []string{}
+
+	err := ValidateProfileName(p.Name)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	keys := make([]string, 0, len(p.Config))
+	for key := range p.Config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		// The limits.* keys are checked by ValidateProfileLimits.
+		if strings.HasPrefix(key, "limits.") {
+			continue
+		}
+
+		validator, err := shared.ConfigKeyChecker(key)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		value := p.Config[key]
+		err = validator(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Invalid value %q for %s: %v", value, key, err))
+		}
+	}
+
+	problems = append(problems, ValidateProfileLimits(p)...)
+
+	names := make([]string, 0, len(p.Devices))
+	for name := range p.Devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	paths := map[string]string{}
+	for _, name := range names {
+		device := p.Devices[name]
+
+		if device["type"] == "" {
+			problems = append(problems, fmt.Sprintf("Device %q has no type", name))
+			continue
+		}
+
+		_, err := dbDeviceTypeToInt(device["type"])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Device %q: %v", name, err))
+			continue
+		}
+
+		if device["type"] != "disk" || device["path"] == "" {
+			continue
+		}
+
+		other, ok := paths[device["path"]]
+		if ok {
+			problems = append(problems, fmt.Sprintf("Devices %q and %q are both mounted on %s", other, name, device["path"]))
+			continue
+		}
+		paths[device["path"]] = name
+	}
+
+	return problems
+}
+
+// ProfileMinMemoryLimit is the smallest limits.memory value accepted by
+// ValidateProfileLimits.
+const ProfileMinMemoryLimit = "1MiB"
+
+// ValidateProfileLimits checks that the limits.* config keys of the given
+// profile are well-formed and consistent, returning a description of each
+// problem found.
+func ValidateProfileLimits(p *api.Profile) []string {
+	problems := []string{}
+
+	keys := make([]string, 0, len(p.Config))
+	for key := range p.Config {
+		if strings.HasPrefix(key, "limits.") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := p.Config[key]
+
+		validator, ok := shared.KnownInstanceConfigKeys[key]
+		if ok {
+			err := validator(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Invalid value %q for %s: %v", value, key, err))
+				continue
+			}
+		}
+
+		switch key {
+		case "limits.cpu":
+			// CPU ranges must go upwards.
+			for _, chunk := range strings.Split(value, ",") {
+				fields := strings.SplitN(chunk, "-", 2)
+				if len(fields) != 2 {
+					continue
+				}
+				lo, err1 := strconv.Atoi(fields[0])
+				hi, err2 := strconv.Atoi(fields[1])
+				if err1 != nil || err2 != nil || lo > hi {
+					problems = append(problems, fmt.Sprintf("Invalid CPU range %q for %s", chunk, key))
+				}
+			}
+		case "limits.memory":
+			if strings.HasSuffix(value, "%") {
+				percent, _ := strconv.ParseInt(strings.TrimSuffix(value, "%"), 10, 64)
+				if percent <= 0 || percent > 100 {
+					problems = append(problems, fmt.Sprintf("Memory limit %q for %s must be between 1%% and 100%%", value, key))
+				}
+				continue
+			}
+
+			size, _ := units.ParseByteSizeString(value)
+			minimum, _ := units.ParseByteSizeString(ProfileMinMemoryLimit)
+			if size < minimum {
+				problems = append(problems, fmt.Sprintf("Memory limit %q for %s is lower than the minimum of %s", value, key, ProfileMinMemoryLimit))
+			}
+		case "limits.processes":
+			processes, _ := strconv.ParseInt(value, 10, 64)
+			if processes <= 0 {
+				problems = append(problems, fmt.Sprintf("Process limit %q for %s must be positive", value, key))
+			}
+		}
+	}
+
+	return problems
+}
+
+// ProfileFilter can be used to filter results yielded by ProfileList.
+//
+// The UsedBy criterion is only honored by GetProfilesByUsage. When the
+// ExcludeDeprecated flag is set, profiles marked as deprecated are left out.
+type ProfileFilter struct {
+	Project           string
+	Name              string
+	UsedBy            string `db:"ignore"`
+	ExcludeDeprecated bool   `db:"ignore"`
+}
+
+// GetProfileURIs returns all available profile URIs.
+func (c *ClusterTx) GetProfileURIs(filter ProfileFilter) ([]string, error) {
+	if !filter.ExcludeDeprecated {
+		return c.getProfileURIs(filter)
+	}
+
+	stmt, args, err := c.prepareActiveProfileNames(filter)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	code := cluster.EntityTypes["profile"]
+	formatter := cluster.EntityFormatURIs[code]
+
+	return query.SelectURIsCtx(c.ctx, stmt, formatter, args...)
+}
+
+// GetProfiles returns all available profiles.
+func (c *ClusterTx) GetProfiles(filter ProfileFilter) ([]Profile, error) {
+	objects, err := c.getProfiles(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !filter.ExcludeDeprecated {
+		return objects, nil
+	}
+
+	active := make([]Profile, 0, len(objects))
+	for _, object := range objects {
+		if object.Deprecated {
+			continue
+		}
+		active = append(active, object)
+	}
+
+	return active, nil
+}
+
+// Prepare a statement returning the project and name of the non-deprecated
+// profiles matching the given filter, in the same order as the generated
+// profileNames statements, which can't express the ExcludeDeprecated
+// criterion.
+func (c *ClusterTx) prepareActiveProfileNames(filter ProfileFilter) (*sql.Stmt, []interface{}, error) {
+	stmt := `
+SELECT projects.name AS project, profiles.name
+  FROM profiles JOIN projects ON profiles.project_id = projects.id
+  WHERE profiles.deprecated = 0`
+	args := []interface{}{}
+
+	if filter.Project != "" {
+		stmt += " AND projects.name = ?"
+		args = append(args, filter.Project)
+	}
+	if filter.Name != "" {
+		stmt += " AND profiles.name = ?"
+		args = append(args, filter.Name)
+	}
+	stmt += " ORDER BY projects.id, profiles.name"
+
+	prepared, err := c.tx.PrepareContext(c.ctx, stmt)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Prepare profile names statement")
+	}
+
+	return prepared, args, nil
+}
+
+// GetProfilesAllProjects returns the profiles of all projects matching the
+// given filter, keyed by project name. The filter's Project criterion is
+// ignored.
+//
+// Projects without the profiles feature enabled report the profiles of the
+// default project, since those are the ones they actually use.
+func (c *Cluster) GetProfilesAllProjects(filter ProfileFilter) (map[string][]api.Profile, error) {
+	result := map[string][]api.Profile{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		projects, err := tx.GetProjects(ProjectFilter{})
+		if err != nil {
+			return errors.Wrap(err, "Load projects")
+		}
+
+		filter.Project = ""
+		profiles, err := tx.GetProfiles(filter)
+		if err != nil {
+			return errors.Wrap(err, "Load profiles")
+		}
+
+		byProject := map[string][]api.Profile{}
+		for i := range profiles {
+			profile := ProfileToAPI(&profiles[i])
+			byProject[profiles[i].Project] = append(byProject[profiles[i].Project], *profile)
+		}
+
+		for _, project := range projects {
+			name := project.Name
+			if !shared.IsTrue(project.Config["features.profiles"]) {
+				name = "default"
+			}
+
+			result[project.Name] = byProject[name]
+			if result[project.Name] == nil {
+				result[project.Name] = []api.Profile{}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetProfileNames returns the names of all profiles in the given project.
+func (c *Cluster) GetProfileNames(project string) ([]string, error) {
+	return c.GetProfileNamesCtx(context.Background(), project)
+}
+
+// GetProfileNamesCtx is like GetProfileNames, but gives up as soon as the
+// given context is done, interrupting any query in flight.
+func (c *Cluster) GetProfileNamesCtx(ctx context.Context, project string) ([]string, error) {
+	var names []string
+
+	err := c.TransactionCtx(ctx, func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		names, err = tx.GetProfileNames(ProfileFilter{Project: project})
+		return err
+	})
+	if err != nil {
+		return []string{}, err
+	}
+
+	return names, nil
+}
+
+// GetProfileNames returns the names of the profiles matching the given
+// filter, in name order. Only the Project and ExcludeDeprecated criteria are
+// honored, and the Project one is required.
+func (c *ClusterTx) GetProfileNames(filter ProfileFilter) ([]string, error) {
+	names := []string{}
+
+	// The statement also returns the project name, which we don't need.
+	var projectName string
+	dest := func(i int) []interface{} {
+		names = append(names, "")
+		return []interface{}{&projectName, &names[i]}
+	}
+
+	if !filter.ExcludeDeprecated {
+		err := query.SelectObjectsCtx(c.ctx, c.stmt(profileNamesByProject), dest, filter.Project)
+		if err != nil {
+			return nil, errors.Wrap(err, "Load profile names")
+		}
+
+		return names, nil
+	}
+
+	stmt, args, err := c.prepareActiveProfileNames(ProfileFilter{Project: filter.Project})
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	err = query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Load profile names")
+	}
+
+	return names, nil
+}
+
+// GetProfile returns the profile with the given name.
+func (c *Cluster) GetProfile(project, name string) (int64, *api.Profile, error) {
+	return c.GetProfileCtx(context.Background(), project, name)
+}
+
+// GetProfileCtx is like GetProfile, but gives up as soon as the given context
+// is done.
+func (c *Cluster) GetProfileCtx(ctx context.Context, project, name string) (int64, *api.Profile, error) {
+	var result *api.Profile
+	var id int64
+
+	err := c.TransactionCtx(ctx, func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profile, err := tx.GetProfile(project, name)
+		if err != nil {
+			return err
+		}
+
+		result = ProfileToAPI(profile)
+		id = int64(profile.ID)
+
+		return nil
+	})
+	if err != nil {
+		return -1, nil, err
+	}
+
+	return id, result, nil
+}
+
+// GetProfileID returns the ID of the profile with the given name. Unlike
+// GetProfile, it doesn't load the profile's config, devices and usage.
+func (c *Cluster) GetProfileID(project, name string) (int64, error) {
+	id := int64(-1)
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		id, err = tx.GetProfileID(project, name)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+// GetProfiles returns the profiles with the given names in the given project.
+func (c *Cluster) GetProfiles(project string, names []string) ([]api.Profile, error) {
+	return c.GetProfilesCtx(context.Background(), project, names)
+}
+
+// GetProfilesCtx is like GetProfiles, but gives up as soon as the given
+// context is done.
+func (c *Cluster) GetProfilesCtx(ctx context.Context, project string, names []string) ([]api.Profile, error) {
+	profiles := make([]api.Profile, len(names))
+
+	err := c.TransactionCtx(ctx, func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		objects, err := tx.GetProfilesByNames(project, names)
+		if err != nil {
+			return err
+		}
+
+		for i := range objects {
+			profiles[i] = *ProfileToAPI(&objects[i])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// GetProfilesByUsage returns the profiles matching the given filter whose
+// UsedBy list contains an URL with the filter's UsedBy value as substring.
+//
+// If the filter's UsedBy value is "-", only profiles that are not used by
+// anything are returned. If it's empty, all profiles matching the filter are
+// returned.
+func (c *ClusterTx) GetProfilesByUsage(filter ProfileFilter) ([]Profile, error) {
+	profiles, err := c.GetProfiles(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.UsedBy == "" {
+		return profiles, nil
+	}
+
+	matching := []Profile{}
+	for _, profile := range profiles {
+		if filter.UsedBy == "-" {
+			if len(profile.UsedBy) == 0 {
+				matching = append(matching, profile)
+			}
+			continue
+		}
+
+		for _, url := range profile.UsedBy {
+			if strings.Contains(url, filter.UsedBy) {
+				matching = append(matching, profile)
+				break
+			}
+		}
+	}
+
+	return matching, nil
+}
+
+// CopyProfile creates a new profile named dstName in dstProject, with the
+// same description, config and devices as the profile named srcName in
+// srcProject.
+//
+// If either project doesn't have the profiles feature enabled, the default
+// project is used instead.
+func (c *ClusterTx) CopyProfile(srcProject, srcName, dstProject, dstName string) error {
+	enabled, err := c.ProjectHasProfiles(srcProject)
+	if err != nil {
+		return errors.Wrap(err, "Check if source project has profiles")
+	}
+	if !enabled {
+		srcProject = "default"
+	}
+
+	enabled, err = c.ProjectHasProfiles(dstProject)
+	if err != nil {
+		return errors.Wrap(err, "Check if target project has profiles")
+	}
+	if !enabled {
+		dstProject = "default"
+	}
+
+	profile, err := c.GetProfile(srcProject, srcName)
+	if err != nil {
+		return errors.Wrapf(err, "Load profile %q", srcName)
+	}
+
+	exists, err := c.ProfileExists(dstProject, dstName)
+	if err != nil {
+		return errors.Wrap(err, "Check if target profile exists")
+	}
+	if exists {
+		return fmt.Errorf("Profile %q already exists in project %q", dstName, dstProject)
+	}
+
+	now := time.Now().UTC()
+	_, err = c.CreateProfile(Profile{
+		Project:       dstProject,
+		Name:          dstName,
+		Description:   profile.Description,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		SchemaVersion: profile.SchemaVersion,
+		Config:        profile.Config,
+		Devices:       profile.Devices,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Create profile %q", dstName)
+	}
+
+	return nil
+}
+
+// CanRenameProfile checks whether the profile named oldName can be renamed to
+// newName, without renaming it. An error is returned if the profile doesn't
+// exist or if newName is already taken in the project. Otherwise the URLs of
+// the instances using the profile are returned, as found in the profile's
+// UsedBy field, so callers can warn about them.
+//
+// If the project doesn't have the profiles feature enabled, the default
+// project is used instead.
+func (c *ClusterTx) CanRenameProfile(project, oldName, newName string) ([]string, error) {
+	enabled, err := c.ProjectHasProfiles(project)
+	if err != nil {
+		return nil, errors.Wrap(err, "Check if project has profiles")
+	}
+	if !enabled {
+		project = "default"
+	}
+
+	_, err = c.GetProfileID(project, oldName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Load profile %q", oldName)
+	}
+
+	exists, err := c.ProfileExists(project, newName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Check if target profile exists")
+	}
+	if exists {
+		return nil, fmt.Errorf("Profile %q already exists in project %q", newName, project)
+	}
+
+	usedBy, err := c.ProfileUsedByRef(ProfileFilter{Project: project, Name: oldName})
+	if err != nil {
+		return nil, errors.Wrap(err, "Load profile usage")
+	}
+
+	users := usedBy[project][oldName]
+	if users == nil {
+		users = []string{}
+	}
+
+	return users, nil
+}
+
+// UpdateProfileIfMatch updates the description, config and devices of the
+// profile with the given name, but only if its current ETag as returned by
+// ProfileETag (or Cluster.GetProfileETag) matches the given one. Otherwise
+// ErrETagMismatch is returned.
+func (c *ClusterTx) UpdateProfileIfMatch(project, name, etag string, profile api.Profile) error {
+	current, err := c.GetProfile(project, name)
+	if err != nil {
+		return err
+	}
+
+	if ProfileETag(ProfileToAPI(current)) != etag {
+		return ErrETagMismatch
+	}
+
+	return c.UpdateProfile(project, name, Profile{
+		Project:       project,
+		Name:          name,
+		Description:   profile.Description,
+		Owner:         current.Owner,
+		CreatedAt:     current.CreatedAt,
+		UpdatedAt:     time.Now().UTC(),
+		SchemaVersion: ProfileSchemaVersion,
+		Deprecated:    current.Deprecated,
+		Immutable:     current.Immutable,
+		Config:        profile.Config,
+		Devices:       profile.Devices,
+	})
+}
+
+// UpdateProfile updates the profile matching the given key parameters.
+//
+// ErrProfileImmutable is returned if the profile is marked as immutable. Use
+// SetProfileImmutable to clear the mark first.
+func (c *ClusterTx) UpdateProfile(project string, name string, object Profile) error {
+	id, err := c.GetProfileID(project, name)
+	if err != nil {
+		return errors.Wrap(err, "Get profile")
+	}
+
+	err = checkProfileMutable(c.tx, id)
+	if err != nil {
+		return err
+	}
+
+	return c.updateProfile(project, name, object)
+}
+
+// Return ErrProfileImmutable if the profile with the given ID is marked as
+// immutable.
+func checkProfileMutable(tx *sql.Tx, id int64) error {
+	values, err := query.SelectIntegers(tx, "SELECT immutable FROM profiles WHERE id=?", id)
+	if err != nil {
+		return errors.Wrap(err, "Check if profile is immutable")
+	}
+
+	if len(values) == 1 && values[0] != 0 {
+		return ErrProfileImmutable
+	}
+
+	return nil
+}
+
+// SetProfileImmutable marks the profile with the given name as immutable, or
+// clears the mark. Attempts to modify the content of an immutable profile
+// fail with ErrProfileImmutable, which lets ProfileExpander skip checking
+// whether its cached layer is stale.
+func (c *ClusterTx) SetProfileImmutable(project, name string, immutable bool) error {
+	id, err := c.GetProfileID(project, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.tx.Exec("UPDATE profiles SET immutable = ?, updated_at = ? WHERE id = ?", immutable, time.Now().UTC(), id)
+	if err != nil {
+		return errors.Wrap(err, "Update immutable flag")
+	}
+
+	return nil
+}
+
+// TouchProfile sets the last modification time of the profile with the given
+// name to the current time. It's meant to be called after operations that
+// change the profile without going through UpdateProfile, such as
+// RenameProfile.
+func (c *ClusterTx) TouchProfile(project, name string) error {
+	id, err := c.GetProfileID(project, name)
+	if err != nil {
+		return err
+	}
+
+	err = touchProfile(c.tx, id)
+	if err != nil {
+		return errors.Wrap(err, "Update modification time")
+	}
+
+	return nil
+}
+
+// SetProfileDeprecated marks the profile with the given name as deprecated,
+// or clears the mark.
+func (c *ClusterTx) SetProfileDeprecated(project, name string, deprecated bool) error {
+	id, err := c.GetProfileID(project, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.tx.Exec("UPDATE profiles SET deprecated = ?, updated_at = ? WHERE id = ?", deprecated, time.Now().UTC(), id)
+	if err != nil {
+		return errors.Wrap(err, "Update deprecated flag")
+	}
+
+	return nil
+}
+
+// Number of profiles loaded at once by WalkProfiles.
+var walkProfilesBatchSize = 100
+
+// WalkProfiles calls the given function with each profile of the given
+// project, in name order, stopping at the first error returned by it.
+//
+// Only the names of the profiles are loaded up-front. The profiles are then
+// loaded in batches of walkProfilesBatchSize, each with a fixed number of
+// queries for their config, devices and usage, right before being passed to
+// the function, so not all profiles need to be held in memory at once.
+func (c *ClusterTx) WalkProfiles(project string, fn func(api.Profile) error) error {
+	names, err := c.GetProfileNames(ProfileFilter{Project: project})
+	if err != nil {
+		return err
+	}
+
+	for len(names) > 0 {
+		n := walkProfilesBatchSize
+		if n > len(names) {
+			n = len(names)
+		}
+
+		profiles, err := c.getProfilesBatch(project, names[:n])
+		if err != nil {
+			return err
+		}
+		names = names[n:]
+
+		for i := range profiles {
+			err = fn(*ProfileToAPI(&profiles[i]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Load the profiles with the given names in the given project, in name
+// order, along with their config, devices and used-by references.
+func (c *ClusterTx) getProfilesBatch(project string, names []string) ([]Profile, error) {
+	args := make([]interface{}, 0, len(names)+1)
+	args = append(args, project)
+	for _, name := range names {
+		args = append(args, name)
+	}
+
+	// Run the given query against the batch, scanning each row into the
+	// given destination and calling the given function after each scan.
+	each := func(stmt string, dest []interface{}, f func() error) error {
+		rows, err := c.tx.QueryContext(c.ctx, fmt.Sprintf(stmt, query.Params(len(names))), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			err := rows.Scan(dest...)
+			if err != nil {
+				return err
+			}
+
+			err = f()
+			if err != nil {
+				return err
+			}
+		}
+
+		return rows.Err()
+	}
+
+	profiles := []Profile{}
+	var profile Profile
+	err := each(`
+SELECT profiles.id, projects.name, profiles.name, coalesce(profiles.description, ''), profiles.owner, profiles.created_at, profiles.updated_at, profiles.schema_version, profiles.deprecated, profiles.immutable
+  FROM profiles JOIN projects ON profiles.project_id = projects.id
+  WHERE projects.name = ? AND profiles.name IN %s ORDER BY profiles.name`,
+		[]interface{}{
+			&profile.ID, &profile.Project, &profile.Name, &profile.Description, &profile.Owner,
+			&profile.CreatedAt, &profile.UpdatedAt, &profile.SchemaVersion, &profile.Deprecated, &profile.Immutable,
+		},
+		func() error {
+			profile.Config = map[string]string{}
+			profile.Devices = map[string]map[string]string{}
+			profile.UsedBy = []string{}
+			profiles = append(profiles, profile)
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "Load profiles")
+	}
+
+	index := make(map[string]*Profile, len(profiles))
+	for i := range profiles {
+		index[profiles[i].Name] = &profiles[i]
+	}
+
+	var name, device, key, value string
+	var code int
+
+	err = each(
+		"SELECT name, key, value FROM profiles_config_ref WHERE project = ? AND name IN %s",
+		[]interface{}{&name, &key, &value},
+		func() error {
+			index[name].Config[key] = value
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "Load profiles config")
+	}
+
+	err = each(
+		"SELECT name, device, type, key, value FROM profiles_devices_ref WHERE project = ? AND name IN %s",
+		[]interface{}{&name, &device, &code, &key, &value},
+		func() error {
+			config, ok := index[name].Devices[device]
+			if !ok {
+				deviceType, err := dbDeviceTypeToString(code)
+				if err != nil {
+					return errors.Wrapf(err, "unexpected device type code '%d'", code)
+				}
+				config = map[string]string{"type": deviceType}
+				index[name].Devices[device] = config
+			}
+			if key != "" {
+				config[key] = value
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "Load profiles devices")
+	}
+
+	err = each(
+		"SELECT name, value FROM profiles_used_by_ref WHERE project = ? AND name IN %s",
+		[]interface{}{&name, &value},
+		func() error {
+			index[name].UsedBy = append(index[name].UsedBy, value)
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "Load profiles usage")
+	}
+
+	return profiles, nil
+}
+
+// GetProfilesByNames returns the profiles with the given names in the given
+// project, in the same order as the names.
+//
+// All profiles of the project are loaded at once, along with their config,
+// devices and used-by references, instead of issuing separate queries for
+// each profile.
+func (c *ClusterTx) GetProfilesByNames(project string, names []string) ([]Profile, error) {
+	objects, err := c.GetProfiles(ProfileFilter{Project: project})
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*Profile, len(objects))
+	for i := range objects {
+		byName[objects[i].Name] = &objects[i]
+	}
+
+	profiles := make([]Profile, len(names))
+	for i, name := range names {
+		profile, ok := byName[name]
+		if !ok {
+			return nil, errors.Wrapf(ErrNoSuchObject, "Load profile %q", name)
+		}
+		profiles[i] = *profile
+	}
+
+	return profiles, nil
+}
+
+// FindDuplicateProfiles returns groups of profiles in the given project that
+// have exactly the same config and devices. Profiles without any duplicate
+// are not included.
+func (c *Cluster) FindDuplicateProfiles(project string) ([][]string, error) {
+	groups := [][]string{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		// Profiles are sorted by name, so groups are sorted by the
+		// name of their first member.
+		checksums := []string{}
+		index := map[string][]string{}
+		for i := range profiles {
+			checksum := ProfileChecksum(ProfileToAPI(&profiles[i]))
+			if index[checksum] == nil {
+				checksums = append(checksums, checksum)
+			}
+			index[checksum] = append(index[checksum], profiles[i].Name)
+		}
+
+		for _, checksum := range checksums {
+			if len(index[checksum]) > 1 {
+				groups = append(groups, index[checksum])
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// GetProfileConfigAsEnv returns the config of the profile with the given name
+// rendered as a sorted list of KEY=VALUE environment strings. Each key is
+// prefixed with the given prefix and has its dots replaced by underscores.
+func (c *Cluster) GetProfileConfigAsEnv(project, name, prefix string) ([]string, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return nil, err
+	}
+
+	env := make([]string, 0, len(profile.Config))
+	for key, value := range profile.Config {
+		key = prefix + strings.Replace(key, ".", "_", -1)
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(env)
+
+	return env, nil
+}
+
+// ValidateProfileForInstanceType checks that the config and devices of the
+// profile with the given name can be applied to an instance of the given type,
+// returning all violations found.
+func (c *Cluster) ValidateProfileForInstanceType(project, name string, instType instancetype.Type) []error {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return []error{errors.Wrapf(err, "Load profile %q", name)}
+	}
+
+	return profileInstanceTypeViolations(profile.Config, profile.Devices, instType)
+}
+
+// GetProfileCanonicalText returns the canonical text representation of the
+// profile with the given name. See ProfileCanonicalText for details.
+func (c *Cluster) GetProfileCanonicalText(project, name string) (string, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return "", err
+	}
+
+	return ProfileCanonicalText(profile), nil
+}
+
+// ProfileLabelsKey is the config key holding the comma-separated list of
+// labels attached to a profile.
+const ProfileLabelsKey = "user.labels"
+
+// SetProfileLabels replaces the labels attached to the profile with the given
+// name. Labels are stored under the ProfileLabelsKey config key.
+func (c *Cluster) SetProfileLabels(project, name string, labels []string) error {
+	normalized := []string{}
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			continue
+		}
+		if strings.Contains(label, ",") {
+			return fmt.Errorf("Invalid label %q: labels can't contain commas", label)
+		}
+		if !shared.StringInSlice(label, normalized) {
+			normalized = append(normalized, label)
+		}
+	}
+	sort.Strings(normalized)
+
+	return c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		id, err := tx.GetProfileID(project, name)
+		if err != nil {
+			return err
+		}
+
+		err = checkProfileMutable(tx.tx, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.tx.Exec("DELETE FROM profiles_config WHERE profile_id=? AND key=?", id, ProfileLabelsKey)
+		if err != nil {
+			return err
+		}
+
+		err = touchProfile(tx.tx, id)
+		if err != nil {
+			return err
+		}
+
+		if len(normalized) == 0 {
+			return nil
+		}
+
+		_, err = tx.tx.Exec(
+			"INSERT INTO profiles_config (profile_id, key, value) VALUES(?, ?, ?)",
+			id, ProfileLabelsKey, strings.Join(normalized, ","))
+		return err
+	})
+}
+
+// GetProfileLabels returns the labels attached to the profile with the given
+// name.
+func (c *Cluster) GetProfileLabels(project, name string) ([]string, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return profileLabels(profile.Config), nil
+}
+
+// GetProfilesByLabel returns the names of the profiles in the given project
+// carrying the given label.
+func (c *Cluster) GetProfilesByLabel(project, label string) ([]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name, profiles_config.value FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles_config.key=?
+		ORDER BY profiles.name`
+
+	inargs := []interface{}{project, ProfileLabelsKey}
+	var name, value string
+	outfmt := []interface{}{name, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, r := range output {
+		config := map[string]string{ProfileLabelsKey: r[1].(string)}
+		if shared.StringInSlice(label, profileLabels(config)) {
+			names = append(names, r[0].(string))
+		}
+	}
+
+	return names, nil
+}
+
+// Return the labels stored in the given profile config.
+func profileLabels(config map[string]string) []string {
+	labels := []string{}
+	for _, label := range strings.Split(config[ProfileLabelsKey], ",") {
+		label = strings.TrimSpace(label)
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+
+	return labels
+}
+
+// ValidateAllProfiles runs ValidateProfile against all profiles of the given
+// project, and returns the problems found for each profile that has any.
+func (c *Cluster) ValidateAllProfiles(project string) (map[string][]string, error) {
+	results := map[string][]string{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		for _, profile := range profiles {
+			problems := ValidateProfile(ProfileToAPI(&profile))
+			if len(problems) > 0 {
+				results[profile.Name] = problems
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// ProfileIncludesKey is the config key holding the comma-separated list of
+// profiles whose config and devices a profile includes, in apply order.
+const ProfileIncludesKey = "user.includes"
+
+// DetectProfileCycle returns the first include cycle reachable from the
+// profile with the given name, as the list of profile names along the cycle
+// with the first one repeated at the end, or nil if there's none.
+//
+// The includes map associates each profile name with the names of the
+// profiles it includes.
+func DetectProfileCycle(includes map[string][]string, name string) []string {
+	path := []string{}
+	visiting := map[string]bool{}
+	done := map[string]bool{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		if visiting[name] {
+			for i, other := range path {
+				if other == name {
+					cycle := append([]string{}, path[i:]...)
+					return append(cycle, name)
+				}
+			}
+		}
+		if done[name] {
+			return nil
+		}
+
+		visiting[name] = true
+		path = append(path, name)
+		for _, included := range includes[name] {
+			cycle := visit(included)
+			if cycle != nil {
+				return cycle
+			}
+		}
+		path = path[:len(path)-1]
+		visiting[name] = false
+		done[name] = true
+
+		return nil
+	}
+
+	return visit(name)
+}
+
+// GetProfileResolvedIncludes returns the profile with the given name, with
+// the config and devices of the profiles listed in its ProfileIncludesKey
+// config key merged in, recursively.
+//
+// Included profiles are applied in order, and the values of the profile
+// including them always win. An error is returned if the includes form a
+// cycle or reference a missing profile.
+func (c *Cluster) GetProfileResolvedIncludes(project, name string) (*api.Profile, error) {
+	var result *api.Profile
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		byName := map[string]*Profile{}
+		includes := map[string][]string{}
+		for i, profile := range profiles {
+			byName[profile.Name] = &profiles[i]
+			includes[profile.Name] = profileIncludes(profile.Config)
+		}
+
+		if byName[name] == nil {
+			return ErrNoSuchObject
+		}
+
+		cycle := DetectProfileCycle(includes, name)
+		if cycle != nil {
+			return fmt.Errorf("Profile include cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		var resolve func(name string) (*api.Profile, error)
+		resolve = func(name string) (*api.Profile, error) {
+			profile, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("Included profile %q not found", name)
+			}
+
+			layers := []api.Profile{}
+			for _, included := range includes[name] {
+				layer, err := resolve(included)
+				if err != nil {
+					return nil, err
+				}
+				layers = append(layers, *layer)
+			}
+
+			resolved := ProfileToAPI(profile)
+			resolved.Config = ExpandInstanceConfig(profile.Config, layers)
+			resolved.Devices = ExpandInstanceDevices(deviceConfig.NewDevices(profile.Devices), layers).CloneNative()
+
+			return resolved, nil
+		}
+
+		result, err = resolve(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Return the names of the profiles included by the given profile config.
+func profileIncludes(config map[string]string) []string {
+	includes := []string{}
+	for _, name := range strings.Split(config[ProfileIncludesKey], ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			includes = append(includes, name)
+		}
+	}
+
+	return includes
+}
+
+// ProfileSnapshot is a point-in-time view of all profiles in a project.
+type ProfileSnapshot struct {
+	Project   string
+	Timestamp time.Time
+	Profiles  []ProfileSnapshotEntry
+}
+
+// ProfileSnapshotEntry holds a single profile of a ProfileSnapshot.
+type ProfileSnapshotEntry struct {
+	Profile   api.Profile
+	Checksum  string
+	Timestamp time.Time
+}
+
+// GetProfilesSnapshot loads all profiles in the given project, along with
+// their checksums, within a single transaction, so the result is consistent
+// even in presence of concurrent writes.
+func (c *Cluster) GetProfilesSnapshot(project string) (ProfileSnapshot, error) {
+	snapshot := ProfileSnapshot{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		snapshot.Project = project
+		snapshot.Timestamp = time.Now().UTC()
+		snapshot.Profiles = make([]ProfileSnapshotEntry, len(profiles))
+		for i := range profiles {
+			profile := ProfileToAPI(&profiles[i])
+			snapshot.Profiles[i] = ProfileSnapshotEntry{
+				Profile:   *profile,
+				Checksum:  ProfileChecksum(profile),
+				Timestamp: snapshot.Timestamp,
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return ProfileSnapshot{}, err
+	}
+
+	return snapshot, nil
+}
+
+// ProfileConfigIntersection returns the config keys that are set to the same
+// value in all the profiles with the given names.
+func (c *Cluster) ProfileConfigIntersection(project string, names []string) (map[string]string, error) {
+	profiles, err := c.GetProfiles(project, names)
+	if err != nil {
+		return nil, err
+	}
+
+	intersection := map[string]string{}
+	if len(profiles) == 0 {
+		return intersection, nil
+	}
+
+	for key, value := range profiles[0].Config {
+		intersection[key] = value
+	}
+
+	for _, profile := range profiles[1:] {
+		for key, value := range intersection {
+			other, ok := profile.Config[key]
+			if !ok || other != value {
+				delete(intersection, key)
+			}
+		}
+	}
+
+	return intersection, nil
+}
+
+// ProfileConfigUnion returns all the config keys set in any of the profiles
+// with the given names, each mapped to the value set by every profile that
+// sets it, keyed by profile name.
+func (c *Cluster) ProfileConfigUnion(project string, names []string) (map[string]map[string]string, error) {
+	profiles, err := c.GetProfiles(project, names)
+	if err != nil {
+		return nil, err
+	}
+
+	union := map[string]map[string]string{}
+	for _, profile := range profiles {
+		for key, value := range profile.Config {
+			if union[key] == nil {
+				union[key] = map[string]string{}
+			}
+			union[key][profile.Name] = value
+		}
+	}
+
+	return union, nil
+}
+
+// GetProfileForClone returns the profile with the given name as a request
+// ready to be POSTed to create a copy of it, with only the fields that are
+// persisted: name, description, config and devices.
+func (c *Cluster) GetProfileForClone(project, name string) (api.ProfilesPost, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return api.ProfilesPost{}, err
+	}
+
+	return api.ProfilesPost{
+		Name: profile.Name,
+		ProfilePut: api.ProfilePut{
+			Description: profile.Description,
+			Config:      profile.Config,
+			Devices:     profile.Devices,
+		},
+	}, nil
+}
+
+// ProfileExport is the content of a profile as written to an export file,
+// holding only the fields that are persisted: name, description, config and
+// devices.
+type ProfileExport struct {
+	Name        string                       `json:"name" yaml:"name"`
+	Description string                       `json:"description" yaml:"description"`
+	Config      map[string]string            `json:"config" yaml:"config"`
+	Devices     map[string]map[string]string `json:"devices" yaml:"devices"`
+}
+
+// ToAPI returns an API profile holding the content of the export.
+func (e *ProfileExport) ToAPI() *api.Profile {
+	p := &api.Profile{Name: e.Name}
+	p.Description = e.Description
+	p.Config = e.Config
+	p.Devices = e.Devices
+
+	return p
+}
+
+// CompareProfileWithExport returns the changes going from the stored profile
+// with the given name to the given export.
+func (c *Cluster) CompareProfileWithExport(project, name string, exp ProfileExport) (ProfileChange, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return ProfileChange{}, err
+	}
+
+	return ProfileDiff(profile, exp.ToAPI()), nil
+}
+
+// NormalizeProfile returns a copy of the given profile with its config in
+// normalized form: keys with an empty value are dropped, since they're
+// equivalent to unset keys, and values of well-known boolean keys are spelled
+// either "true" or "false".
+//
+// Normalization never changes the effective configuration of a profile.
+func NormalizeProfile(profile api.Profile) api.Profile {
+	config := make(map[string]string, len(profile.Config))
+	for key, value := range profile.Config {
+		if value == "" {
+			continue
+		}
+
+		checker, ok := shared.KnownInstanceConfigKeys[key]
+		if ok && reflect.ValueOf(checker).Pointer() == reflect.ValueOf(shared.IsBool).Pointer() {
+			if shared.IsTrue(value) {
+				value = "true"
+			} else if shared.StringInSlice(strings.ToLower(value), []string{"false", "0", "no", "off"}) {
+				value = "false"
+			}
+		}
+
+		config[key] = value
+	}
+
+	devices := make(map[string]map[string]string, len(profile.Devices))
+	for name, device := range profile.Devices {
+		devices[name] = make(map[string]string, len(device))
+		for key, value := range device {
+			devices[name][key] = value
+		}
+	}
+
+	profile.Config = config
+	profile.Devices = devices
+
+	return profile
+}
+
+// PreviewProfileNormalization returns the changes that NormalizeProfile
+// would apply to each profile of the given project, without applying them.
+// Profiles that are already normalized are not included.
+func (c *Cluster) PreviewProfileNormalization(project string) (map[string]ProfileChange, error) {
+	changes := map[string]ProfileChange{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		for i := range profiles {
+			current := ProfileToAPI(&profiles[i])
+			normalized := NormalizeProfile(*current)
+
+			change := ProfileDiff(current, &normalized)
+			if change.IsEmpty() {
+				continue
+			}
+			changes[current.Name] = change
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// Change types reported in profile change payloads.
+const (
+	ProfileChangeTypeUpdated   = "updated"
+	ProfileChangeTypeUnchanged = "unchanged"
+)
+
+// JSON representation of a profile change, as built by
+// BuildProfileChangePayload.
+type profileChangePayload struct {
+	Project     string                     `json:"project"`
+	Name        string                     `json:"name"`
+	Type        string                     `json:"type"`
+	Description *profileValueChangePayload `json:"description"`
+	Config      profileConfigChangePayload `json:"config"`
+	Devices     profileDevicesPayload      `json:"devices"`
+}
+
+type profileValueChangePayload struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+type profileConfigChangePayload struct {
+	Added   map[string]string                    `json:"added"`
+	Removed map[string]string                    `json:"removed"`
+	Changed map[string]profileValueChangePayload `json:"changed"`
+}
+
+type profileDevicesPayload struct {
+	Added   map[string]map[string]string          `json:"added"`
+	Removed map[string]map[string]string          `json:"removed"`
+	Changed map[string]profileConfigChangePayload `json:"changed"`
+}
+
+// Return the JSON representation of the given config changes, with empty
+// maps in place of nil ones.
+func newProfileConfigChangePayload(added, removed map[string]string, changed map[string]ProfileValueChange) profileConfigChangePayload {
+	payload := profileConfigChangePayload{
+		Added:   map[string]string{},
+		Removed: map[string]string{},
+		Changed: map[string]profileValueChangePayload{},
+	}
+
+	for key, value := range added {
+		payload.Added[key] = value
+	}
+
+	for key, value := range removed {
+		payload.Removed[key] = value
+	}
+
+	for key, change := range changed {
+		payload.Changed[key] = profileValueChangePayload{Old: change.Old, New: change.New}
+	}
+
+	return payload
+}
+
+// BuildProfileChangePayload returns a JSON document describing the given
+// change to the profile with the given name, suitable for change
+// notification webhooks.
+//
+// The document holds the project and name of the profile, the change type
+// (either ProfileChangeTypeUpdated or ProfileChangeTypeUnchanged) and the
+// description, config and devices changes. Keys are always present and sorted,
+// so the same change always produces the same payload.
+func BuildProfileChangePayload(project, name string, change ProfileChange) ([]byte, error) {
+	payload := profileChangePayload{
+		Project: project,
+		Name:    name,
+		Type:    ProfileChangeTypeUpdated,
+		Config:  newProfileConfigChangePayload(change.ConfigAdded, change.ConfigRemoved, change.ConfigChanged),
+		Devices: profileDevicesPayload{
+			Added:   map[string]map[string]string{},
+			Removed: map[string]map[string]string{},
+			Changed: map[string]profileConfigChangePayload{},
+		},
+	}
+
+	if change.IsEmpty() {
+		payload.Type = ProfileChangeTypeUnchanged
+	}
+
+	if change.Description != nil {
+		payload.Description = &profileValueChangePayload{Old: change.Description.Old, New: change.Description.New}
+	}
+
+	for device, config := range change.DevicesAdded {
+		payload.Devices.Added[device] = config
+	}
+
+	for device, config := range change.DevicesRemoved {
+		payload.Devices.Removed[device] = config
+	}
+
+	for device, c := range change.DevicesChanged {
+		payload.Devices.Changed[device] = newProfileConfigChangePayload(c.Added, c.Removed, c.Changed)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "Encode profile change payload")
+	}
+
+	return data, nil
+}
+
+// GetProfileDeltaFromDefault returns the changes going from the "default"
+// profile of the given project to the profile with the given name.
+func (c *Cluster) GetProfileDeltaFromDefault(project, name string) (ProfileChange, error) {
+	profiles, err := c.GetProfiles(project, []string{"default", name})
+	if err != nil {
+		return ProfileChange{}, err
+	}
+
+	return ProfileDiff(&profiles[0], &profiles[1]), nil
+}
+
+// GetProfilesSharingDevice returns the devices defined identically by more
+// than one profile of the given project, as a map of device signature to the
+// sorted names of the profiles defining such device.
+//
+// The signature of a device is its type followed by a colon and a checksum of
+// its full config, so devices with different names but the same config share
+// the same signature.
+func (c *Cluster) GetProfilesSharingDevice(project string) (map[string][]string, error) {
+	sharing := map[string][]string{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		users := map[string][]string{}
+		for _, profile := range profiles {
+			for _, device := range profile.Devices {
+				signature := profileDeviceSignature(device)
+				names := users[signature]
+				if len(names) > 0 && names[len(names)-1] == profile.Name {
+					continue
+				}
+				users[signature] = append(names, profile.Name)
+			}
+		}
+
+		for signature, names := range users {
+			if len(names) < 2 {
+				continue
+			}
+			sort.Strings(names)
+			sharing[signature] = names
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sharing, nil
+}
+
+// Return the signature of the given device config, made of its type and of a
+// checksum of its sorted config.
+func profileDeviceSignature(device map[string]string) string {
+	h := sha256.New()
+
+	keys := make([]string, 0, len(device))
+	for key := range device {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%q=%q\n", key, device[key])
+	}
+
+	return fmt.Sprintf("%s:%x", device["type"], h.Sum(nil))
+}
+
+// GetProfileConflictMatrix returns, for each pair of profiles of the given
+// project, the sorted config keys that both profiles set to different values.
+//
+// The matrix is symmetric: conflicts between profiles a and b are reported
+// both under [a][b] and [b][a]. Pairs without conflicts are omitted.
+func (c *Cluster) GetProfileConflictMatrix(project string) (map[string]map[string][]string, error) {
+	matrix := map[string]map[string][]string{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		for i, a := range profiles {
+			for _, b := range profiles[i+1:] {
+				keys := []string{}
+				for key, value := range a.Config {
+					other, ok := b.Config[key]
+					if ok && other != value {
+						keys = append(keys, key)
+					}
+				}
+
+				if len(keys) == 0 {
+					continue
+				}
+				sort.Strings(keys)
+
+				if matrix[a.Name] == nil {
+					matrix[a.Name] = map[string][]string{}
+				}
+				if matrix[b.Name] == nil {
+					matrix[b.Name] = map[string][]string{}
+				}
+				matrix[a.Name][b.Name] = keys
+				matrix[b.Name][a.Name] = keys
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return matrix, nil
+}
+
+// ImportProfileFromCanonicalText replaces the config and devices of the
+// profile with the given name with the ones parsed from the given text, in the
+// format produced by ProfileCanonicalText.
+func (c *Cluster) ImportProfileFromCanonicalText(project, name, text string) error {
+	config, devices, err := ParseProfileCanonicalText(text)
+	if err != nil {
+		return errors.Wrap(err, "Parse profile text")
+	}
+
+	return c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profile, err := tx.GetProfile(project, name)
+		if err != nil {
+			return err
+		}
+
+		profile.Config = config
+		profile.Devices = devices
+		profile.UpdatedAt = time.Now().UTC()
+
+		return tx.UpdateProfile(project, name, *profile)
+	})
+}
+
+// CompactProfileConfig removes from the config of the profile with the given
+// name all keys whose value equals the one in the given defaults, and returns
+// the number of keys removed.
+func (c *Cluster) CompactProfileConfig(project, name string, defaults map[string]string) (int, error) {
+	removed := 0
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profile, err := tx.GetProfile(project, name)
+		if err != nil {
+			return err
+		}
+
+		for key, value := range profile.Config {
+			def, ok := defaults[key]
+			if !ok || def != value {
+				continue
+			}
+			delete(profile.Config, key)
+			removed++
+		}
+
+		if removed == 0 {
+			return nil
+		}
+
+		profile.UpdatedAt = time.Now().UTC()
+
+		return tx.UpdateProfile(project, name, *profile)
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return removed, nil
+}
+
+// GetProfileWithDefaults returns the profile with the given name, with the
+// given default values merged in for any config key the profile doesn't set.
+//
+// The sorted list of keys whose value comes from the defaults is returned as
+// well, so callers can tell explicit values from default ones.
+func (c *Cluster) GetProfileWithDefaults(project, name string, defaults map[string]string) (*api.Profile, []string, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := make(map[string]string, len(profile.Config)+len(defaults))
+	for key, value := range profile.Config {
+		config[key] = value
+	}
+
+	defaulted := []string{}
+	for key, value := range defaults {
+		_, ok := config[key]
+		if ok {
+			continue
+		}
+		config[key] = value
+		defaulted = append(defaulted, key)
+	}
+	sort.Strings(defaulted)
+
+	profile.Config = config
+
+	return profile, defaulted, nil
+}
+
+// ProfileInstanceTypeDefaults holds the config values implied for each
+// instance type when a key is not set, as applied by the instance drivers.
+var ProfileInstanceTypeDefaults = map[instancetype.Type]map[string]string{
+	instancetype.Container: {
+		"security.devlxd":     "true",
+		"security.nesting":    "false",
+		"security.privileged": "false",
+	},
+	instancetype.VM: {
+		"limits.cpu":          "1",
+		"limits.memory":       "1GiB",
+		"security.secureboot": "true",
+	},
+}
+
+// GetProfileWithTypeDefaults returns the profile with the given name, with
+// the defaults implied by the given instance type (see
+// ProfileInstanceTypeDefaults) merged in for any config key the profile
+// doesn't set.
+func (c *Cluster) GetProfileWithTypeDefaults(project, name string, instType instancetype.Type) (*api.Profile, error) {
+	profile, _, err := c.GetProfileWithDefaults(project, name, ProfileInstanceTypeDefaults[instType])
+	if err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// ProfileReferences holds the names of the external entities a profile
+// depends on through its devices.
+type ProfileReferences struct {
+	StoragePools []string
+	Networks     []string
+	ACLs         []string
+}
+
+// GetProfileExternalReferences returns the storage pools, networks and
+// network ACLs referenced by the devices of the profile with the given name.
+//
+// Storage pools come from the "pool" key of disk devices, networks from the
+// "network" key of nic devices (or their "parent" for bridged nics not using
+// a managed network) and ACLs from the comma-separated "security.acls" key of
+// nic devices. Each list is sorted and free of duplicates.
+func (c *Cluster) GetProfileExternalReferences(project, name string) (ProfileReferences, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return ProfileReferences{}, err
+	}
+
+	return profileExternalReferences(profile.Devices), nil
+}
+
+// GetProfilesWithDanglingReferences returns the profiles of the given project
+// whose devices reference a storage pool or network not in the given known
+// ones, mapped to the sorted list of dangling references, in the form
+// "pool:<name>" or "network:<name>".
+//
+// References are extracted as in GetProfileExternalReferences.
+func (c *Cluster) GetProfilesWithDanglingReferences(project string, knownPools, knownNetworks []string) (map[string][]string, error) {
+	dangling := map[string][]string{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		for _, profile := range profiles {
+			refs := profileExternalReferences(profile.Devices)
+			missing := []string{}
+
+			for _, pool := range refs.StoragePools {
+				if !shared.StringInSlice(pool, knownPools) {
+					missing = append(missing, "pool:"+pool)
+				}
+			}
+
+			for _, network := range refs.Networks {
+				if !shared.StringInSlice(network, knownNetworks) {
+					missing = append(missing, "network:"+network)
+				}
+			}
+
+			if len(missing) > 0 {
+				sort.Strings(missing)
+				dangling[profile.Name] = missing
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return dangling, nil
+}
+
+// Return the external entities referenced by the given profile devices.
+func profileExternalReferences(devices map[string]map[string]string) ProfileReferences {
+	pools := map[string]bool{}
+	networks := map[string]bool{}
+	acls := map[string]bool{}
+
+	for _, device := range devices {
+		switch device["type"] {
+		case "disk":
+			if device["pool"] != "" {
+				pools[device["pool"]] = true
+			}
+		case "nic":
+			if device["network"] != "" {
+				networks[device["network"]] = true
+			} else if device["nictype"] == "bridged" && device["parent"] != "" {
+				networks[device["parent"]] = true
+			}
+
+			for _, acl := range strings.Split(device["security.acls"], ",") {
+				acl = strings.TrimSpace(acl)
+				if acl != "" {
+					acls[acl] = true
+				}
+			}
+		}
+	}
+
+	sortedKeys := func(set map[string]bool) []string {
+		keys := []string{}
+		for key := range set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	return ProfileReferences{
+		StoragePools: sortedKeys(pools),
+		Networks:     sortedKeys(networks),
+		ACLs:         sortedKeys(acls),
+	}
+}
+
+// GetExpandedInstanceConfig returns the config of the instance with the given
+// name as the instance sees it.
+//
+// The instance's own profiles are applied in their apply order, on top of the
+// project defaults, and the instance's own config is applied last. Projects
+// don't hold instance config of their own, so the project defaults are empty
+// and the project's "default" profile is applied only if the instance uses
+// it. The layer contributed by each profile is cached across calls, see
+// ProfileExpander.
+func (c *Cluster) GetExpandedInstanceConfig(project, instance string) (map[string]string, error) {
+	var config map[string]string
+	profiles := []Profile{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		inst, err := tx.GetInstance(project, instance)
+		if err != nil {
+			return errors.Wrapf(err, "Load instance %q", instance)
+		}
+		config = inst.Config
+
+		// Load the profile names explicitly in apply order, since the
+		// Profiles field of the instance is not guaranteed to be.
+		names, err := query.SelectStrings(tx.tx, `
+SELECT profiles.name FROM instances_profiles
+  JOIN profiles ON profiles.id = instances_profiles.profile_id
+  WHERE instances_profiles.instance_id = ?
+  ORDER BY instances_profiles.apply_order`, inst.ID)
+		if err != nil {
+			return errors.Wrap(err, "Load instance profiles")
+		}
+
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		for _, name := range names {
+			profile, err := tx.GetProfile(project, name)
+			if err != nil {
+				return errors.Wrapf(err, "Load profile %q", name)
+			}
+			profiles = append(profiles, *profile)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	expanded, _ := c.profileExpander().Expand(config, nil, profiles)
+
+	return expanded, nil
+}
+
+// BulkExpandForInstances returns the expanded config of each of the given
+// instances of the given project, as returned by GetExpandedInstanceConfig.
+//
+// All profiles are loaded once, and the merged config of each distinct
+// profile stack is computed only once and reused by all instances using it.
+func (c *Cluster) BulkExpandForInstances(project string, instances []string) (map[string]map[string]string, error) {
+	result := make(map[string]map[string]string, len(instances))
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		objects, err := tx.GetInstances(InstanceFilter{Project: project, Type: instancetype.Any})
+		if err != nil {
+			return errors.Wrap(err, "Load instances")
+		}
+
+		configs := make(map[string]map[string]string, len(objects))
+		for _, object := range objects {
+			configs[object.Name] = object.Config
+		}
+
+		stacks, err := tx.getInstanceProfileStacks(project)
+		if err != nil {
+			return err
+		}
+
+		profileProject := project
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			profileProject = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: profileProject})
+		if err != nil {
+			return err
+		}
+
+		byName := make(map[string]Profile, len(profiles))
+		for _, profile := range profiles {
+			byName[profile.Name] = profile
+		}
+
+		layers := map[string]map[string]string{}
+		for _, instance := range instances {
+			config, ok := configs[instance]
+			if !ok {
+				return errors.Wrapf(ErrNoSuchObject, "Load instance %q", instance)
+			}
+
+			names := stacks[instance]
+			signature := strings.Join(names, "/")
+
+			layer, ok := layers[signature]
+			if !ok {
+				stack := make([]Profile, 0, len(names))
+				for _, name := range names {
+					profile, ok := byName[name]
+					if !ok {
+						return errors.Wrapf(ErrNoSuchObject, "Load profile %q", name)
+					}
+					stack = append(stack, profile)
+				}
+
+				layer, _ = c.profileExpander().Expand(nil, nil, stack)
+				layers[signature] = layer
+			}
+
+			expanded := make(map[string]string, len(layer)+len(config))
+			for k, v := range layer {
+				expanded[k] = v
+			}
+			for k, v := range config {
+				expanded[k] = v
+			}
+			result[instance] = expanded
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Return the names of the profiles of each instance of the given project, in
+// apply order.
+func (c *ClusterTx) getInstanceProfileStacks(project string) (map[string][]string, error) {
+	stmt := `
+SELECT instances.name, profiles.name FROM instances_profiles
+  JOIN instances ON instances.id = instances_profiles.instance_id
+  JOIN projects ON projects.id = instances.project_id
+  JOIN profiles ON profiles.id = instances_profiles.profile_id
+  WHERE projects.name = ?
+  ORDER BY instances.id, instances_profiles.apply_order
+`
+	rows, err := c.tx.Query(stmt, project)
+	if err != nil {
+		return nil, errors.Wrap(err, "Load instance profiles")
+	}
+	defer rows.Close()
+
+	stacks := map[string][]string{}
+	for rows.Next() {
+		var instance string
+		var profile string
+
+		err := rows.Scan(&instance, &profile)
+		if err != nil {
+			return nil, err
+		}
+
+		stacks[instance] = append(stacks[instance], profile)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return stacks, nil
+}
+
+// Return the config keys and devices that can't be applied to an instance of
+// the given type.
+func profileInstanceTypeViolations(config map[string]string, devices map[string]map[string]string, instType instancetype.Type) []error {
+	violations := []error{}
+
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		device := devices[name]
+		if !deviceSupportsInstanceType(device, instType) {
+			devType := device["type"]
+			if device["nictype"] != "" {
+				devType = fmt.Sprintf("%s (%s)", devType, device["nictype"])
+			}
+			violations = append(violations, fmt.Errorf("Device %q of type %s is not supported by instance type %s", name, devType, instType))
+		}
+	}
+
+	// Raw config keys only apply to their own instance type.
+	if instType == instancetype.VM && config["raw.lxc"] != "" {
+		violations = append(violations, fmt.Errorf("Config key \"raw.lxc\" is not supported by instance type %s", instType))
+	}
+	if instType == instancetype.Container && config["raw.qemu"] != "" {
+		violations = append(violations, fmt.Errorf("Config key \"raw.qemu\" is not supported by instance type %s", instType))
+	}
+
+	return violations
+}
+
+// ValidateInstanceProfileStack checks that the profiles with the given names
+// can be applied, in the given order, to a new instance of the given type.
+//
+// It checks that all profiles exist and are listed only once, that profiles
+// don't define conflicting devices, that the resulting config and devices are
+// supported by the instance type and that the stack provides a root disk. A
+// description of each problem found is returned, while the error is only set
+// if the profiles couldn't be loaded.
+func (c *Cluster) ValidateInstanceProfileStack(project string, profiles []string, instType instancetype.Type) ([]string, error) {
+	problems := []string{}
+	loaded := []api.Profile{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		seen := map[string]bool{}
+		for _, name := range profiles {
+			if seen[name] {
+				problems = append(problems, fmt.Sprintf("Profile %q is listed more than once", name))
+				continue
+			}
+			seen[name] = true
+
+			profile, err := tx.GetProfile(project, name)
+			if err == ErrNoSuchObject {
+				problems = append(problems, fmt.Sprintf("Profile %q doesn't exist", name))
+				continue
+			}
+			if err != nil {
+				return errors.Wrapf(err, "Load profile %q", name)
+			}
+			loaded = append(loaded, *ProfileToAPI(profile))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// A device redefined by a later profile must keep the same type.
+	deviceSources := map[string]api.Profile{}
+	for _, profile := range loaded {
+		names := make([]string, 0, len(profile.Devices))
+		for name := range profile.Devices {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			previous, ok := deviceSources[name]
+			if ok && previous.Devices[name]["type"] != profile.Devices[name]["type"] {
+				problems = append(problems, fmt.Sprintf(
+					"Device %q is a %s in profile %q but a %s in profile %q", name,
+					previous.Devices[name]["type"], previous.Name, profile.Devices[name]["type"], profile.Name))
+			}
+			deviceSources[name] = profile
+		}
+	}
+
+	config := ExpandInstanceConfig(nil, loaded)
+	devices := ExpandInstanceDevices(nil, loaded).CloneNative()
+
+	// No two disks can be mounted on the same path.
+	paths := map[string]string{}
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		device := devices[name]
+		if device["type"] != "disk" || device["path"] == "" {
+			continue
+		}
+		other, ok := paths[device["path"]]
+		if ok {
+			problems = append(problems, fmt.Sprintf("Disk devices %q and %q share path %q", other, name, device["path"]))
+			continue
+		}
+		paths[device["path"]] = name
+	}
+
+	for _, violation := range profileInstanceTypeViolations(config, devices, instType) {
+		problems = append(problems, violation.Error())
+	}
+
+	_, _, err = shared.GetRootDiskDevice(devices)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	return problems, nil
+}
+
+// GetProfilesViolatingProjectConfig returns the profiles whose config is not
+// allowed by the restrictions of the given project, mapped to the sorted list
+// of offending keys.
+//
+// Profiles that don't violate any restriction are omitted, and an empty map
+// is returned if the project is not restricted.
+func (c *Cluster) GetProfilesViolatingProjectConfig(project string) (map[string][]string, error) {
+	violations := map[string][]string{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		p, err := tx.GetProject(project)
+		if err != nil {
+			return errors.Wrap(err, "Fetch project")
+		}
+
+		if !shared.IsTrue(p.Config["restricted"]) {
+			return nil
+		}
+
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		for _, profile := range profiles {
+			keys := profileRestrictedConfigKeys(p.Config, profile.Config)
+			if len(keys) > 0 {
+				violations[profile.Name] = keys
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return violations, nil
+}
+
+// Return the sorted list of keys of the given profile config that are
+// forbidden by the given restricted project config.
+//
+// This mirrors the config checks that lxd/project performs on profiles, which
+// can't be used from here since that package depends on this one.
+func profileRestrictedConfigKeys(restrictions map[string]string, config map[string]string) []string {
+	restriction := func(key string, defaultValue string) string {
+		value, ok := restrictions[key]
+		if !ok {
+			return defaultValue
+		}
+		return value
+	}
+
+	containerLowLevel := restriction("restricted.containers.lowlevel", "block") == "allow"
+	vmLowLevel := restriction("restricted.virtual-machines.lowlevel", "block") == "allow"
+	nesting := restriction("restricted.containers.nesting", "block")
+	privilege := restriction("restricted.containers.privilege", "unprivileged")
+
+	containerLowLevelKeys := []string{
+		"boot.host_shutdown_timeout",
+		"linux.kernel_modules",
+		"raw.apparmor",
+		"raw.idmap",
+		"raw.lxc",
+		"raw.seccomp",
+		"security.devlxd.images",
+		"security.idmap.base",
+		"security.idmap.size",
+	}
+	vmLowLevelKeys := []string{
+		"boot.host_shutdown_timeout",
+		"limits.memory.hugepages",
+		"raw.qemu",
+	}
+
+	keys := []string{}
+	for key, value := range config {
+		switch {
+		case !containerLowLevel && (strings.HasPrefix(key, "security.syscalls") || shared.StringInSlice(key, containerLowLevelKeys)):
+		case !vmLowLevel && shared.StringInSlice(key, vmLowLevelKeys):
+		case key == "security.nesting" && nesting == "block" && shared.IsTrue(value):
+		case key == "security.privileged" && privilege != "allow" && shared.IsTrue(value):
+		case key == "security.idmap.isolated" && privilege == "isolated" && !shared.IsTrue(value):
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// UpdateProfileDescription updates the description of the profile with the given ID.
+func UpdateProfileDescription(tx *sql.Tx, id int64, description string) error {
+	err := checkProfileMutable(tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE profiles SET description=?, updated_at=? WHERE id=?", description, time.Now().UTC(), id)
+	return err
+}
+
+// Set the updated_at timestamp of the profile with the given ID to the
+// current time.
+func touchProfile(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec("UPDATE profiles SET updated_at=? WHERE id=?", time.Now().UTC(), id)
+	return err
+}
+
+// ClearProfileConfigOnly resets the config of the profile with the given ID,
+// leaving its devices untouched.
+func ClearProfileConfigOnly(tx *sql.Tx, id int64) error {
+	err := checkProfileMutable(tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM profiles_config WHERE profile_id=?", id)
+	if err != nil {
+		return err
+	}
+	return touchProfile(tx, id)
+}
+
+// ClearProfileConfig resets the config of the profile with the given ID.
+//
+// Note that this also deletes all the profile's devices. Use
+// ClearProfileConfigOnly to reset just the key/value config.
+func ClearProfileConfig(tx *sql.Tx, id int64) error {
+	err := checkProfileMutable(tx, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM profiles_config WHERE profile_id=?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM profiles_devices_config WHERE id IN
+		(SELECT profiles_devices_config.id
+		 FROM profiles_devices_config JOIN profiles_devices
+		 ON profiles_devices_config.profile_device_id=profiles_devices.id
+		 WHERE profiles_devices.profile_id=?)`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM profiles_devices WHERE profile_id=?", id)
+	if err != nil {
+		return err
+	}
+	return touchProfile(tx, id)
+}
+
+// Maximum number of rows inserted by a single statement in
+// CreateProfileConfig, keeping the number of parameters below SQLite's
+// default limit of 999.
+const profileConfigInsertBatchSize = 999 / 3
+
+// CreateProfileConfig adds a config to the profile with the given ID.
+//
+// Keys with empty values are skipped, while the other keys are inserted in
+// sorted order, using as few multi-row INSERT statements as possible.
+//
+// An error is returned if any of the keys is empty or only contains
+// whitespace, in which case nothing is inserted.
+func CreateProfileConfig(tx *sql.Tx, id int64, config map[string]string) error {
+	err := checkProfileMutable(tx, id)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(config))
+	for k, v := range config {
+		if strings.TrimSpace(k) == "" {
+			return fmt.Errorf("Invalid empty config key")
+		}
+		if v == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > profileConfigInsertBatchSize {
+			n = profileConfigInsertBatchSize
+		}
+
+		values := make([]string, n)
+		args := make([]interface{}, 0, n*3)
+		for i, k := range keys[:n] {
+			values[i] = "(?, ?, ?)"
+			args = append(args, id, k, config[k])
+		}
+
+		stmt := fmt.Sprintf("INSERT INTO profiles_config (profile_id, key, value) VALUES %s", strings.Join(values, ", "))
+		_, err := tx.Exec(stmt, args...)
+		if err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+// GetInstancesWithProfile gets the names of the containers associated with
+// the profile with the given name in the given project.
+func (c *Cluster) GetInstancesWithProfile(project, profile string) (map[string][]string, error) {
+	return c.GetInstancesWithProfileByType(project, profile, instancetype.Container)
+}
+
+// GetInstancesWithProfileByType gets the names of the instances of the given
+// type associated with the profile with the given name in the given project,
+// keyed by project name. Use instancetype.Any to get instances of all types.
+func (c *Cluster) GetInstancesWithProfileByType(project, profile string, instanceType instancetype.Type) (map[string][]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT instances.name, projects.name FROM instances
+		JOIN instances_profiles ON instances.id == instances_profiles.instance_id
+		JOIN projects ON projects.id == instances.project_id
+		WHERE instances_profiles.profile_id ==
+		  (SELECT profiles.id FROM profiles
+		   JOIN projects ON projects.id == profiles.project_id
+		   WHERE profiles.name=? AND projects.name=?)`
+
+	inargs := []interface{}{profile, project}
+	if instanceType != instancetype.Any {
+		q += " AND instances.type == ?"
+		inargs = append(inargs, instanceType)
+	}
+
+	results := map[string][]string{}
+	var instanceName string
+	var projectName string
+	outfmt := []interface{}{instanceName, projectName}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range output {
+		instanceName := r[0].(string)
+		projectName := r[1].(string)
+
+		if results[projectName] == nil {
+			results[projectName] = []string{}
+		}
+
+		results[projectName] = append(results[projectName], instanceName)
+	}
+
+	return results, nil
+}
+
+// GetProfilesByOwner returns the names of the profiles in the given project
+// owned by the given owner.
+func (c *Cluster) GetProfilesByOwner(project, owner string) ([]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name FROM profiles
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles.owner=?
+		ORDER BY profiles.name`
+
+	inargs := []interface{}{project, owner}
+	var name string
+	outfmt := []interface{}{name}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, r := range output {
+		names = append(names, r[0].(string))
+	}
+
+	return names, nil
+}
+
+// GetProfileInstanceTypeDistribution returns the number of instances using
+// the profile with the given name in the given project, grouped by instance
+// type (container or virtual-machine).
+func (c *Cluster) GetProfileInstanceTypeDistribution(project, name string) (map[string]int, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT instances.type, COUNT(*) FROM instances
+		JOIN instances_profiles ON instances.id == instances_profiles.instance_id
+		WHERE instances_profiles.profile_id ==
+		  (SELECT profiles.id FROM profiles
+		   JOIN projects ON projects.id == profiles.project_id
+		   WHERE profiles.name=? AND projects.name=?)
+		GROUP BY instances.type`
+
+	inargs := []interface{}{name, project}
+	var typ, count int
+	outfmt := []interface{}{typ, count}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string]int{}
+	for _, r := range output {
+		instanceType := instancetype.Type(r[0].(int))
+		results[instanceType.String()] = r[1].(int)
+	}
+
+	return results, nil
+}
+
+// GetProfilesReferencingImage returns the names of the profiles whose device
+// config references the image with the given fingerprint, grouped by project.
+func (c *Cluster) GetProfilesReferencingImage(fingerprint string) (map[string][]string, error) {
+	if fingerprint == "" {
+		return nil, fmt.Errorf("No image fingerprint provided")
+	}
+
+	q := `SELECT DISTINCT projects.name, profiles.name FROM profiles_devices_config
+		JOIN profiles_devices ON profiles_devices.id == profiles_devices_config.profile_device_id
+		JOIN profiles ON profiles.id == profiles_devices.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE instr(profiles_devices_config.value, ?) > 0
+		ORDER BY projects.name, profiles.name`
+
+	results := map[string][]string{}
+	inargs := []interface{}{fingerprint}
+	var project, name string
+	outfmt := []interface{}{project, name}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range output {
+		project := r[0].(string)
+		results[project] = append(results[project], r[1].(string))
+	}
+
+	return results, nil
+}
+
+// GetProfilesReferencingSecret returns the names of the profiles whose config
+// values reference the secret with the given ID, grouped by project.
+//
+// A value references a secret if it contains its ID.
+func (c *Cluster) GetProfilesReferencingSecret(secretID string) (map[string][]string, error) {
+	if secretID == "" {
+		return nil, fmt.Errorf("No secret ID provided")
+	}
+
+	q := `SELECT DISTINCT projects.name, profiles.name FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE instr(profiles_config.value, ?) > 0
+		ORDER BY projects.name, profiles.name`
+
+	results := map[string][]string{}
+	inargs := []interface{}{secretID}
+	var project, name string
+	outfmt := []interface{}{project, name}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range output {
+		project := r[0].(string)
+		results[project] = append(results[project], r[1].(string))
+	}
+
+	return results, nil
+}
+
+// GetProfileConfigByPrefix returns the config keys of the profile with the
+// given name that start with the given prefix, along with their values.
+func (c *Cluster) GetProfileConfigByPrefix(project, name, prefix string) (map[string]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		_, err = tx.GetProfileID(project, name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles_config.key, profiles_config.value FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles.name=? AND profiles_config.key LIKE ? ESCAPE '\'`
+
+	inargs := []interface{}{project, name, escapeLikePattern(prefix) + "%"}
+	var key string
+	var value string
+	outfmt := []interface{}{key, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	config := map[string]string{}
+	for _, r := range output {
+		config[r[0].(string)] = r[1].(string)
+	}
+
+	return config, nil
+}
+
+// GetProfilesWithBootConfig returns the profiles of the given project setting
+// any boot.* config key, mapped to their boot.* config.
+func (c *Cluster) GetProfilesWithBootConfig(project string) (map[string]map[string]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name, profiles_config.key, profiles_config.value FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles_config.key LIKE 'boot.%'`
+
+	inargs := []interface{}{project}
+	var name string
+	var key string
+	var value string
+	outfmt := []interface{}{name, key, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string]map[string]string{}
+	for _, r := range output {
+		name := r[0].(string)
+		if results[name] == nil {
+			results[name] = map[string]string{}
+		}
+		results[name][r[1].(string)] = r[2].(string)
+	}
+
+	return results, nil
+}
+
+// GetProfilesWithProxyDevices returns the profiles of the given project
+// defining proxy devices, mapped to the config of each of those devices by
+// device name.
+func (c *Cluster) GetProfilesWithProxyDevices(project string) (map[string]map[string]map[string]string, error) {
+	proxyType, err := dbDeviceTypeToInt("proxy")
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name, profiles_devices.name,
+		coalesce(profiles_devices_config.key, ''), coalesce(profiles_devices_config.value, '')
+		FROM profiles_devices
+		JOIN profiles ON profiles.id == profiles_devices.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		LEFT JOIN profiles_devices_config ON profiles_devices_config.profile_device_id == profiles_devices.id
+		WHERE projects.name=? AND profiles_devices.type=?`
+
+	inargs := []interface{}{project, proxyType}
+	var name string
+	var device string
+	var key string
+	var value string
+	outfmt := []interface{}{name, device, key, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string]map[string]map[string]string{}
+	for _, r := range output {
+		name := r[0].(string)
+		device := r[1].(string)
+		if results[name] == nil {
+			results[name] = map[string]map[string]string{}
+		}
+		if results[name][device] == nil {
+			results[name][device] = map[string]string{"type": "proxy"}
+		}
+		if r[2].(string) != "" {
+			results[name][device][r[2].(string)] = r[3].(string)
+		}
+	}
+
+	return results, nil
+}
+
+// GetProfilesWithGPUDevices returns the profiles of the given project
+// defining gpu devices, mapped to the sorted names of those devices.
+func (c *Cluster) GetProfilesWithGPUDevices(project string) (map[string][]string, error) {
+	gpuType, err := dbDeviceTypeToInt("gpu")
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name, profiles_devices.name FROM profiles_devices
+		JOIN profiles ON profiles.id == profiles_devices.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles_devices.type=?
+		ORDER BY profiles.name, profiles_devices.name`
+
+	inargs := []interface{}{project, gpuType}
+	var name string
+	var device string
+	outfmt := []interface{}{name, device}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string][]string{}
+	for _, r := range output {
+		name := r[0].(string)
+		results[name] = append(results[name], r[1].(string))
+	}
+
+	return results, nil
+}
+
+// Escape the LIKE wildcards in the given string, using '\' as escape
+// character.
+func escapeLikePattern(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(s)
+}
+
+// GetDeviceTypesInProject returns the sorted list of distinct device types
+// used by the profiles of the given project.
+func (c *Cluster) GetDeviceTypesInProject(project string) ([]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT DISTINCT profiles_devices.type FROM profiles_devices
+		JOIN profiles ON profiles.id == profiles_devices.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=?`
+
+	inargs := []interface{}{project}
+	var typ int
+	outfmt := []interface{}{typ}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	types := []string{}
+	for _, r := range output {
+		deviceType, err := dbDeviceTypeToString(r[0].(int))
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, deviceType)
+	}
+	sort.Strings(types)
+
+	return types, nil
+}
+
+// GetProfilesMissingDevice returns the names of the profiles in the given
+// project which don't have any device of the given type.
+func (c *Cluster) GetProfilesMissingDevice(project, deviceType string) ([]string, error) {
+	typeCode, err := dbDeviceTypeToInt(deviceType)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name FROM profiles
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND NOT EXISTS
+		  (SELECT 1 FROM profiles_devices
+		   WHERE profiles_devices.profile_id == profiles.id AND profiles_devices.type=?)
+		ORDER BY profiles.name`
+
+	inargs := []interface{}{project, typeCode}
+	var name string
+	outfmt := []interface{}{name}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, r := range output {
+		names = append(names, r[0].(string))
+	}
+
+	return names, nil
+}
+
+// GetProfileAttachmentMatrix returns, for each instance in the given project,
+// whether each of the profiles available to the project is attached to it.
+func (c *Cluster) GetProfileAttachmentMatrix(project string) (map[string]map[string]bool, error) {
+	profileProject := project
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			profileProject = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT instances.name, profiles.name,
+		  CASE WHEN instances_profiles.id IS NULL THEN 0 ELSE 1 END
+		FROM instances
+		JOIN projects AS instances_projects ON instances_projects.id == instances.project_id
+		CROSS JOIN profiles
+		JOIN projects AS profiles_projects ON profiles_projects.id == profiles.project_id
+		LEFT JOIN instances_profiles
+		  ON instances_profiles.instance_id == instances.id
+		  AND instances_profiles.profile_id == profiles.id
+		WHERE instances_projects.name=? AND profiles_projects.name=?`
+
+	inargs := []interface{}{project, profileProject}
+	var instance, profile string
+	var attached int
+	outfmt := []interface{}{instance, profile, attached}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	matrix := map[string]map[string]bool{}
+	for _, r := range output {
+		instance := r[0].(string)
+		if matrix[instance] == nil {
+			matrix[instance] = map[string]bool{}
+		}
+		matrix[instance][r[1].(string)] = r[2].(int) == 1
+	}
+
+	return matrix, nil
+}
+
+// GetProfilesExceedingDeviceCount returns the profiles in the given project
+// having more than max devices, mapped to their device count.
+func (c *Cluster) GetProfilesExceedingDeviceCount(project string, max int) (map[string]int, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name, COUNT(profiles_devices.id) FROM profiles
+		JOIN projects ON projects.id == profiles.project_id
+		LEFT JOIN profiles_devices ON profiles_devices.profile_id == profiles.id
+		WHERE projects.name=?
+		GROUP BY profiles.id
+		HAVING COUNT(profiles_devices.id) > ?`
+
+	inargs := []interface{}{project, max}
+	var name string
+	var count int
+	outfmt := []interface{}{name, count}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string]int{}
+	for _, r := range output {
+		results[r[0].(string)] = r[1].(int)
+	}
+
+	return results, nil
+}
+
+// UpdateProfilePoolReferences changes the "pool" config key of all disk
+// devices of all profiles across all projects from oldPool to newPool, and
+// returns the number of devices that were changed.
+func (c *Cluster) UpdateProfilePoolReferences(oldPool, newPool string) (int, error) {
+	diskType, err := dbDeviceTypeToInt("disk")
+	if err != nil {
+		return -1, err
+	}
+
+	count := 0
+	err = c.Transaction(func(tx *ClusterTx) error {
+		affected := `
+  SELECT profiles_devices.profile_id
+    FROM profiles_devices_config
+    JOIN profiles_devices ON profiles_devices.id = profiles_devices_config.profile_device_id
+   WHERE profiles_devices_config.key='pool' AND profiles_devices_config.value=? AND profiles_devices.type=?`
+
+		immutable, err := query.SelectStrings(
+			tx.tx, fmt.Sprintf("SELECT name FROM profiles WHERE immutable=1 AND id IN (%s) ORDER BY name", affected), oldPool, diskType)
+		if err != nil {
+			return errors.Wrap(err, "Check for immutable profiles")
+		}
+		if len(immutable) > 0 {
+			return errors.Wrapf(ErrProfileImmutable, "Update profile %q", immutable[0])
+		}
+
+		stmt := fmt.Sprintf("UPDATE profiles SET updated_at=? WHERE id IN (%s)", affected)
+		_, err = tx.tx.Exec(stmt, time.Now().UTC(), oldPool, diskType)
+		if err != nil {
+			return errors.Wrap(err, "Update profile timestamps")
+		}
+
+		stmt = `
+UPDATE profiles_devices_config SET value=?
+ WHERE key='pool' AND value=? AND profile_device_id IN (
+   SELECT id FROM profiles_devices WHERE type=?)
+`
+		result, err := tx.tx.Exec(stmt, newPool, oldPool, diskType)
+		if err != nil {
+			return errors.Wrap(err, "Update profile pool references")
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "Fetch affected rows")
+		}
+		count = int(n)
+
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return count, nil
+}
+
+// UpdateProfileNetworkReferences changes the "network" and "parent" config
+// keys of all nic devices of all profiles across all projects from oldNet to
+// newNet, and returns the number of config values that were changed.
+func (c *Cluster) UpdateProfileNetworkReferences(oldNet, newNet string) (int, error) {
+	nicType, err := dbDeviceTypeToInt("nic")
+	if err != nil {
+		return -1, err
+	}
+
+	count := 0
+	err = c.Transaction(func(tx *ClusterTx) error {
+		affected := `
+  SELECT profiles_devices.profile_id
+    FROM profiles_devices_config
+    JOIN profiles_devices ON profiles_devices.id = profiles_devices_config.profile_device_id
+   WHERE profiles_devices_config.key IN ('network', 'parent') AND profiles_devices_config.value=? AND profiles_devices.type=?`
+
+		immutable, err := query.SelectStrings(
+			tx.tx, fmt.Sprintf("SELECT name FROM profiles WHERE immutable=1 AND id IN (%s) ORDER BY name", affected), oldNet, nicType)
+		if err != nil {
+			return errors.Wrap(err, "Check for immutable profiles")
+		}
+		if len(immutable) > 0 {
+			return errors.Wrapf(ErrProfileImmutable, "Update profile %q", immutable[0])
+		}
+
+		stmt := fmt.Sprintf("UPDATE profiles SET updated_at=? WHERE id IN (%s)", affected)
+		_, err = tx.tx.Exec(stmt, time.Now().UTC(), oldNet, nicType)
+		if err != nil {
+			return errors.Wrap(err, "Update profile timestamps")
+		}
+
+		stmt = `
+UPDATE profiles_devices_config SET value=?
+ WHERE key IN ('network', 'parent') AND value=? AND profile_device_id IN (
+   SELECT id FROM profiles_devices WHERE type=?)
+`
+		result, err := tx.tx.Exec(stmt, newNet, oldNet, nicType)
+		if err != nil {
+			return errors.Wrap(err, "Update profile network references")
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "Fetch affected rows")
+		}
+		count = int(n)
+
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return count, nil
+}
+
+// ProfileDeviceRef identifies a device of a profile.
+type ProfileDeviceRef struct {
+	Project string
+	Profile string
+	Device  string
+}
+
+// UpdateProfilePoolReferencesDryRun returns the profile devices that
+// UpdateProfilePoolReferences would change if renaming the given pool,
+// without modifying anything.
+func (c *Cluster) UpdateProfilePoolReferencesDryRun(oldPool string) ([]ProfileDeviceRef, error) {
+	return c.getProfileDevicesWithConfigValue("disk", []string{"pool"}, oldPool)
+}
+
+// UpdateProfileNetworkReferencesDryRun returns the profile devices that
+// UpdateProfileNetworkReferences would change if renaming the given network,
+// without modifying anything.
+func (c *Cluster) UpdateProfileNetworkReferencesDryRun(oldNet string) ([]ProfileDeviceRef, error) {
+	return c.getProfileDevicesWithConfigValue("nic", []string{"network", "parent"}, oldNet)
+}
+
+// Return the profile devices of the given type, across all projects, having
+// any of the given config keys set to the given value. The result is sorted
+// by project, profile and device name.
+func (c *Cluster) getProfileDevicesWithConfigValue(deviceType string, keys []string, value string) ([]ProfileDeviceRef, error) {
+	typeCode, err := dbDeviceTypeToInt(deviceType)
+	if err != nil {
+		return nil, err
+	}
+
+	q := fmt.Sprintf(`SELECT DISTINCT projects.name, profiles.name, profiles_devices.name
+		FROM profiles_devices_config
+		JOIN profiles_devices ON profiles_devices.id == profiles_devices_config.profile_device_id
+		JOIN profiles ON profiles.id == profiles_devices.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE profiles_devices.type=? AND profiles_devices_config.value=?
+		AND profiles_devices_config.key IN %s
+		ORDER BY projects.name, profiles.name, profiles_devices.name`, query.Params(len(keys)))
+
+	inargs := []interface{}{typeCode, value}
+	for _, key := range keys {
+		inargs = append(inargs, key)
+	}
+	var project string
+	var profile string
+	var device string
+	outfmt := []interface{}{project, profile, device}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []ProfileDeviceRef{}
+	for _, r := range output {
+		refs = append(refs, ProfileDeviceRef{
+			Project: r[0].(string),
+			Profile: r[1].(string),
+			Device:  r[2].(string),
+		})
+	}
+
+	return refs, nil
+}
+
+// GetConfigKeyHistogram returns, for each config key set by any profile in
+// the given project, the number of profiles setting it.
+func (c *Cluster) GetConfigKeyHistogram(project string) (map[string]int, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles_config.key, COUNT(DISTINCT profiles_config.profile_id) FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=?
+		GROUP BY profiles_config.key`
+
+	inargs := []interface{}{project}
+	var key string
+	var count int
+	outfmt := []interface{}{key, count}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	histogram := map[string]int{}
+	for _, r := range output {
+		histogram[r[0].(string)] = r[1].(int)
+	}
+
+	return histogram, nil
+}
+
+// GetDeviceKeyHistogram returns, for each device config key used by any
+// profile in the given project, the number of profiles having at least one
+// device setting it.
+func (c *Cluster) GetDeviceKeyHistogram(project string) (map[string]int, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles_devices_config.key, COUNT(DISTINCT profiles_devices.profile_id)
+		FROM profiles_devices_config
+		JOIN profiles_devices ON profiles_devices.id == profiles_devices_config.profile_device_id
+		JOIN profiles ON profiles.id == profiles_devices.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=?
+		GROUP BY profiles_devices_config.key`
+
+	inargs := []interface{}{project}
+	var key string
+	var count int
+	outfmt := []interface{}{key, count}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	histogram := map[string]int{}
+	for _, r := range output {
+		histogram[r[0].(string)] = r[1].(int)
+	}
+
+	return histogram, nil
+}
+
+// GetProfileConfigOutliers returns the profiles of the given project whose
+// value for the given config key differs from the most common one, mapped to
+// their value.
+//
+// Profiles not setting the key are ignored. If several values are equally
+// common, the smallest one in lexical order is considered the reference.
+func (c *Cluster) GetProfileConfigOutliers(project, key string) (map[string]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name, profiles_config.value FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles_config.key=?`
+
+	inargs := []interface{}{project, key}
+	var name string
+	var value string
+	outfmt := []interface{}{name, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, r := range output {
+		counts[r[1].(string)]++
+	}
+
+	common := ""
+	for value, count := range counts {
+		if count > counts[common] || (count == counts[common] && value < common) {
+			common = value
+		}
+	}
+
+	outliers := map[string]string{}
+	for _, r := range output {
+		value := r[1].(string)
+		if value != common {
+			outliers[r[0].(string)] = value
+		}
+	}
+
+	return outliers, nil
+}
+
+// GetProfileConfigTypeReport returns, for each config key set by any profile
+// in the given project, the type inferred from the majority of its values:
+// "bool", "int", "bytes" or "string".
+//
+// If no type has a strict majority over the others, "string" is reported.
+func (c *Cluster) GetProfileConfigTypeReport(project string) (map[string]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles_config.key, profiles_config.value FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=?`
+
+	inargs := []interface{}{project}
+	var key string
+	var value string
+	outfmt := []interface{}{key, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]map[string]int{}
+	for _, r := range output {
+		key := r[0].(string)
+		if counts[key] == nil {
+			counts[key] = map[string]int{}
+		}
+		counts[key][profileConfigValueType(r[1].(string))]++
+	}
+
+	report := map[string]string{}
+	for key, types := range counts {
+		report[key] = "string"
+		best := 0
+		for typ, count := range types {
+			if count > best {
+				report[key] = typ
+				best = count
+			} else if count == best {
+				report[key] = "string"
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// Return the type of the given config value: "bool", "int", "bytes" or
+// "string".
+func profileConfigValueType(value string) string {
+	if shared.StringInSlice(strings.ToLower(value), []string{"true", "false", "yes", "no", "on", "off"}) {
+		return "bool"
+	}
+
+	_, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return "int"
+	}
+
+	_, err = units.ParseByteSizeString(value)
+	if err == nil {
+		return "bytes"
+	}
+
+	return "string"
+}
+
+// ProfileUser is an instance using a profile.
+type ProfileUser struct {
+	Project string
+	Name    string
+	Type    instancetype.Type
+}
+
+// GetProfileUsedBySorted returns a page of the instances using the profile
+// with the given name, sorted by the given field, along with the total number
+// of instances using it.
+//
+// The sortBy parameter must be either "name" or "type". Instances of the same
+// type are sorted by name, and instances with the same name by project.
+func (c *Cluster) GetProfileUsedBySorted(project, name string, offset, limit int, sortBy string) ([]ProfileUser, int, error) {
+	if !shared.StringInSlice(sortBy, []string{"name", "type"}) {
+		return nil, -1, fmt.Errorf("Invalid sort field %q", sortBy)
+	}
+
+	if offset < 0 {
+		return nil, -1, fmt.Errorf("Invalid offset %d", offset)
+	}
+
+	if limit < 1 {
+		return nil, -1, fmt.Errorf("Invalid limit %d", limit)
+	}
+
+	var id int64
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		id, err = tx.GetProfileID(project, name)
+		return err
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+
+	q := `SELECT projects.name, instances.name, instances.type FROM instances_profiles
+		JOIN instances ON instances.id == instances_profiles.instance_id
+		JOIN projects ON projects.id == instances.project_id
+		WHERE instances_profiles.profile_id=?`
+
+	inargs := []interface{}{id}
+	var instanceProject string
+	var instanceName string
+	var instanceType int
+	outfmt := []interface{}{instanceProject, instanceName, instanceType}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	users := make([]ProfileUser, len(output))
+	for i, r := range output {
+		users[i] = ProfileUser{
+			Project: r[0].(string),
+			Name:    r[1].(string),
+			Type:    instancetype.Type(r[2].(int)),
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		if sortBy == "type" && a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Project < b.Project
+	})
+
+	total := len(users)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+
+	return users[offset:end], total, nil
+}
+
+// SearchProfilesByConfigRegex returns the sorted names of the profiles of the
+// given project whose value for the given config key matches the given
+// regular expression.
+func (c *Cluster) SearchProfilesByConfigRegex(project, key, pattern string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid pattern")
+	}
+
+	err = c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles.name, profiles_config.value FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles_config.key=?
+		ORDER BY profiles.name`
+
+	inargs := []interface{}{project, key}
+	var name string
+	var value string
+	outfmt := []interface{}{name, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, r := range output {
+		if re.MatchString(r[1].(string)) {
+			names = append(names, r[0].(string))
+		}
+	}
+
+	return names, nil
+}
+
+// GetConfigMatrix returns the values of the given config keys for all
+// profiles in the given project, indexed by profile name and then by key.
+//
+// Keys that a profile doesn't set are omitted, and so are profiles that set
+// none of the given keys.
+func (c *Cluster) GetConfigMatrix(project string, keys []string) (map[string]map[string]string, error) {
+	matrix := map[string]map[string]string{}
+	if len(keys) == 0 {
+		return matrix, nil
+	}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := fmt.Sprintf(`SELECT profiles.name, profiles_config.key, profiles_config.value FROM profiles_config
+		JOIN profiles ON profiles.id == profiles_config.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles_config.key IN %s`, query.Params(len(keys)))
+
+	inargs := []interface{}{project}
+	for _, key := range keys {
+		inargs = append(inargs, key)
+	}
+	var name string
+	var key string
+	var value string
+	outfmt := []interface{}{name, key, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range output {
+		name := r[0].(string)
+		if matrix[name] == nil {
+			matrix[name] = map[string]string{}
+		}
+		matrix[name][r[1].(string)] = r[2].(string)
+	}
+
+	return matrix, nil
+}
+
+// GetProfileCreatedAt returns the time the profile with the given name was
+// created. Profiles created before this was tracked return the time at which
+// the schema update backfilled it.
+func (c *Cluster) GetProfileCreatedAt(project, name string) (time.Time, error) {
+	var createdAt time.Time
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profile, err := tx.GetProfile(project, name)
+		if err != nil {
+			return err
+		}
+
+		createdAt = profile.CreatedAt
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return createdAt, nil
+}
+
+// GetProfilesOlderThan returns the sorted names of the profiles in the given
+// project that were created more than the given age ago. The default profile
+// and profiles whose creation time is unknown are never returned.
+func (c *Cluster) GetProfilesOlderThan(project string, age time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-age)
+	names := []string{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
+		if err != nil {
+			return err
+		}
+
+		for _, profile := range profiles {
+			if profile.Name == "default" || profile.CreatedAt.IsZero() {
+				continue
+			}
+			if profile.CreatedAt.Before(cutoff) {
+				names = append(names, profile.Name)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// GetProfileDeviceConfigByPrefix returns the config keys of the given device
+// of the profile with the given name that start with the given prefix, along
+// with their values.
+func (c *Cluster) GetProfileDeviceConfigByPrefix(project, name, device, prefix string) (map[string]string, error) {
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profile, err := tx.GetProfile(project, name)
+		if err != nil {
+			return err
+		}
+
+		_, ok := profile.Devices[device]
+		if !ok {
+			return errors.Wrapf(ErrNoSuchObject, "Device %q", device)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	q := `SELECT profiles_devices_config.key, profiles_devices_config.value FROM profiles_devices_config
+		JOIN profiles_devices ON profiles_devices.id == profiles_devices_config.profile_device_id
+		JOIN profiles ON profiles.id == profiles_devices.profile_id
+		JOIN projects ON projects.id == profiles.project_id
+		WHERE projects.name=? AND profiles.name=? AND profiles_devices.name=?
+		AND profiles_devices_config.key LIKE ? ESCAPE '\'`
+
+	inargs := []interface{}{project, name, device, escapeLikePattern(prefix) + "%"}
+	var key string
+	var value string
+	outfmt := []interface{}{key, value}
+
+	output, err := queryScan(c, q, inargs, outfmt)
+	if err != nil {
+		return nil, err
+	}
+
+	config := map[string]string{}
+	for _, r := range output {
+		config[r[0].(string)] = r[1].(string)
+	}
+
+	return config, nil
+}
+
+// ProfileRedactedValue is the placeholder replacing the value of redacted
+// config keys.
+const ProfileRedactedValue = "[redacted]"
+
+// GetProfileRedacted returns the profile with the given name, with the values
+// of all config keys starting with any of the given prefixes replaced by
+// ProfileRedactedValue.
+func (c *Cluster) GetProfileRedacted(project, name string, secretKeyPrefixes []string) (*api.Profile, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range profile.Config {
+		for _, prefix := range secretKeyPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				profile.Config[key] = ProfileRedactedValue
+				break
+			}
+		}
+	}
+
+	return profile, nil
+}
+
+// SuggestProfileConfigKeys returns the sorted list of distinct config keys
+// starting with the given prefix that are set by any profile in the given
+// project.
+func (c *Cluster) SuggestProfileConfigKeys(project, prefix string) ([]string, error) {
+	var keys []string
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		stmt := `
+SELECT DISTINCT profiles_config.key FROM profiles_config
+  JOIN profiles ON profiles.id = profiles_config.profile_id
+  JOIN projects ON projects.id = profiles.project_id
+  WHERE projects.name = ? AND profiles_config.key LIKE ? ESCAPE '\'
+  ORDER BY profiles_config.key
+`
+		keys, err = query.SelectStrings(tx.tx, stmt, project, escapeLikePattern(prefix)+"%")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// SuggestProfileConfigValues returns the sorted list of distinct values
+// starting with the given prefix that profiles in the given project set for
+// the given config key.
+func (c *Cluster) SuggestProfileConfigValues(project, key, prefix string) ([]string, error) {
+	var values []string
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		stmt := `
+SELECT DISTINCT profiles_config.value FROM profiles_config
+  JOIN profiles ON profiles.id = profiles_config.profile_id
+  JOIN projects ON projects.id = profiles.project_id
+  WHERE projects.name = ? AND profiles_config.key = ? AND profiles_config.value LIKE ? ESCAPE '\'
+  ORDER BY profiles_config.value
+`
+		values, err = query.SelectStrings(tx.tx, stmt, project, key, escapeLikePattern(prefix)+"%")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return p
+	return values, nil
 }
 
-// ProfileFilter can be used to filter results yielded by ProfileList.
-type ProfileFilter struct {
-	Project string
-	Name    string
-}
+// GetProfilesBelowSchemaVersion returns the sorted names of the profiles in
+// the given project whose schema version is lower than the given one.
+func (c *Cluster) GetProfilesBelowSchemaVersion(project string, version int) ([]string, error) {
+	var names []string
 
-// GetProfileNames returns the names of all profiles in the given project.
-func (c *Cluster) GetProfileNames(project string) ([]string, error) {
 	err := c.Transaction(func(tx *ClusterTx) error {
 		enabled, err := tx.ProjectHasProfiles(project)
 		if err != nil {
@@ -95,38 +4512,151 @@ func (c *Cluster) GetProfileNames(project string) ([]string, error) {
 		if !enabled {
 			project = "default"
 		}
-		return nil
+
+		stmt := `
+SELECT profiles.name FROM profiles
+  JOIN projects ON projects.id = profiles.project_id
+  WHERE projects.name = ? AND profiles.schema_version < ?
+  ORDER BY profiles.name
+`
+		names, err = query.SelectStrings(tx.tx, stmt, project, version)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	q := fmt.Sprintf(`
-SELECT profiles.name
- FROM profiles
- JOIN projects ON projects.id = profiles.project_id
-WHERE projects.name = ?
-`)
-	inargs := []interface{}{project}
-	var name string
-	outfmt := []interface{}{name}
-	result, err := queryScan(c, q, inargs, outfmt)
+	return names, nil
+}
+
+// ProfileNestedValueKey is the key under which GetProfileNested stores the
+// value of a config key that is also the prefix of other keys.
+const ProfileNestedValueKey = "_value"
+
+// GetProfileNested returns the profile with the given name as nested maps,
+// with "name", "description", "config" and "devices" keys.
+//
+// Dotted config keys, and dotted keys of each device's config, are split into
+// nested maps, so "limits.cpu" becomes {"limits": {"cpu": ...}}. When a key
+// is both a leaf and a branch, like "user.a" and "user.a.b", the value of the
+// leaf is stored in the branch under ProfileNestedValueKey.
+func (c *Cluster) GetProfileNested(project, name string) (map[string]interface{}, error) {
+	_, profile, err := c.GetProfile(project, name)
 	if err != nil {
-		return []string{}, err
+		return nil, err
 	}
 
-	response := []string{}
-	for _, r := range result {
-		response = append(response, r[0].(string))
+	devices := map[string]interface{}{}
+	for device, config := range profile.Devices {
+		devices[device] = nestProfileConfig(config)
 	}
 
-	return response, nil
+	nested := map[string]interface{}{
+		"name":        profile.Name,
+		"description": profile.Description,
+		"config":      nestProfileConfig(profile.Config),
+		"devices":     devices,
+	}
+
+	return nested, nil
 }
 
-// GetProfile returns the profile with the given name.
-func (c *Cluster) GetProfile(project, name string) (int64, *api.Profile, error) {
-	var result *api.Profile
-	var id int64
+// Split the dotted keys of the given config into nested maps.
+func nestProfileConfig(config map[string]string) map[string]interface{} {
+	nested := map[string]interface{}{}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		node := nested
+
+		for _, part := range parts[:len(parts)-1] {
+			switch child := node[part].(type) {
+			case map[string]interface{}:
+				node = child
+			case string:
+				branch := map[string]interface{}{ProfileNestedValueKey: child}
+				node[part] = branch
+				node = branch
+			default:
+				branch := map[string]interface{}{}
+				node[part] = branch
+				node = branch
+			}
+		}
+
+		last := parts[len(parts)-1]
+		branch, ok := node[last].(map[string]interface{})
+		if ok {
+			branch[ProfileNestedValueKey] = config[key]
+		} else {
+			node[last] = config[key]
+		}
+	}
+
+	return nested
+}
+
+// GetProfileAsInventoryVars returns the config of the profile with the given
+// name as a map of variables suitable for an Ansible inventory.
+//
+// Variable names are the config keys with dots and dashes replaced by
+// underscores. The values "true" and "false" are converted to booleans and
+// decimal integers to int64, while all other values are kept as strings.
+func (c *Cluster) GetProfileAsInventoryVars(project, name string) (map[string]interface{}, error) {
+	_, profile, err := c.GetProfile(project, name)
+	if err != nil {
+		return nil, err
+	}
+
+	replacer := strings.NewReplacer(".", "_", "-", "_")
+
+	vars := map[string]interface{}{}
+	for key, value := range profile.Config {
+		vars[replacer.Replace(key)] = profileInventoryValue(value)
+	}
+
+	return vars, nil
+}
+
+// Convert the given config value to a bool or an integer, if it looks like
+// one.
+func profileInventoryValue(value string) interface{} {
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return n
+	}
+
+	return value
+}
+
+// ProfileMetric is a numeric sample of a profile config value.
+type ProfileMetric struct {
+	Profile string
+	Key     string
+	Value   float64
+}
+
+// GetProfileConfigMetrics returns a metric sample for each limits.* config
+// key of the profiles in the given project with a numeric value, sorted by
+// profile name and key.
+//
+// Byte sizes like "1GiB" are converted to bytes, while values that are not
+// numeric, like CPU ranges or percentages, are skipped.
+func (c *Cluster) GetProfileConfigMetrics(project string) ([]ProfileMetric, error) {
+	metrics := []ProfileMetric{}
 
 	err := c.Transaction(func(tx *ClusterTx) error {
 		enabled, err := tx.ProjectHasProfiles(project)
@@ -137,189 +4667,320 @@ func (c *Cluster) GetProfile(project, name string) (int64, *api.Profile, error)
 			project = "default"
 		}
 
-		profile, err := tx.GetProfile(project, name)
+		profiles, err := tx.GetProfiles(ProfileFilter{Project: project})
 		if err != nil {
 			return err
 		}
 
-		result = ProfileToAPI(profile)
-		id = int64(profile.ID)
+		for _, profile := range profiles {
+			for key, value := range profile.Config {
+				if !strings.HasPrefix(key, "limits.") {
+					continue
+				}
+
+				n, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					bytes, err := units.ParseByteSizeString(value)
+					if err != nil {
+						continue
+					}
+					n = float64(bytes)
+				}
+
+				metrics = append(metrics, ProfileMetric{Profile: profile.Name, Key: key, Value: n})
+			}
+		}
 
 		return nil
 	})
 	if err != nil {
-		return -1, nil, err
+		return nil, err
 	}
 
-	return id, result, nil
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Profile != metrics[j].Profile {
+			return metrics[i].Profile < metrics[j].Profile
+		}
+		return metrics[i].Key < metrics[j].Key
+	})
+
+	return metrics, nil
 }
 
-// GetProfiles returns the profiles with the given names in the given project.
-func (c *Cluster) GetProfiles(project string, names []string) ([]api.Profile, error) {
-	profiles := make([]api.Profile, len(names))
+// RemoveUnreferencedProfiles removes unreferenced profiles, returning the
+// total number of rows deleted.
+func (c *Cluster) RemoveUnreferencedProfiles() (int64, error) {
+	stmts := []string{
+		"DELETE FROM profiles_config WHERE profile_id NOT IN (SELECT id FROM profiles)",
+		"DELETE FROM profiles_devices WHERE profile_id NOT IN (SELECT id FROM profiles)",
+		"DELETE FROM profiles_devices_config WHERE profile_device_id NOT IN (SELECT id FROM profiles_devices)",
+	}
+
+	var deleted int64
 
 	err := c.Transaction(func(tx *ClusterTx) error {
-		enabled, err := tx.ProjectHasProfiles(project)
-		if err != nil {
-			return errors.Wrap(err, "Check if project has profiles")
-		}
-		if !enabled {
-			project = "default"
-		}
+		deleted = 0
+		for _, stmt := range stmts {
+			result, err := tx.tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
 
-		for i, name := range names {
-			profile, err := tx.GetProfile(project, name)
+			n, err := result.RowsAffected()
 			if err != nil {
-				return errors.Wrapf(err, "Load profile %q", name)
+				return errors.Wrap(err, "Fetch affected rows")
 			}
-			profiles[i] = *ProfileToAPI(profile)
+			deleted += n
 		}
 
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return -1, err
 	}
 
-	return profiles, nil
+	return deleted, nil
 }
 
-// UpdateProfileDescription updates the description of the profile with the given ID.
-func UpdateProfileDescription(tx *sql.Tx, id int64, description string) error {
-	_, err := tx.Exec("UPDATE profiles SET description=? WHERE id=?", description, id)
-	return err
+// MergeProfiles returns the config and devices resulting from stacking the
+// given profiles, with the same semantics as ExpandInstanceConfig and
+// ExpandInstanceDevices but without any instance-level layer on top.
+func MergeProfiles(profiles []api.Profile) (map[string]string, deviceConfig.Devices) {
+	return ExpandInstanceConfig(nil, profiles), ExpandInstanceDevices(nil, profiles)
 }
 
-// ClearProfileConfig resets the config of the profile with the given ID.
-func ClearProfileConfig(tx *sql.Tx, id int64) error {
-	_, err := tx.Exec("DELETE FROM profiles_config WHERE profile_id=?", id)
-	if err != nil {
-		return err
+// ExpandInstanceConfig expands the given instance config with the config
+// values of the given profiles.
+//
+// Profiles are applied in slice order, so values of later profiles override
+// the ones of earlier profiles, and the instance config overrides them all.
+// Both config and profiles may be nil. The returned map is always a new one,
+// and never aliases the given config.
+func ExpandInstanceConfig(config map[string]string, profiles []api.Profile) map[string]string {
+	if len(profiles) == 0 {
+		expandedConfig := make(map[string]string, len(config))
+		for k, v := range config {
+			expandedConfig[k] = v
+		}
+		return expandedConfig
 	}
 
-	_, err = tx.Exec(`DELETE FROM profiles_devices_config WHERE id IN
-		(SELECT profiles_devices_config.id
-		 FROM profiles_devices_config JOIN profiles_devices
-		 ON profiles_devices_config.profile_device_id=profiles_devices.id
-		 WHERE profiles_devices.profile_id=?)`, id)
-	if err != nil {
-		return err
+	expandedConfig, _ := ExpandInstanceConfigWithSource(config, profiles)
+	return expandedConfig
+}
+
+// ExpandInstanceConfigWithSource is like ExpandInstanceConfig, but also
+// returns a map associating each expanded config key with the name of the
+// profile whose value won, or "instance" for keys of the given instance
+// config.
+func ExpandInstanceConfigWithSource(config map[string]string, profiles []api.Profile) (map[string]string, map[string]string) {
+	expandedConfig := map[string]string{}
+	sources := map[string]string{}
+
+	// Apply all the profiles
+	for _, profile := range profiles {
+		for k, v := range profile.Config {
+			expandedConfig[k] = v
+			sources[k] = profile.Name
+		}
 	}
-	_, err = tx.Exec("DELETE FROM profiles_devices WHERE profile_id=?", id)
-	if err != nil {
-		return err
+
+	// Stick the given config on top
+	for k, v := range config {
+		expandedConfig[k] = v
+		sources[k] = "instance"
 	}
-	return nil
+
+	return expandedConfig, sources
 }
 
-// CreateProfileConfig adds a config to the profile with the given ID.
-func CreateProfileConfig(tx *sql.Tx, id int64, config map[string]string) error {
-	str := fmt.Sprintf("INSERT INTO profiles_config (profile_id, key, value) VALUES(?, ?, ?)")
-	stmt, err := tx.Prepare(str)
-	defer stmt.Close()
-	if err != nil {
-		return err
-	}
+// ExpandInstanceConfigWithNulls is like ExpandInstanceConfig, but a nil value
+// in the given instance config removes the key from the expanded config,
+// instead of overriding it.
+func ExpandInstanceConfigWithNulls(config map[string]*string, profiles []api.Profile) map[string]string {
+	expandedConfig := ExpandInstanceConfig(nil, profiles)
 
 	for k, v := range config {
-		if v == "" {
+		if v == nil {
+			delete(expandedConfig, k)
 			continue
 		}
+		expandedConfig[k] = *v
+	}
 
-		_, err = stmt.Exec(id, k, v)
-		if err != nil {
-			return err
+	return expandedConfig
+}
+
+// ExpandInstanceConfigBounded is like ExpandInstanceConfig, but returns an
+// error as soon as the expanded config would hold more than maxKeys keys.
+func ExpandInstanceConfigBounded(config map[string]string, profiles []api.Profile, maxKeys int) (map[string]string, error) {
+	expandedConfig := map[string]string{}
+
+	layers := make([]map[string]string, 0, len(profiles)+1)
+	for _, profile := range profiles {
+		layers = append(layers, profile.Config)
+	}
+	layers = append(layers, config)
+
+	for _, layer := range layers {
+		for k, v := range layer {
+			_, ok := expandedConfig[k]
+			if !ok && len(expandedConfig) >= maxKeys {
+				return nil, fmt.Errorf("Expanded config exceeds the maximum of %d keys", maxKeys)
+			}
+			expandedConfig[k] = v
 		}
 	}
 
-	return nil
+	return expandedConfig, nil
 }
 
-// GetInstancesWithProfile gets the names of the instance associated with the
-// profile with the given name in the given project.
-func (c *Cluster) GetInstancesWithProfile(project, profile string) (map[string][]string, error) {
-	err := c.Transaction(func(tx *ClusterTx) error {
-		enabled, err := tx.ProjectHasProfiles(project)
-		if err != nil {
-			return errors.Wrap(err, "Check if project has profiles")
+// ExpandInstanceConfigTraced is like ExpandInstanceConfig, but calls the given
+// trace function every time a layer sets a key, including when it overwrites
+// the value set by a previous layer.
+//
+// The source passed to trace is the name of the profile setting the key, or
+// "instance" for the given instance config. Keys within a layer are traced in
+// sorted order. A nil trace function is allowed, and makes this equivalent to
+// ExpandInstanceConfig.
+func ExpandInstanceConfigTraced(config map[string]string, profiles []api.Profile, trace func(key, value, source string)) map[string]string {
+	if trace == nil {
+		return ExpandInstanceConfig(config, profiles)
+	}
+
+	expandedConfig := map[string]string{}
+
+	apply := func(layer map[string]string, source string) {
+		keys := make([]string, 0, len(layer))
+		for k := range layer {
+			keys = append(keys, k)
 		}
-		if !enabled {
-			project = "default"
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			expandedConfig[k] = layer[k]
+			trace(k, layer[k], source)
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
 
-	q := `SELECT instances.name, projects.name FROM instances
-		JOIN instances_profiles ON instances.id == instances_profiles.instance_id
-		JOIN projects ON projects.id == instances.project_id
-		WHERE instances_profiles.profile_id ==
-		  (SELECT profiles.id FROM profiles
-		   JOIN projects ON projects.id == profiles.project_id
-		   WHERE profiles.name=? AND projects.name=?)
-		AND instances.type == 0`
+	for _, profile := range profiles {
+		apply(profile.Config, profile.Name)
+	}
 
-	results := map[string][]string{}
-	inargs := []interface{}{profile, project}
-	var name string
-	outfmt := []interface{}{name, name}
+	apply(config, "instance")
 
-	output, err := queryScan(c, q, inargs, outfmt)
-	if err != nil {
-		return nil, err
+	return expandedConfig
+}
+
+// ExpandInstanceConfigFiltered is like ExpandInstanceConfig, but only retains
+// the keys for which the given allow function returns true.
+func ExpandInstanceConfigFiltered(config map[string]string, profiles []api.Profile, allow func(key string) bool) map[string]string {
+	expandedConfig := map[string]string{}
+
+	layers := make([]map[string]string, 0, len(profiles)+1)
+	for _, profile := range profiles {
+		layers = append(layers, profile.Config)
 	}
+	layers = append(layers, config)
 
-	for _, r := range output {
-		if results[r[1].(string)] == nil {
-			results[r[1].(string)] = []string{}
+	for _, layer := range layers {
+		for k, v := range layer {
+			if !allow(k) {
+				continue
+			}
+			expandedConfig[k] = v
 		}
-
-		results[r[1].(string)] = append(results[r[1].(string)], r[0].(string))
 	}
 
-	return results, nil
+	return expandedConfig
 }
 
-// RemoveUnreferencedProfiles removes unreferenced profiles.
-func (c *Cluster) RemoveUnreferencedProfiles() error {
-	stmt := `
-DELETE FROM profiles_config WHERE profile_id NOT IN (SELECT id FROM profiles);
-DELETE FROM profiles_devices WHERE profile_id NOT IN (SELECT id FROM profiles);
-DELETE FROM profiles_devices_config WHERE profile_device_id NOT IN (SELECT id FROM profiles_devices);
-`
-	err := exec(c, stmt)
-	if err != nil {
-		return err
-	}
+// Possible actions of a ConflictSuggestion.
+const (
+	ConflictActionRename = "rename"
+	ConflictActionMerge  = "merge"
+	ConflictActionDrop   = "drop"
+)
 
-	return nil
+// ConflictSuggestion describes a possible way to resolve a conflict between
+// two profiles defining a device with the same name but a different config.
+type ConflictSuggestion struct {
+	Device string
+	Action string
+
+	// Profile whose device should be renamed or dropped. Empty for
+	// merges, which apply to both profiles.
+	Profile string
+
+	// New name of the device, for renames.
+	NewName string
+
+	// Config that the device should have in both profiles, for merges.
+	Config map[string]string
 }
 
-// ExpandInstanceConfig expands the given instance config with the config
-// values of the given profiles.
-func ExpandInstanceConfig(config map[string]string, profiles []api.Profile) map[string]string {
-	expandedConfig := map[string]string{}
+// SuggestDeviceConflictResolution returns suggestions for resolving the
+// conflicts between the devices of the two given profiles, sorted by device
+// name.
+//
+// For each device defined by both profiles with a different config it
+// suggests renaming the device of b, merging the two devices if they have the
+// same type, with the values of b winning as they would when b is applied
+// after a, and dropping the device of a.
+func SuggestDeviceConflictResolution(a, b api.Profile) []ConflictSuggestion {
+	names := []string{}
+	for name, device := range a.Devices {
+		other, ok := b.Devices[name]
+		if !ok {
+			continue
+		}
 
-	// Apply all the profiles
-	profileConfigs := make([]map[string]string, len(profiles))
-	for i, profile := range profiles {
-		profileConfigs[i] = profile.Config
+		added, removed, changed := diffProfileConfig(device, other)
+		if len(added) > 0 || len(removed) > 0 || len(changed) > 0 {
+			names = append(names, name)
+		}
 	}
+	sort.Strings(names)
 
-	for i := range profileConfigs {
-		for k, v := range profileConfigs[i] {
-			expandedConfig[k] = v
+	suggestions := []ConflictSuggestion{}
+	for _, name := range names {
+		device := a.Devices[name]
+		other := b.Devices[name]
+
+		newName := fmt.Sprintf("%s-%s", name, b.Name)
+		for i := 1; a.Devices[newName] != nil || b.Devices[newName] != nil; i++ {
+			newName = fmt.Sprintf("%s-%s%d", name, b.Name, i)
 		}
-	}
+		suggestions = append(suggestions, ConflictSuggestion{
+			Device:  name,
+			Action:  ConflictActionRename,
+			Profile: b.Name,
+			NewName: newName,
+		})
 
-	// Stick the given config on top
-	for k, v := range config {
-		expandedConfig[k] = v
+		if device["type"] == other["type"] {
+			merged := map[string]string{}
+			for k, v := range device {
+				merged[k] = v
+			}
+			for k, v := range other {
+				merged[k] = v
+			}
+			suggestions = append(suggestions, ConflictSuggestion{
+				Device: name,
+				Action: ConflictActionMerge,
+				Config: merged,
+			})
+		}
+
+		suggestions = append(suggestions, ConflictSuggestion{
+			Device:  name,
+			Action:  ConflictActionDrop,
+			Profile: a.Name,
+		})
 	}
 
-	return expandedConfig
+	return suggestions
 }
 
 // ExpandInstanceDevices expands the given instance devices with the devices
@@ -345,3 +5006,75 @@ func ExpandInstanceDevices(devices deviceConfig.Devices, profiles []api.Profile)
 
 	return expandedDevices
 }
+
+// ExpandInstanceDevicesWithSource is like ExpandInstanceDevices, but also
+// returns a map associating each expanded device name with the name of the
+// profile it comes from, or "instance" for the given instance devices.
+func ExpandInstanceDevicesWithSource(devices deviceConfig.Devices, profiles []api.Profile) (deviceConfig.Devices, map[string]string) {
+	expandedDevices := deviceConfig.Devices{}
+	sources := map[string]string{}
+
+	for _, profile := range profiles {
+		for k, v := range deviceConfig.NewDevices(profile.Devices) {
+			expandedDevices[k] = v
+			sources[k] = profile.Name
+		}
+	}
+
+	for k, v := range devices {
+		expandedDevices[k] = v
+		sources[k] = "instance"
+	}
+
+	return expandedDevices, sources
+}
+
+// ExpandInstanceDevicesWithLimits is like ExpandInstanceDevices, but after
+// merging it clamps device config values to the given per-type limits.
+//
+// The limits map is keyed by device type and then by config key, with the
+// maximum allowed value as value. Values are compared as byte sizes (plain
+// integers are accepted too); values or limits that can't be parsed are left
+// untouched.
+func ExpandInstanceDevicesWithLimits(devices deviceConfig.Devices, profiles []api.Profile, limits map[string]map[string]string) deviceConfig.Devices {
+	expandedDevices := ExpandInstanceDevices(devices, profiles)
+
+	for name, device := range expandedDevices {
+		typeLimits, ok := limits[device["type"]]
+		if !ok {
+			continue
+		}
+
+		cloned := false
+		for key, limit := range typeLimits {
+			value, ok := device[key]
+			if !ok {
+				continue
+			}
+
+			valueSize, err := units.ParseByteSizeString(value)
+			if err != nil {
+				continue
+			}
+
+			limitSize, err := units.ParseByteSizeString(limit)
+			if err != nil {
+				continue
+			}
+
+			if valueSize <= limitSize {
+				continue
+			}
+
+			// Don't modify the devices passed in by the caller.
+			if !cloned {
+				device = device.Clone()
+				expandedDevices[name] = device
+				cloned = true
+			}
+			device[key] = limit
+		}
+	}
+
+	return expandedDevices
+}
@@ -34,19 +34,19 @@ SELECT projects.name AS project, profiles.name
 `)
 
 var profileObjects = cluster.RegisterStmt(`
-SELECT profiles.id, projects.name AS project, profiles.name, coalesce(profiles.description, '')
+SELECT profiles.id, projects.name AS project, profiles.name, coalesce(profiles.description, ''), profiles.owner, profiles.created_at, profiles.updated_at, profiles.schema_version, profiles.deprecated, profiles.immutable
   FROM profiles JOIN projects ON profiles.project_id = projects.id
   ORDER BY projects.id, profiles.name
 `)
 
 var profileObjectsByProject = cluster.RegisterStmt(`
-SELECT profiles.id, projects.name AS project, profiles.name, coalesce(profiles.description, '')
+SELECT profiles.id, projects.name AS project, profiles.name, coalesce(profiles.description, ''), profiles.owner, profiles.created_at, profiles.updated_at, profiles.schema_version, profiles.deprecated, profiles.immutable
   FROM profiles JOIN projects ON profiles.project_id = projects.id
   WHERE project = ? ORDER BY projects.id, profiles.name
 `)
 
 var profileObjectsByProjectAndName = cluster.RegisterStmt(`
-SELECT profiles.id, projects.name AS project, profiles.name, coalesce(profiles.description, '')
+SELECT profiles.id, projects.name AS project, profiles.name, coalesce(profiles.description, ''), profiles.owner, profiles.created_at, profiles.updated_at, profiles.schema_version, profiles.deprecated, profiles.immutable
   FROM profiles JOIN projects ON profiles.project_id = projects.id
   WHERE project = ? AND profiles.name = ? ORDER BY projects.id, profiles.name
 `)
@@ -93,8 +93,8 @@ SELECT profiles.id FROM profiles JOIN projects ON profiles.project_id = projects
 `)
 
 var profileCreate = cluster.RegisterStmt(`
-INSERT INTO profiles (project_id, name, description)
-  VALUES ((SELECT projects.id FROM projects WHERE projects.name = ?), ?, ?)
+INSERT INTO profiles (project_id, name, description, owner, created_at, updated_at, schema_version, deprecated, immutable)
+  VALUES ((SELECT projects.id FROM projects WHERE projects.name = ?), ?, ?, ?, ?, ?, ?, ?, ?)
 `)
 
 var profileCreateConfigRef = cluster.RegisterStmt(`
@@ -129,12 +129,12 @@ DELETE FROM profiles_devices WHERE profile_id = ?
 
 var profileUpdate = cluster.RegisterStmt(`
 UPDATE profiles
-  SET project_id = (SELECT id FROM projects WHERE name = ?), name = ?, description = ?
+  SET project_id = (SELECT id FROM projects WHERE name = ?), name = ?, description = ?, owner = ?, created_at = ?, updated_at = ?, schema_version = ?, deprecated = ?, immutable = ?
  WHERE id = ?
 `)
 
-// GetProfileURIs returns all available profile URIs.
-func (c *ClusterTx) GetProfileURIs(filter ProfileFilter) ([]string, error) {
+// getProfileURIs returns all available profile URIs.
+func (c *ClusterTx) getProfileURIs(filter ProfileFilter) ([]string, error) {
 	// Check which filter criteria are active.
 	criteria := map[string]interface{}{}
 	if filter.Project != "" {
@@ -167,11 +167,11 @@ func (c *ClusterTx) GetProfileURIs(filter ProfileFilter) ([]string, error) {
 	code := cluster.EntityTypes["profile"]
 	formatter := cluster.EntityFormatURIs[code]
 
-	return query.SelectURIs(stmt, formatter, args...)
+	return query.SelectURIsCtx(c.ctx, stmt, formatter, args...)
 }
 
-// GetProfiles returns all available profiles.
-func (c *ClusterTx) GetProfiles(filter ProfileFilter) ([]Profile, error) {
+// getProfiles returns all available profiles.
+func (c *ClusterTx) getProfiles(filter ProfileFilter) ([]Profile, error) {
 	// Result slice.
 	objects := make([]Profile, 0)
 
@@ -212,11 +212,17 @@ func (c *ClusterTx) GetProfiles(filter ProfileFilter) ([]Profile, error) {
 			&objects[i].Project,
 			&objects[i].Name,
 			&objects[i].Description,
+			&objects[i].Owner,
+			&objects[i].CreatedAt,
+			&objects[i].UpdatedAt,
+			&objects[i].SchemaVersion,
+			&objects[i].Deprecated,
+			&objects[i].Immutable,
 		}
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch profiles")
 	}
@@ -321,7 +327,7 @@ func (c *ClusterTx) ProfileExists(project string, name string) (bool, error) {
 // GetProfileID return the ID of the profile with the given key.
 func (c *ClusterTx) GetProfileID(project string, name string) (int64, error) {
 	stmt := c.stmt(profileID)
-	rows, err := stmt.Query(project, name)
+	rows, err := stmt.QueryContext(c.ctx, project, name)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to get profile ID")
 	}
@@ -403,7 +409,7 @@ func (c *ClusterTx) ProfileConfigRef(filter ProfileFilter) (map[string]map[strin
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch  ref for profiles")
 	}
@@ -492,7 +498,7 @@ func (c *ClusterTx) ProfileDevicesRef(filter ProfileFilter) (map[string]map[stri
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch  ref for profiles")
 	}
@@ -587,7 +593,7 @@ func (c *ClusterTx) ProfileUsedByRef(filter ProfileFilter) (map[string]map[strin
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch string ref for profiles")
 	}
@@ -624,18 +630,24 @@ func (c *ClusterTx) CreateProfile(object Profile) (int64, error) {
 		return -1, fmt.Errorf("This profile already exists")
 	}
 
-	args := make([]interface{}, 3)
+	args := make([]interface{}, 9)
 
 	// Populate the statement arguments.
 	args[0] = object.Project
 	args[1] = object.Name
 	args[2] = object.Description
+	args[3] = object.Owner
+	args[4] = object.CreatedAt
+	args[5] = object.UpdatedAt
+	args[6] = object.SchemaVersion
+	args[7] = object.Deprecated
+	args[8] = object.Immutable
 
 	// Prepared statement to use.
 	stmt := c.stmt(profileCreate)
 
 	// Execute the statement.
-	result, err := stmt.Exec(args...)
+	result, err := stmt.ExecContext(c.ctx, args...)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to create profile")
 	}
@@ -648,7 +660,7 @@ func (c *ClusterTx) CreateProfile(object Profile) (int64, error) {
 	// Insert config reference.
 	stmt = c.stmt(profileCreateConfigRef)
 	for key, value := range object.Config {
-		_, err := stmt.Exec(id, key, value)
+		_, err := stmt.ExecContext(c.ctx, id, key, value)
 		if err != nil {
 			return -1, errors.Wrap(err, "Insert config for profile")
 		}
@@ -665,7 +677,7 @@ func (c *ClusterTx) CreateProfile(object Profile) (int64, error) {
 			return -1, errors.Wrapf(err, "Device type code for %s", typ)
 		}
 		stmt = c.stmt(profileCreateDevicesRef)
-		result, err := stmt.Exec(id, name, typCode)
+		result, err := stmt.ExecContext(c.ctx, id, name, typCode)
 		if err != nil {
 			return -1, errors.Wrapf(err, "Insert device %s", name)
 		}
@@ -675,7 +687,7 @@ func (c *ClusterTx) CreateProfile(object Profile) (int64, error) {
 		}
 		stmt = c.stmt(profileCreateDevicesConfigRef)
 		for key, value := range config {
-			_, err := stmt.Exec(deviceID, key, value)
+			_, err := stmt.ExecContext(c.ctx, deviceID, key, value)
 			if err != nil {
 				return -1, errors.Wrap(err, "Insert config for profile")
 			}
@@ -688,7 +700,7 @@ func (c *ClusterTx) CreateProfile(object Profile) (int64, error) {
 // RenameProfile renames the profile matching the given key parameters.
 func (c *ClusterTx) RenameProfile(project string, name string, to string) error {
 	stmt := c.stmt(profileRename)
-	result, err := stmt.Exec(to, project, name)
+	result, err := stmt.ExecContext(c.ctx, to, project, name)
 	if err != nil {
 		return errors.Wrap(err, "Rename profile")
 	}
@@ -706,7 +718,7 @@ func (c *ClusterTx) RenameProfile(project string, name string, to string) error
 // DeleteProfile deletes the profile matching the given key parameters.
 func (c *ClusterTx) DeleteProfile(project string, name string) error {
 	stmt := c.stmt(profileDelete)
-	result, err := stmt.Exec(project, name)
+	result, err := stmt.ExecContext(c.ctx, project, name)
 	if err != nil {
 		return errors.Wrap(err, "Delete profile")
 	}
@@ -722,15 +734,15 @@ func (c *ClusterTx) DeleteProfile(project string, name string) error {
 	return nil
 }
 
-// UpdateProfile updates the profile matching the given key parameters.
-func (c *ClusterTx) UpdateProfile(project string, name string, object Profile) error {
+// updateProfile updates the profile matching the given key parameters.
+func (c *ClusterTx) updateProfile(project string, name string, object Profile) error {
 	id, err := c.GetProfileID(project, name)
 	if err != nil {
 		return errors.Wrap(err, "Get profile")
 	}
 
 	stmt := c.stmt(profileUpdate)
-	result, err := stmt.Exec(object.Project, object.Name, object.Description, id)
+	result, err := stmt.ExecContext(c.ctx, object.Project, object.Name, object.Description, object.Owner, object.CreatedAt, object.UpdatedAt, object.SchemaVersion, object.Deprecated, object.Immutable, id)
 	if err != nil {
 		return errors.Wrap(err, "Update profile")
 	}
@@ -745,7 +757,7 @@ func (c *ClusterTx) UpdateProfile(project string, name string, object Profile) e
 
 	// Delete current config.
 	stmt = c.stmt(profileDeleteConfigRef)
-	_, err = stmt.Exec(id)
+	_, err = stmt.ExecContext(c.ctx, id)
 	if err != nil {
 		return errors.Wrap(err, "Delete current config")
 	}
@@ -756,7 +768,7 @@ func (c *ClusterTx) UpdateProfile(project string, name string, object Profile) e
 		if value == "" {
 			continue
 		}
-		_, err := stmt.Exec(id, key, value)
+		_, err := stmt.ExecContext(c.ctx, id, key, value)
 		if err != nil {
 			return errors.Wrap(err, "Insert config for profile")
 		}
@@ -764,7 +776,7 @@ func (c *ClusterTx) UpdateProfile(project string, name string, object Profile) e
 
 	// Delete current devices.
 	stmt = c.stmt(profileDeleteDevicesRef)
-	_, err = stmt.Exec(id)
+	_, err = stmt.ExecContext(c.ctx, id)
 	if err != nil {
 		return errors.Wrap(err, "Delete current devices")
 	}
@@ -780,7 +792,7 @@ func (c *ClusterTx) UpdateProfile(project string, name string, object Profile) e
 			return errors.Wrapf(err, "Device type code for %s", typ)
 		}
 		stmt = c.stmt(profileCreateDevicesRef)
-		result, err := stmt.Exec(id, name, typCode)
+		result, err := stmt.ExecContext(c.ctx, id, name, typCode)
 		if err != nil {
 			return errors.Wrapf(err, "Insert device %s", name)
 		}
@@ -793,7 +805,7 @@ func (c *ClusterTx) UpdateProfile(project string, name string, object Profile) e
 			if value == "" {
 				continue
 			}
-			_, err := stmt.Exec(deviceID, key, value)
+			_, err := stmt.ExecContext(c.ctx, deviceID, key, value)
 			if err != nil {
 				return errors.Wrap(err, "Insert config for profile")
 			}
@@ -0,0 +1,129 @@
+// +build linux,cgo,!agent
+
+package db
+
+import (
+	"sync"
+	"time"
+
+	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+)
+
+// ProfileExpander expands instance config and devices with the profiles they
+// use, caching the layer contributed by each profile across expansions.
+//
+// The cached layer of a profile is reused only as long as the profile's
+// checksum (see ProfileChecksum) doesn't change. The checksum is not even
+// computed again if the cached layer was computed from an immutable profile
+// and the profile hasn't been modified since, for example to clear its
+// immutable flag and edit it.
+type ProfileExpander struct {
+	mu     sync.Mutex
+	layers map[profileLayerKey]*profileLayer
+
+	computed int // Number of layers computed so far
+}
+
+// Identify the profile a cached layer was computed from. The project and
+// name are included too, so a layer isn't reused if the ID of a deleted
+// profile gets reused by a new one.
+type profileLayerKey struct {
+	id      int
+	project string
+	name    string
+}
+
+// The config and devices contributed by a single profile, along with the
+// state of the profile they were computed from.
+type profileLayer struct {
+	checksum  string
+	immutable bool
+	updatedAt time.Time
+	config    map[string]string
+	devices   deviceConfig.Devices
+}
+
+// NewProfileExpander returns a new ProfileExpander with an empty cache.
+func NewProfileExpander() *ProfileExpander {
+	return &ProfileExpander{
+		layers: map[profileLayerKey]*profileLayer{},
+	}
+}
+
+// Return the ProfileExpander shared by all instance config expansions
+// performed through this cluster database.
+func (c *Cluster) profileExpander() *ProfileExpander {
+	c.expanderOnce.Do(func() {
+		c.expander = NewProfileExpander()
+	})
+
+	return c.expander
+}
+
+// Expand returns the given instance config and devices expanded with the
+// given profiles, applied in order, with the instance's own config and
+// devices on top. It's equivalent to calling ExpandInstanceConfig and
+// ExpandInstanceDevices.
+func (e *ProfileExpander) Expand(config map[string]string, devices deviceConfig.Devices, profiles []Profile) (map[string]string, deviceConfig.Devices) {
+	expandedConfig := map[string]string{}
+	expandedDevices := deviceConfig.Devices{}
+
+	for i := range profiles {
+		layer := e.layer(&profiles[i])
+
+		for k, v := range layer.config {
+			expandedConfig[k] = v
+		}
+
+		// Clone the cached devices, so callers can't modify them.
+		for k, v := range layer.devices {
+			expandedDevices[k] = v.Clone()
+		}
+	}
+
+	for k, v := range config {
+		expandedConfig[k] = v
+	}
+
+	for k, v := range devices {
+		expandedDevices[k] = v
+	}
+
+	return expandedConfig, expandedDevices
+}
+
+// Return the layer of the given profile, computing it if it's not cached yet
+// or if its cached version is stale.
+func (e *ProfileExpander) layer(profile *Profile) *profileLayer {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := profileLayerKey{id: profile.ID, project: profile.Project, name: profile.Name}
+	layer, ok := e.layers[key]
+	if ok && layer.immutable && profile.Immutable && layer.updatedAt.Equal(profile.UpdatedAt) {
+		return layer
+	}
+
+	checksum := ProfileChecksum(ProfileToAPI(profile))
+	if ok && layer.checksum == checksum {
+		layer.immutable = profile.Immutable
+		layer.updatedAt = profile.UpdatedAt
+		return layer
+	}
+
+	layer = &profileLayer{
+		checksum:  checksum,
+		immutable: profile.Immutable,
+		updatedAt: profile.UpdatedAt,
+		config:    make(map[string]string, len(profile.Config)),
+		devices:   deviceConfig.NewDevices(profile.Devices),
+	}
+	for k, v := range profile.Config {
+		layer.config[k] = v
+	}
+
+	e.layers[key] = layer
+	e.computed++
+
+	return layer
+}
@@ -0,0 +1,11 @@
+// +build linux,cgo,!agent
+
+package db
+
+// Computed returns the number of profile layers computed so far.
+func (e *ProfileExpander) Computed() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.computed
+}
@@ -0,0 +1,139 @@
+// +build linux,cgo,!agent
+
+package db_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/lxd/db"
+	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+)
+
+// The layer of an immutable profile is computed only once, while the one of a
+// regular profile is recomputed when the profile changes.
+func TestProfileExpander(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	var profiles []db.Profile
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "base",
+			Config:  map[string]string{"limits.cpu": "1", "limits.memory": "1GiB"},
+			Devices: map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "default"}},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "web",
+			Config:  map[string]string{"limits.cpu": "2"},
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.SetProfileImmutable("default", "base", true)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range []string{"base", "web"} {
+			profile, err := tx.GetProfile("default", name)
+			if err != nil {
+				return err
+			}
+			profiles = append(profiles, *profile)
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, profiles[0].Immutable)
+	require.False(t, profiles[1].Immutable)
+
+	expander := db.NewProfileExpander()
+	config := map[string]string{"user.foo": "bar"}
+	devices := deviceConfig.Devices{"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"}}
+
+	for i := 0; i < 10; i++ {
+		expandedConfig, expandedDevices := expander.Expand(config, devices, profiles)
+		assert.Equal(t, map[string]string{"limits.cpu": "2", "limits.memory": "1GiB", "user.foo": "bar"}, expandedConfig)
+		assert.Equal(t, deviceConfig.Devices{
+			"root": {"type": "disk", "path": "/", "pool": "default"},
+			"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+		}, expandedDevices)
+
+		// Modifying the result doesn't affect the cache.
+		expandedDevices["root"]["pool"] = "other"
+	}
+	assert.Equal(t, 2, expander.Computed())
+
+	// A change to the regular profile invalidates only its own layer.
+	profiles[1].Config = map[string]string{"limits.cpu": "4"}
+	for i := 0; i < 10; i++ {
+		expandedConfig, _ := expander.Expand(config, devices, profiles)
+		assert.Equal(t, map[string]string{"limits.cpu": "4", "limits.memory": "1GiB", "user.foo": "bar"}, expandedConfig)
+	}
+	assert.Equal(t, 3, expander.Computed())
+}
+
+// A layer cached while a profile was regular is not reused once the profile
+// gets modified and marked as immutable.
+func TestProfileExpander_MarkedImmutableAfterChange(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	load := func() []db.Profile {
+		var profile *db.Profile
+		err := cluster.Transaction(func(tx *db.ClusterTx) error {
+			var err error
+			profile, err = tx.GetProfile("default", "base")
+			return err
+		})
+		require.NoError(t, err)
+		return []db.Profile{*profile}
+	}
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "base",
+			Config:  map[string]string{"limits.cpu": "1"},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	expander := db.NewProfileExpander()
+	config, _ := expander.Expand(nil, nil, load())
+	assert.Equal(t, map[string]string{"limits.cpu": "1"}, config)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile, err := tx.GetProfile("default", "base")
+		if err != nil {
+			return err
+		}
+		profile.Config = map[string]string{"limits.cpu": "2"}
+		err = tx.UpdateProfile("default", "base", *profile)
+		if err != nil {
+			return err
+		}
+		return tx.SetProfileImmutable("default", "base", true)
+	})
+	require.NoError(t, err)
+
+	config, _ = expander.Expand(nil, nil, load())
+	assert.Equal(t, map[string]string{"limits.cpu": "2"}, config)
+	assert.Equal(t, 2, expander.Computed())
+
+	config, _ = expander.Expand(nil, nil, load())
+	assert.Equal(t, map[string]string{"limits.cpu": "2"}, config)
+	assert.Equal(t, 2, expander.Computed())
+}
@@ -0,0 +1,14 @@
+// +build linux,cgo,!agent
+
+package db
+
+// SetWalkProfilesBatchSize changes the number of profiles loaded at once by
+// WalkProfiles, returning a function restoring the previous value.
+func SetWalkProfilesBatchSize(n int) func() {
+	previous := walkProfilesBatchSize
+	walkProfilesBatchSize = n
+
+	return func() {
+		walkProfilesBatchSize = previous
+	}
+}
@@ -0,0 +1,402 @@
+// +build linux,cgo,!agent
+
+package db
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/lxc/lxd/lxd/db/query"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// ProfileRevision is a stored copy of the description, config and devices of
+// a profile at a certain point in time.
+type ProfileRevision struct {
+	Revision    int
+	Description string
+	Config      map[string]string
+	Devices     map[string]map[string]string
+	Author      string
+	CreatedAt   time.Time
+}
+
+// ToAPI returns an API profile with the given name holding the content of the
+// revision.
+func (r *ProfileRevision) ToAPI(name string) *api.Profile {
+	p := &api.Profile{Name: name}
+	p.Description = r.Description
+	p.Config = r.Config
+	p.Devices = r.Devices
+
+	return p
+}
+
+// CreateProfileRevision stores the current description, config and devices of
+// the profile with the given name as a new revision, and returns its number.
+//
+// Revision numbers start at 1 and increase by one each time.
+func (c *Cluster) CreateProfileRevision(project, name, author string) (int, error) {
+	revision := -1
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profile, err := tx.GetProfile(project, name)
+		if err != nil {
+			return err
+		}
+
+		revision, err = tx.createProfileRevision(profile, author)
+		return err
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	return revision, nil
+}
+
+// GetProfileRevisions returns all stored revisions of the profile with the
+// given name, oldest first.
+func (c *Cluster) GetProfileRevisions(project, name string) ([]ProfileRevision, error) {
+	var revisions []ProfileRevision
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		id, err := tx.GetProfileID(project, name)
+		if err != nil {
+			return err
+		}
+
+		revisions, err = tx.getProfileRevisions(id, -1)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// GetProfileRevision returns the revision with the given number of the profile
+// with the given name.
+func (c *Cluster) GetProfileRevision(project, name string, rev int) (*ProfileRevision, error) {
+	var revision *ProfileRevision
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		id, err := tx.GetProfileID(project, name)
+		if err != nil {
+			return err
+		}
+
+		revision, err = tx.getProfileRevision(id, rev)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revision, nil
+}
+
+// GetProfileRevisionDiff returns the changes between the two revisions with
+// the given numbers of the profile with the given name.
+func (c *Cluster) GetProfileRevisionDiff(project, name string, fromRev, toRev int) (ProfileChange, error) {
+	var from *ProfileRevision
+	var to *ProfileRevision
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		id, err := tx.GetProfileID(project, name)
+		if err != nil {
+			return err
+		}
+
+		from, err = tx.getProfileRevision(id, fromRev)
+		if err != nil {
+			return errors.Wrapf(err, "Load revision %d", fromRev)
+		}
+
+		to, err = tx.getProfileRevision(id, toRev)
+		if err != nil {
+			return errors.Wrapf(err, "Load revision %d", toRev)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return ProfileChange{}, err
+	}
+
+	return ProfileDiff(from.ToAPI(name), to.ToAPI(name)), nil
+}
+
+// RollbackProfileToRevision replaces the description, config and devices of
+// the profile with the given name with the ones stored in the revision with
+// the given number, and records the result as a new revision.
+func (c *Cluster) RollbackProfileToRevision(project, name string, rev int) error {
+	return c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profile, err := tx.GetProfile(project, name)
+		if err != nil {
+			return err
+		}
+
+		revision, err := tx.getProfileRevision(int64(profile.ID), rev)
+		if err != nil {
+			return errors.Wrapf(err, "Load revision %d", rev)
+		}
+
+		profile.Description = revision.Description
+		profile.Config = revision.Config
+		profile.Devices = revision.Devices
+		profile.UpdatedAt = time.Now().UTC()
+
+		err = tx.UpdateProfile(project, name, *profile)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.createProfileRevision(profile, "")
+		return err
+	})
+}
+
+// GetProfileChangeFrequency returns, for each profile of the given project
+// having revisions created after the given time, the number of such
+// revisions.
+func (c *Cluster) GetProfileChangeFrequency(project string, since time.Time) (map[string]int, error) {
+	frequency := map[string]int{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		stmt := `
+SELECT profiles.name, COUNT(*) FROM profiles_revisions
+  JOIN profiles ON profiles.id = profiles_revisions.profile_id
+  JOIN projects ON projects.id = profiles.project_id
+  WHERE projects.name = ? AND profiles_revisions.created_at > ?
+  GROUP BY profiles.id
+`
+		rows, err := tx.tx.Query(stmt, project, since.UTC())
+		if err != nil {
+			return errors.Wrap(err, "Fetch profile revisions")
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var name string
+			var count int
+
+			err := rows.Scan(&name, &count)
+			if err != nil {
+				return err
+			}
+
+			frequency[name] = count
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return frequency, nil
+}
+
+// GetProfileAuthorStats returns, for each author of revisions of profiles in
+// the given project, the number of such revisions. Revisions without an
+// author are not counted.
+func (c *Cluster) GetProfileAuthorStats(project string) (map[string]int, error) {
+	stats := map[string]int{}
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		stmt := `
+SELECT profiles_revisions.author, COUNT(*) FROM profiles_revisions
+  JOIN profiles ON profiles.id = profiles_revisions.profile_id
+  JOIN projects ON projects.id = profiles.project_id
+  WHERE projects.name = ? AND profiles_revisions.author != ''
+  GROUP BY profiles_revisions.author
+`
+		rows, err := tx.tx.Query(stmt, project)
+		if err != nil {
+			return errors.Wrap(err, "Fetch profile revisions")
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var author string
+			var count int
+
+			err := rows.Scan(&author, &count)
+			if err != nil {
+				return err
+			}
+
+			stats[author] = count
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// GetProfileETag returns the ETag of the profile with the given name, as
+// computed by ProfileETag. It's the ETag that UpdateProfileIfMatch expects.
+func (c *Cluster) GetProfileETag(project, name string) (string, error) {
+	var profile *Profile
+
+	err := c.Transaction(func(tx *ClusterTx) error {
+		enabled, err := tx.ProjectHasProfiles(project)
+		if err != nil {
+			return errors.Wrap(err, "Check if project has profiles")
+		}
+		if !enabled {
+			project = "default"
+		}
+
+		profile, err = tx.GetProfile(project, name)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return ProfileETag(ProfileToAPI(profile)), nil
+}
+
+// Store the content of the given profile as its next revision.
+func (c *ClusterTx) createProfileRevision(profile *Profile, author string) (int, error) {
+	revisions, err := query.SelectIntegers(
+		c.tx, "SELECT coalesce(max(revision), 0) FROM profiles_revisions WHERE profile_id = ?", profile.ID)
+	if err != nil {
+		return -1, errors.Wrap(err, "Fetch last profile revision")
+	}
+	revision := revisions[0] + 1
+
+	content := ProfileCanonicalText(ProfileToAPI(profile))
+
+	_, err = c.tx.Exec(`
+INSERT INTO profiles_revisions (profile_id, revision, description, content, author, created_at)
+  VALUES (?, ?, ?, ?, ?, ?)
+`, profile.ID, revision, profile.Description, content, author, time.Now().UTC())
+	if err != nil {
+		return -1, errors.Wrap(err, "Insert profile revision")
+	}
+
+	return revision, nil
+}
+
+// Return the revisions of the profile with the given ID, oldest first. If rev
+// is not negative, only the revision with that number is returned.
+func (c *ClusterTx) getProfileRevisions(id int64, rev int) ([]ProfileRevision, error) {
+	stmt := `
+SELECT revision, description, content, author, created_at FROM profiles_revisions
+  WHERE profile_id = ? AND (? < 0 OR revision = ?)
+  ORDER BY revision
+`
+	rows, err := c.tx.Query(stmt, id, rev, rev)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fetch profile revisions")
+	}
+	defer rows.Close()
+
+	revisions := []ProfileRevision{}
+	for rows.Next() {
+		revision := ProfileRevision{}
+		var content string
+
+		err := rows.Scan(&revision.Revision, &revision.Description, &content, &revision.Author, &revision.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		revision.Config, revision.Devices, err = ParseProfileCanonicalText(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Parse profile revision %d", revision.Revision)
+		}
+
+		revisions = append(revisions, revision)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// Return the revision with the given number of the profile with the given ID.
+func (c *ClusterTx) getProfileRevision(id int64, rev int) (*ProfileRevision, error) {
+	if rev < 0 {
+		return nil, ErrNoSuchObject
+	}
+
+	revisions, err := c.getProfileRevisions(id, rev)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(revisions) == 0 {
+		return nil, ErrNoSuchObject
+	}
+
+	return &revisions[0], nil
+}
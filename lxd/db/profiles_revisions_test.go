@@ -0,0 +1,287 @@
+// +build linux,cgo,!agent
+
+package db_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/shared/api"
+)
+
+func TestGetProfileRevisionDiff(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config:  map[string]string{"limits.cpu": "1", "user.a": "x"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	updates := []db.Profile{
+		{
+			Config: map[string]string{"limits.cpu": "2", "user.a": "x"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		},
+		{
+			Description: "Changed",
+			Config:      map[string]string{"limits.cpu": "4", "limits.memory": "1GiB"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "fast"},
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		},
+	}
+
+	rev, err := cluster.CreateProfileRevision("default", "p1", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, 1, rev)
+
+	for i, update := range updates {
+		err = cluster.Transaction(func(tx *db.ClusterTx) error {
+			update.Project = "default"
+			update.Name = "p1"
+			return tx.UpdateProfile("default", "p1", update)
+		})
+		require.NoError(t, err)
+
+		rev, err := cluster.CreateProfileRevision("default", "p1", "alice")
+		require.NoError(t, err)
+		assert.Equal(t, i+2, rev)
+	}
+
+	revisions, err := cluster.GetProfileRevisions("default", "p1")
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, "alice", revisions[0].Author)
+	assert.Equal(t, "2", revisions[1].Config["limits.cpu"])
+
+	change, err := cluster.GetProfileRevisionDiff("default", "p1", 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, &db.ProfileValueChange{Old: "", New: "Changed"}, change.Description)
+	assert.Equal(t, map[string]string{"limits.memory": "1GiB"}, change.ConfigAdded)
+	assert.Equal(t, map[string]string{"user.a": "x"}, change.ConfigRemoved)
+	assert.Equal(t, map[string]db.ProfileValueChange{"limits.cpu": {Old: "1", New: "4"}}, change.ConfigChanged)
+	assert.Equal(t, map[string]map[string]string{"eth0": {"type": "nic", "network": "lxdbr0"}}, change.DevicesAdded)
+	assert.Equal(t, map[string]map[string]string{}, change.DevicesRemoved)
+	assert.Equal(t, map[string]string{}, change.DevicesChanged["root"].Added)
+	assert.Equal(t, map[string]db.ProfileValueChange{"pool": {Old: "default", New: "fast"}}, change.DevicesChanged["root"].Changed)
+
+	_, err = cluster.GetProfileRevisionDiff("default", "p1", 1, 4)
+	assert.EqualError(t, err, "Load revision 4: No such object")
+}
+
+func TestRollbackProfileToRevision(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project:     "default",
+			Name:        "p1",
+			Description: "First",
+			Config:      map[string]string{"limits.cpu": "1"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	_, err = cluster.CreateProfileRevision("default", "p1", "alice")
+	require.NoError(t, err)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.UpdateProfile("default", "p1", db.Profile{
+			Project:     "default",
+			Name:        "p1",
+			Description: "Second",
+			Config:      map[string]string{"limits.cpu": "2", "limits.memory": "1GiB"},
+		})
+	})
+	require.NoError(t, err)
+
+	_, err = cluster.CreateProfileRevision("default", "p1", "bob")
+	require.NoError(t, err)
+
+	err = cluster.RollbackProfileToRevision("default", "p1", 1)
+	require.NoError(t, err)
+
+	_, profile, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "First", profile.Description)
+	assert.Equal(t, map[string]string{"limits.cpu": "1"}, profile.Config)
+	assert.Equal(t, map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "default"},
+	}, profile.Devices)
+
+	revisions, err := cluster.GetProfileRevisions("default", "p1")
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, revisions[0].Config, revisions[2].Config)
+
+	err = cluster.RollbackProfileToRevision("default", "p1", 10)
+	assert.EqualError(t, err, "Load revision 10: No such object")
+}
+
+func TestGetProfileChangeFrequency(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"p1", "p2", "p3"} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = cluster.CreateProfileRevision("default", "p3", "")
+	require.NoError(t, err)
+
+	since := time.Now()
+
+	for name, n := range map[string]int{"p1": 3, "p2": 1} {
+		for i := 0; i < n; i++ {
+			_, err := cluster.CreateProfileRevision("default", name, "")
+			require.NoError(t, err)
+		}
+	}
+
+	frequency, err := cluster.GetProfileChangeFrequency("default", since)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"p1": 3, "p2": 1}, frequency)
+
+	frequency, err = cluster.GetProfileChangeFrequency("default", since.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"p1": 3, "p2": 1, "p3": 1}, frequency)
+}
+
+func TestGetProfileAuthorStats(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProject(api.ProjectsPost{
+			Name: "other",
+			ProjectPut: api.ProjectPut{
+				Config: map[string]string{"features.profiles": "true"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, profile := range []db.Profile{
+			{Project: "default", Name: "p1"},
+			{Project: "default", Name: "p2"},
+			{Project: "other", Name: "p1"},
+		} {
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	revisions := []struct {
+		project string
+		name    string
+		author  string
+	}{
+		{"default", "p1", "alice"},
+		{"default", "p1", "bob"},
+		{"default", "p2", "alice"},
+		{"default", "p2", ""},
+		{"other", "p1", "bob"},
+	}
+	for _, r := range revisions {
+		_, err := cluster.CreateProfileRevision(r.project, r.name, r.author)
+		require.NoError(t, err)
+	}
+
+	stats, err := cluster.GetProfileAuthorStats("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"alice": 2, "bob": 1}, stats)
+
+	stats, err = cluster.GetProfileAuthorStats("other")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"bob": 1}, stats)
+}
+
+func TestGetProfileETag(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config:  map[string]string{"limits.cpu": "1"},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	etag1, err := cluster.GetProfileETag("default", "p1")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(etag1, `W/"`))
+
+	etag2, err := cluster.GetProfileETag("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, etag1, etag2)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.UpdateProfile("default", "p1", db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config:  map[string]string{"limits.cpu": "2"},
+		})
+	})
+	require.NoError(t, err)
+
+	etag3, err := cluster.GetProfileETag("default", "p1")
+	require.NoError(t, err)
+	assert.NotEqual(t, etag1, etag3)
+
+	// Changes that don't go through UpdateProfile bump the last
+	// modification time too.
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.SetProfileDeprecated("default", "p1", true)
+	})
+	require.NoError(t, err)
+
+	etag4, err := cluster.GetProfileETag("default", "p1")
+	require.NoError(t, err)
+	assert.NotEqual(t, etag3, etag4)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.TouchProfile("default", "p1")
+	})
+	require.NoError(t, err)
+
+	etag5, err := cluster.GetProfileETag("default", "p1")
+	require.NoError(t, err)
+	assert.NotEqual(t, etag4, etag5)
+}
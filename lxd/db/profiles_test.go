@@ -0,0 +1,4324 @@
+// +build linux,cgo,!agent
+
+package db_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lxc/lxd/lxd/db"
+	"github.com/lxc/lxd/lxd/db/query"
+	deviceConfig "github.com/lxc/lxd/lxd/device/config"
+	"github.com/lxc/lxd/lxd/instance/instancetype"
+	"github.com/lxc/lxd/shared/api"
+)
+
+func TestGetProfileInstanceTypeDistribution(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile := db.Profile{
+			Project: "default",
+			Name:    "shared",
+		}
+		_, err := tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		addProfileInstance(t, tx, "c1", instancetype.Container, "shared")
+		addProfileInstance(t, tx, "c2", instancetype.Container, "shared")
+		addProfileInstance(t, tx, "v1", instancetype.VM, "shared")
+		addProfileInstance(t, tx, "c3", instancetype.Container, "default")
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	distribution, err := cluster.GetProfileInstanceTypeDistribution("default", "shared")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"container": 2, "virtual-machine": 1}, distribution)
+
+	distribution, err = cluster.GetProfileInstanceTypeDistribution("default", "default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"container": 1}, distribution)
+}
+
+func TestFindDuplicateProfiles(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"web1", "web2"} {
+			profile := db.Profile{
+				Project:     "default",
+				Name:        name,
+				Description: name,
+				Config:      map[string]string{"limits.cpu": "2"},
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "default"},
+				},
+			}
+			_, err := tx.CreateProfile(profile)
+			require.NoError(t, err)
+		}
+
+		profile := db.Profile{
+			Project: "default",
+			Name:    "db",
+			Config:  map[string]string{"limits.cpu": "4"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		}
+		_, err := tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	groups, err := cluster.FindDuplicateProfiles("default")
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"web1", "web2"}}, groups)
+}
+
+func TestGetProfileConfigAsEnv(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile := db.Profile{
+			Project: "default",
+			Name:    "env",
+			Config: map[string]string{
+				"limits.memory":    "1GB",
+				"boot.autostart":   "true",
+				"user.app.version": "1.2",
+			},
+		}
+		_, err := tx.CreateProfile(profile)
+		return err
+	})
+	require.NoError(t, err)
+
+	env, err := cluster.GetProfileConfigAsEnv("default", "env", "LXD_")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"LXD_boot_autostart=true",
+		"LXD_limits_memory=1GB",
+		"LXD_user_app_version=1.2",
+	}, env)
+}
+
+func TestGetProfilesReferencingImage(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	fingerprint := "8d4f9f4d1b5a3c8b2e7f6a5d4c3b2a1f0e9d8c7b6a5f4e3d2c1b0a9f8e7d6c5b"
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		project := api.ProjectsPost{}
+		project.Name = "test"
+		project.Config = map[string]string{"features.profiles": "true"}
+		_, err := tx.CreateProject(project)
+		require.NoError(t, err)
+
+		profile := db.Profile{
+			Project: "default",
+			Name:    "pinned",
+			Devices: map[string]map[string]string{
+				"data": {"type": "disk", "path": "/data", "source": "image:" + fingerprint},
+			},
+		}
+		_, err = tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		profile = db.Profile{
+			Project: "test",
+			Name:    "pinned",
+			Devices: map[string]map[string]string{
+				"data": {"type": "disk", "path": "/data", "source": fingerprint},
+			},
+		}
+		_, err = tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		profile = db.Profile{
+			Project: "default",
+			Name:    "other",
+			Devices: map[string]map[string]string{
+				"data": {"type": "disk", "path": "/data", "source": "/srv/data"},
+			},
+		}
+		_, err = tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	profiles, err := cluster.GetProfilesReferencingImage(fingerprint)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"default": {"pinned"},
+		"test":    {"pinned"},
+	}, profiles)
+
+	_, err = cluster.GetProfilesReferencingImage("")
+	assert.EqualError(t, err, "No image fingerprint provided")
+}
+
+func TestValidateProfileForInstanceType(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile := db.Profile{
+			Project: "default",
+			Name:    "container-only",
+			Config:  map[string]string{"raw.lxc": "lxc.apparmor.profile=unconfined"},
+			Devices: map[string]map[string]string{
+				"root":  {"type": "disk", "path": "/", "pool": "default"},
+				"eth0":  {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+				"eth1":  {"type": "nic", "nictype": "ipvlan", "parent": "eth0"},
+				"proxy": {"type": "proxy", "listen": "tcp:0.0.0.0:80", "connect": "tcp:127.0.0.1:80"},
+			},
+		}
+		_, err := tx.CreateProfile(profile)
+		return err
+	})
+	require.NoError(t, err)
+
+	violations := cluster.ValidateProfileForInstanceType("default", "container-only", instancetype.Container)
+	assert.Len(t, violations, 0)
+
+	violations = cluster.ValidateProfileForInstanceType("default", "container-only", instancetype.VM)
+	require.Len(t, violations, 3)
+	assert.EqualError(t, violations[0], `Device "eth1" of type nic (ipvlan) is not supported by instance type virtual-machine`)
+	assert.EqualError(t, violations[1], `Device "proxy" of type proxy is not supported by instance type virtual-machine`)
+	assert.EqualError(t, violations[2], `Config key "raw.lxc" is not supported by instance type virtual-machine`)
+
+	violations = cluster.ValidateProfileForInstanceType("default", "missing", instancetype.VM)
+	assert.Len(t, violations, 1)
+}
+
+func TestGetProfileCanonicalText(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile := db.Profile{
+			Project:     "default",
+			Name:        "p1",
+			Description: "First",
+			Config:      map[string]string{"limits.cpu": "2", "raw.lxc": "a=1\nb=2"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		}
+		_, err := tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		profile = db.Profile{
+			Project:     "default",
+			Name:        "p2",
+			Description: "Second",
+			Devices: map[string]map[string]string{
+				"eth0": {"network": "lxdbr0", "type": "nic"},
+				"root": {"pool": "default", "path": "/", "type": "disk"},
+			},
+			Config: map[string]string{"raw.lxc": "a=1\nb=2", "limits.cpu": "2"},
+		}
+		_, err = tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	text1, err := cluster.GetProfileCanonicalText("default", "p1")
+	require.NoError(t, err)
+
+	text2, err := cluster.GetProfileCanonicalText("default", "p2")
+	require.NoError(t, err)
+
+	assert.Equal(t, text1, text2)
+	assert.Equal(t, `limits.cpu="2"
+raw.lxc="a=1\nb=2"
+[devices.eth0]
+network="lxdbr0"
+type="nic"
+[devices.root]
+path="/"
+pool="default"
+type="disk"
+`, text1)
+}
+
+func TestGetProfilesByLabel(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"web", "db", "cache"} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name})
+			require.NoError(t, err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, cluster.SetProfileLabels("default", "web", []string{"prod", "frontend"}))
+	require.NoError(t, cluster.SetProfileLabels("default", "db", []string{"prod", " backend ", "prod"}))
+	require.NoError(t, cluster.SetProfileLabels("default", "cache", []string{"staging"}))
+
+	labels, err := cluster.GetProfileLabels("default", "db")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"backend", "prod"}, labels)
+
+	names, err := cluster.GetProfilesByLabel("default", "prod")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db", "web"}, names)
+
+	names, err = cluster.GetProfilesByLabel("default", "unknown")
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, names)
+
+	// Replacing labels drops the old ones.
+	require.NoError(t, cluster.SetProfileLabels("default", "web", nil))
+
+	names, err = cluster.GetProfilesByLabel("default", "prod")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db"}, names)
+
+	err = cluster.SetProfileLabels("default", "web", []string{"a,b"})
+	assert.EqualError(t, err, `Invalid label "a,b": labels can't contain commas`)
+}
+
+func TestExpandInstanceConfigWithNulls(t *testing.T) {
+	profiles := []api.Profile{
+		{Name: "p1", ProfilePut: api.ProfilePut{Config: map[string]string{"a": "1", "b": "2"}}},
+		{Name: "p2", ProfilePut: api.ProfilePut{Config: map[string]string{"b": "3", "c": "4"}}},
+	}
+
+	value := "5"
+	config := map[string]*string{
+		"a": nil,
+		"c": &value,
+		"d": nil,
+	}
+
+	expanded := db.ExpandInstanceConfigWithNulls(config, profiles)
+	assert.Equal(t, map[string]string{"b": "3", "c": "5"}, expanded)
+
+	expanded = db.ExpandInstanceConfigWithNulls(nil, profiles)
+	assert.Equal(t, map[string]string{"a": "1", "b": "3", "c": "4"}, expanded)
+}
+
+func TestGetProfilesSnapshot(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"p1", "p2"} {
+			profile := db.Profile{
+				Project: "default",
+				Name:    name,
+				Config:  map[string]string{"user.name": name},
+			}
+			_, err := tx.CreateProfile(profile)
+			require.NoError(t, err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	snapshot, err := cluster.GetProfilesSnapshot("default")
+	require.NoError(t, err)
+
+	assert.Equal(t, "default", snapshot.Project)
+	assert.False(t, snapshot.Timestamp.IsZero())
+	require.Len(t, snapshot.Profiles, 3)
+
+	for i, name := range []string{"default", "p1", "p2"} {
+		entry := snapshot.Profiles[i]
+		assert.Equal(t, name, entry.Profile.Name)
+		assert.Equal(t, db.ProfileChecksum(&entry.Profile), entry.Checksum)
+		assert.Equal(t, snapshot.Timestamp, entry.Timestamp)
+	}
+}
+
+func TestGetDeviceTypesInProject(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile := db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		}
+		_, err := tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		profile = db.Profile{
+			Project: "default",
+			Name:    "p2",
+			Devices: map[string]map[string]string{
+				"data": {"type": "disk", "path": "/data", "source": "/srv"},
+				"web":  {"type": "proxy", "listen": "tcp:0.0.0.0:80", "connect": "tcp:127.0.0.1:80"},
+			},
+		}
+		_, err = tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	types, err := cluster.GetDeviceTypesInProject("default")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"disk", "nic", "proxy"}, types)
+}
+
+func TestGetProfilesMissingDevice(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile := db.Profile{
+			Project: "default",
+			Name:    "with-disk",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		}
+		_, err := tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		profile = db.Profile{
+			Project: "default",
+			Name:    "without-disk",
+			Devices: map[string]map[string]string{
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		}
+		_, err = tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	names, err := cluster.GetProfilesMissingDevice("default", "disk")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default", "without-disk"}, names)
+
+	_, err = cluster.GetProfilesMissingDevice("default", "bogus")
+	assert.EqualError(t, err, "Invalid device type bogus")
+}
+
+func TestProfileConfigIntersection(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"limits.cpu": "2", "limits.memory": "1GB", "boot.autostart": "true"},
+			"p2": {"limits.cpu": "2", "limits.memory": "2GB", "boot.autostart": "true"},
+			"p3": {"limits.cpu": "2", "limits.memory": "1GB", "security.nesting": "true"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			require.NoError(t, err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	common, err := cluster.ProfileConfigIntersection("default", []string{"p1", "p2", "p3"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"limits.cpu": "2"}, common)
+
+	common, err = cluster.ProfileConfigIntersection("default", []string{"p1", "p3"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"limits.cpu": "2", "limits.memory": "1GB"}, common)
+
+	_, err = cluster.ProfileConfigIntersection("default", []string{"p1", "missing"})
+	assert.Error(t, err)
+}
+
+func TestProfileConfigUnion(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"limits.cpu": "2", "limits.memory": "1GB"},
+			"p2": {"limits.cpu": "4", "boot.autostart": "true"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			require.NoError(t, err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	union, err := cluster.ProfileConfigUnion("default", []string{"p1", "p2"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"limits.cpu":     {"p1": "2", "p2": "4"},
+		"limits.memory":  {"p1": "1GB"},
+		"boot.autostart": {"p2": "true"},
+	}, union)
+}
+
+func TestImportProfileFromCanonicalText(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile := db.Profile{
+			Project:     "default",
+			Name:        "source",
+			Description: "Source",
+			Config:      map[string]string{"limits.cpu": "2", "raw.lxc": "a=1\nb=2"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		}
+		_, err := tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		profile = db.Profile{
+			Project:     "default",
+			Name:        "target",
+			Description: "Target",
+			Config:      map[string]string{"limits.memory": "1GB"},
+		}
+		_, err = tx.CreateProfile(profile)
+		require.NoError(t, err)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	text, err := cluster.GetProfileCanonicalText("default", "source")
+	require.NoError(t, err)
+
+	err = cluster.ImportProfileFromCanonicalText("default", "target", text)
+	require.NoError(t, err)
+
+	imported, err := cluster.GetProfileCanonicalText("default", "target")
+	require.NoError(t, err)
+	assert.Equal(t, text, imported)
+
+	_, profile, err := cluster.GetProfile("default", "target")
+	require.NoError(t, err)
+	assert.Equal(t, "Target", profile.Description)
+	assert.Equal(t, map[string]string{"limits.cpu": "2", "raw.lxc": "a=1\nb=2"}, profile.Config)
+
+	// Invalid text leaves the profile untouched.
+	err = cluster.ImportProfileFromCanonicalText("default", "target", "[devices.eth0]\nnetwork=\"lxdbr0\"\n")
+	assert.EqualError(t, err, `Parse profile text: Device "eth0": Invalid device type `)
+
+	err = cluster.ImportProfileFromCanonicalText("default", "target", "limits.cpu=2\n")
+	assert.EqualError(t, err, `Parse profile text: Line 1: Invalid value for key "limits.cpu"`)
+
+	after, err := cluster.GetProfileCanonicalText("default", "target")
+	require.NoError(t, err)
+	assert.Equal(t, text, after)
+}
+
+func TestValidateProfileLimits(t *testing.T) {
+	cases := []struct {
+		config   map[string]string
+		problems []string
+	}{
+		{
+			map[string]string{"limits.cpu": "0-3", "limits.memory": "1GB", "user.foo": "x"},
+			[]string{},
+		},
+		{
+			map[string]string{"limits.cpu": "a,b"},
+			[]string{`Invalid value "a,b" for limits.cpu: Invalid CPU limit syntax`},
+		},
+		{
+			map[string]string{"limits.cpu": "4-2"},
+			[]string{`Invalid CPU range "4-2" for limits.cpu`},
+		},
+		{
+			map[string]string{"limits.memory": "512kB"},
+			[]string{`Memory limit "512kB" for limits.memory is lower than the minimum of 1MiB`},
+		},
+		{
+			map[string]string{"limits.memory": "150%"},
+			[]string{`Memory limit "150%" for limits.memory must be between 1% and 100%`},
+		},
+		{
+			map[string]string{"limits.memory": "lots", "limits.processes": "0"},
+			[]string{
+				`Invalid value "lots" for limits.memory: Invalid value: lots`,
+				`Process limit "0" for limits.processes must be positive`,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		profile := &api.Profile{ProfilePut: api.ProfilePut{Config: c.config}}
+		assert.Equal(t, c.problems, db.ValidateProfileLimits(profile))
+	}
+}
+
+func TestGetProfileAttachmentMatrix(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{Project: "default", Name: "web"})
+		require.NoError(t, err)
+
+		addProfileInstance(t, tx, "c1", instancetype.Container, "default", "web")
+		addProfileInstance(t, tx, "c2", instancetype.Container, "default")
+		addProfileInstance(t, tx, "c3", instancetype.Container)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	matrix, err := cluster.GetProfileAttachmentMatrix("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]bool{
+		"c1": {"default": true, "web": true},
+		"c2": {"default": true, "web": false},
+		"c3": {"default": false, "web": false},
+	}, matrix)
+}
+
+func TestGetProfileWithDefaults(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile := db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config:  map[string]string{"boot.autostart": "true"},
+		}
+		_, err := tx.CreateProfile(profile)
+		return err
+	})
+	require.NoError(t, err)
+
+	defaults := map[string]string{
+		"boot.autostart":          "false",
+		"boot.autostart.priority": "0",
+		"limits.cpu.priority":     "10",
+	}
+
+	profile, defaulted, err := cluster.GetProfileWithDefaults("default", "p1", defaults)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"boot.autostart":          "true",
+		"boot.autostart.priority": "0",
+		"limits.cpu.priority":     "10",
+	}, profile.Config)
+	assert.Equal(t, []string{"boot.autostart.priority", "limits.cpu.priority"}, defaulted)
+
+	// The stored profile is untouched.
+	_, stored, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"boot.autostart": "true"}, stored.Config)
+}
+
+func TestValidateInstanceProfileStack(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles := []db.Profile{
+			{
+				Project: "default",
+				Name:    "base",
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "default"},
+					"eth0": {"type": "nic", "network": "lxdbr0"},
+				},
+			},
+			{
+				Project: "default",
+				Name:    "data",
+				Devices: map[string]map[string]string{
+					"data": {"type": "disk", "path": "/srv", "source": "/data"},
+				},
+			},
+			{
+				Project: "default",
+				Name:    "conflicting",
+				Devices: map[string]map[string]string{
+					"eth0":  {"type": "disk", "path": "/srv", "source": "/other"},
+					"proxy": {"type": "proxy", "listen": "tcp:0.0.0.0:80", "connect": "tcp:127.0.0.1:80"},
+				},
+			},
+		}
+		for _, profile := range profiles {
+			_, err := tx.CreateProfile(profile)
+			require.NoError(t, err)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	problems, err := cluster.ValidateInstanceProfileStack("default", []string{"default", "base", "data"}, instancetype.VM)
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, problems)
+
+	problems, err = cluster.ValidateInstanceProfileStack("default", []string{"data", "missing", "data"}, instancetype.Container)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`Profile "missing" doesn't exist`,
+		`Profile "data" is listed more than once`,
+		"No root device could be found",
+	}, problems)
+
+	problems, err = cluster.ValidateInstanceProfileStack("default", []string{"base", "data", "conflicting"}, instancetype.VM)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`Device "eth0" is a nic in profile "base" but a disk in profile "conflicting"`,
+		`Disk devices "data" and "eth0" share path "/srv"`,
+		`Device "proxy" of type proxy is not supported by instance type virtual-machine`,
+	}, problems)
+}
+
+func TestGetProfilesByOwner(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for name, owner := range map[string]string{"p1": "alice", "p2": "bob", "p3": "alice"} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Owner: owner})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	names, err := cluster.GetProfilesByOwner("default", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"p1", "p3"}, names)
+
+	names, err = cluster.GetProfilesByOwner("default", "carol")
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, names)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile, err := tx.GetProfile("default", "p2")
+		require.NoError(t, err)
+		assert.Equal(t, "bob", profile.Owner)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCompactProfileConfig(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config: map[string]string{
+				"boot.autostart":      "false",
+				"security.nesting":    "true",
+				"security.privileged": "false",
+				"user.note":           "keep",
+			},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	defaults := map[string]string{
+		"boot.autostart":      "false",
+		"security.nesting":    "false",
+		"security.privileged": "false",
+	}
+
+	removed, err := cluster.CompactProfileConfig("default", "p1", defaults)
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	_, profile, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"security.nesting": "true", "user.note": "keep"}, profile.Config)
+	assert.Len(t, profile.Devices, 1)
+
+	removed, err = cluster.CompactProfileConfig("default", "p1", defaults)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestGetProfilesExceedingDeviceCount(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+				"data": {"type": "disk", "path": "/data", "source": "/srv"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p2",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{Project: "default", Name: "empty"})
+		return err
+	})
+	require.NoError(t, err)
+
+	counts, err := cluster.GetProfilesExceedingDeviceCount("default", 2)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"p1": 3}, counts)
+
+	counts, err = cluster.GetProfilesExceedingDeviceCount("default", 1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"p1": 3, "p2": 2}, counts)
+
+	// Profiles without devices are counted too.
+	counts, err = cluster.GetProfilesExceedingDeviceCount("default", -1)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"default": 0, "empty": 0, "p1": 3, "p2": 2}, counts)
+}
+
+func TestGetProfilesViolatingProjectConfig(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProject(api.ProjectsPost{
+			Name: "p",
+			ProjectPut: api.ProjectPut{
+				Config: map[string]string{
+					"features.profiles":              "true",
+					"restricted":                     "true",
+					"restricted.containers.lowlevel": "allow",
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "p",
+			Name:    "nested",
+			Config:  map[string]string{"security.nesting": "true", "raw.lxc": "lxc.aa_profile=unconfined"},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "p",
+			Name:    "vm",
+			Config:  map[string]string{"raw.qemu": "-S", "security.privileged": "true"},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "p",
+			Name:    "ok",
+			Config:  map[string]string{"limits.cpu": "2"},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "unrestricted",
+			Config:  map[string]string{"security.privileged": "true"},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	violations, err := cluster.GetProfilesViolatingProjectConfig("p")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"nested": {"security.nesting"},
+		"vm":     {"raw.qemu", "security.privileged"},
+	}, violations)
+
+	violations, err = cluster.GetProfilesViolatingProjectConfig("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{}, violations)
+}
+
+func TestExpandInstanceDevicesWithLimits(t *testing.T) {
+	profiles := []api.Profile{
+		{
+			Name: "p1",
+			ProfilePut: api.ProfilePut{
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "default", "size": "50GiB"},
+					"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0", "limits.max": "10Mbit"},
+				},
+			},
+		},
+	}
+	devices := deviceConfig.Devices{
+		"data": {"type": "disk", "path": "/data", "source": "/srv", "size": "5GiB"},
+	}
+	limits := map[string]map[string]string{
+		"disk": {"size": "10GiB"},
+	}
+
+	expanded := db.ExpandInstanceDevicesWithLimits(devices, profiles, limits)
+	assert.Equal(t, "10GiB", expanded["root"]["size"])
+	assert.Equal(t, "5GiB", expanded["data"]["size"])
+	assert.Equal(t, "10Mbit", expanded["eth0"]["limits.max"])
+
+	// The profile devices are left untouched.
+	assert.Equal(t, "50GiB", profiles[0].Devices["root"]["size"])
+}
+
+func TestGetProfileExternalReferences(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "fast"},
+				"data": {"type": "disk", "path": "/data", "pool": "slow"},
+				"host": {"type": "disk", "path": "/host", "source": "/srv"},
+				"eth0": {"type": "nic", "network": "lxdbr0", "security.acls": "web, ssh"},
+				"eth1": {"type": "nic", "nictype": "bridged", "parent": "br1", "security.acls": "ssh"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	refs, err := cluster.GetProfileExternalReferences("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fast", "slow"}, refs.StoragePools)
+	assert.Equal(t, []string{"br1", "lxdbr0"}, refs.Networks)
+	assert.Equal(t, []string{"ssh", "web"}, refs.ACLs)
+
+	_, err = cluster.GetProfileExternalReferences("default", "missing")
+	assert.Equal(t, db.ErrNoSuchObject, err)
+}
+
+func TestUpdateProfilePoolReferences(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProject(api.ProjectsPost{
+			Name: "p",
+			ProjectPut: api.ProjectPut{
+				Config: map[string]string{"features.profiles": "true"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "old"},
+				"data": {"type": "disk", "path": "/data", "pool": "other"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "p",
+			Name:    "p2",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "old"},
+				"eth0": {"type": "nic", "nictype": "bridged", "parent": "old", "pool": "old"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	count, err := cluster.UpdateProfilePoolReferences("old", "new")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, p1, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "new", p1.Devices["root"]["pool"])
+	assert.Equal(t, "other", p1.Devices["data"]["pool"])
+
+	_, p2, err := cluster.GetProfile("p", "p2")
+	require.NoError(t, err)
+	assert.Equal(t, "new", p2.Devices["root"]["pool"])
+	assert.Equal(t, "old", p2.Devices["eth0"]["pool"])
+}
+
+func TestUpdateProfileNetworkReferences(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Devices: map[string]map[string]string{
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+				"eth1": {"type": "nic", "nictype": "macvlan", "parent": "lxdbr0"},
+				"eth2": {"type": "nic", "network": "other"},
+				"data": {"type": "disk", "path": "/data", "source": "/srv", "parent": "lxdbr0"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	count, err := cluster.UpdateProfileNetworkReferences("lxdbr0", "lxdbr1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	_, profile, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "lxdbr1", profile.Devices["eth0"]["network"])
+	assert.Equal(t, "lxdbr1", profile.Devices["eth1"]["parent"])
+	assert.Equal(t, "other", profile.Devices["eth2"]["network"])
+	assert.Equal(t, "lxdbr0", profile.Devices["data"]["parent"])
+}
+
+func TestGetExpandedInstanceConfig(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	defaultConfig := map[string]string{"boot.autostart": "true", "limits.cpu": "1", "user.a": "default"}
+	p1Config := map[string]string{"limits.cpu": "2", "limits.memory": "1GiB"}
+	p2Config := map[string]string{"limits.memory": "2GiB", "user.a": "p2"}
+	instanceConfig := map[string]string{"user.a": "instance"}
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		err := tx.UpdateProfile("default", "default", db.Profile{
+			Project: "default",
+			Name:    "default",
+			Config:  defaultConfig,
+		})
+		if err != nil {
+			return err
+		}
+
+		for name, config := range map[string]map[string]string{"p1": p1Config, "p2": p2Config} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.CreateInstance(db.Instance{
+			Project:      "default",
+			Name:         "c1",
+			Node:         "none",
+			Type:         instancetype.Container,
+			Architecture: 1,
+			Profiles:     []string{"p1", "p2"},
+			Config:       instanceConfig,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateInstance(db.Instance{
+			Project:      "default",
+			Name:         "c2",
+			Node:         "none",
+			Type:         instancetype.Container,
+			Architecture: 1,
+			Profiles:     []string{"default", "p1"},
+			Config:       instanceConfig,
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	// The project doesn't hold any instance config of its own, so only the
+	// instance's profiles are layered under its config.
+	layer := func(layers ...map[string]string) map[string]string {
+		expected := map[string]string{}
+		for _, layer := range layers {
+			for key, value := range layer {
+				expected[key] = value
+			}
+		}
+		return expected
+	}
+
+	config, err := cluster.GetExpandedInstanceConfig("default", "c1")
+	require.NoError(t, err)
+	assert.Equal(t, layer(p1Config, p2Config, instanceConfig), config)
+	assert.Equal(t, "instance", config["user.a"])
+	assert.NotContains(t, config, "boot.autostart")
+
+	config, err = cluster.GetExpandedInstanceConfig("default", "c2")
+	require.NoError(t, err)
+	assert.Equal(t, layer(defaultConfig, p1Config, instanceConfig), config)
+	assert.Equal(t, "2", config["limits.cpu"])
+	assert.Equal(t, "true", config["boot.autostart"])
+
+	_, err = cluster.GetExpandedInstanceConfig("default", "missing")
+	assert.Error(t, err)
+}
+
+func TestUpdateProfileReferencesDryRun(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "old"},
+				"data": {"type": "disk", "path": "/data", "pool": "other"},
+				"eth0": {"type": "nic", "network": "old"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p2",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "old"},
+				"eth1": {"type": "nic", "nictype": "macvlan", "parent": "old"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	pools, err := cluster.UpdateProfilePoolReferencesDryRun("old")
+	require.NoError(t, err)
+	assert.Equal(t, []db.ProfileDeviceRef{
+		{Project: "default", Profile: "p1", Device: "root"},
+		{Project: "default", Profile: "p2", Device: "root"},
+	}, pools)
+
+	networks, err := cluster.UpdateProfileNetworkReferencesDryRun("old")
+	require.NoError(t, err)
+	assert.Equal(t, []db.ProfileDeviceRef{
+		{Project: "default", Profile: "p1", Device: "eth0"},
+		{Project: "default", Profile: "p2", Device: "eth1"},
+	}, networks)
+
+	// Nothing was changed by the dry runs.
+	_, p1, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "old", p1.Devices["root"]["pool"])
+
+	count, err := cluster.UpdateProfilePoolReferences("old", "new")
+	require.NoError(t, err)
+	assert.Equal(t, len(pools), count)
+
+	count, err = cluster.UpdateProfileNetworkReferences("old", "new")
+	require.NoError(t, err)
+	assert.Equal(t, len(networks), count)
+
+	pools, err = cluster.UpdateProfilePoolReferencesDryRun("old")
+	require.NoError(t, err)
+	assert.Equal(t, []db.ProfileDeviceRef{}, pools)
+}
+
+func TestGetConfigKeyHistogram(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"limits.cpu": "1", "limits.memory": "1GiB", "user.a": "x"},
+			"p2": {"limits.cpu": "2", "limits.memory": "2GiB"},
+			"p3": {"limits.cpu": "4"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	histogram, err := cluster.GetConfigKeyHistogram("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"limits.cpu": 3, "limits.memory": 2, "user.a": 1}, histogram)
+}
+
+func TestGetDeviceKeyHistogram(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		devices := map[string]map[string]map[string]string{
+			"p1": {
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"data": {"type": "disk", "path": "/data", "source": "/srv"},
+			},
+			"p2": {
+				"root": {"type": "disk", "path": "/", "pool": "default", "size": "10GiB"},
+			},
+			"p3": {
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		}
+		for name, devs := range devices {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Devices: devs})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	histogram, err := cluster.GetDeviceKeyHistogram("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"type":    3,
+		"path":    2,
+		"pool":    2,
+		"source":  1,
+		"size":    1,
+		"network": 1,
+	}, histogram)
+}
+
+func TestGetProfileConfigOutliers(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"security.nesting": "false"},
+			"p2": {"security.nesting": "false"},
+			"p3": {"security.nesting": "false"},
+			"p4": {"security.nesting": "true"},
+			"p5": {"limits.cpu": "1"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	outliers, err := cluster.GetProfileConfigOutliers("default", "security.nesting")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"p4": "true"}, outliers)
+
+	outliers, err = cluster.GetProfileConfigOutliers("default", "limits.memory")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{}, outliers)
+}
+
+func TestGetProfilesWithDanglingReferences(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"data": {"type": "disk", "path": "/data", "pool": "gone"},
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p2",
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	dangling, err := cluster.GetProfilesWithDanglingReferences("default", []string{"default"}, []string{"lxdbr0"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"p1": {"pool:gone"}}, dangling)
+
+	dangling, err = cluster.GetProfilesWithDanglingReferences("default", []string{"default", "gone"}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"p1": {"network:lxdbr0"},
+		"p2": {"network:lxdbr0"},
+	}, dangling)
+}
+
+func TestExpandInstanceConfigBounded(t *testing.T) {
+	profiles := []api.Profile{
+		{Name: "p1", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "1", "limits.memory": "1GiB"}}},
+		{Name: "p2", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "2", "user.a": "x"}}},
+	}
+	config := map[string]string{"user.a": "y"}
+
+	expanded, err := db.ExpandInstanceConfigBounded(config, profiles, 3)
+	require.NoError(t, err)
+	assert.Equal(t, db.ExpandInstanceConfig(config, profiles), expanded)
+
+	_, err = db.ExpandInstanceConfigBounded(config, profiles, 2)
+	assert.EqualError(t, err, "Expanded config exceeds the maximum of 2 keys")
+
+	_, err = db.ExpandInstanceConfigBounded(map[string]string{"user.b": "z"}, profiles, 3)
+	assert.EqualError(t, err, "Expanded config exceeds the maximum of 3 keys")
+}
+
+func TestExpandInstanceConfigFiltered(t *testing.T) {
+	profiles := []api.Profile{
+		{Name: "p1", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "1", "limits.memory": "1GiB", "boot.autostart": "true"}}},
+		{Name: "p2", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "2", "user.a": "x"}}},
+	}
+	config := map[string]string{"limits.memory": "2GiB", "user.a": "y"}
+
+	limits := func(key string) bool { return strings.HasPrefix(key, "limits.") }
+
+	expanded := db.ExpandInstanceConfigFiltered(config, profiles, limits)
+	assert.Equal(t, map[string]string{"limits.cpu": "2", "limits.memory": "2GiB"}, expanded)
+
+	all := func(key string) bool { return true }
+	assert.Equal(t, db.ExpandInstanceConfig(config, profiles), db.ExpandInstanceConfigFiltered(config, profiles, all))
+}
+
+func TestGetProfileConfigTypeReport(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"security.nesting": "true", "limits.cpu": "2", "limits.memory": "1GiB", "user.note": "hello"},
+			"p2": {"security.nesting": "false", "limits.cpu": "4", "limits.memory": "512MiB", "user.note": "42"},
+			"p3": {"security.nesting": "yes", "limits.cpu": "0-3", "limits.memory": "2GiB"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	report, err := cluster.GetProfileConfigTypeReport("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"security.nesting": "bool",
+		"limits.cpu":       "int",
+		"limits.memory":    "bytes",
+		"user.note":        "string",
+	}, report)
+}
+
+func TestGetProfileUsedBySorted(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{Project: "default", Name: "shared"})
+		if err != nil {
+			return err
+		}
+
+		addProfileInstance(t, tx, "d", instancetype.Container, "shared")
+		addProfileInstance(t, tx, "a", instancetype.VM, "shared")
+		addProfileInstance(t, tx, "c", instancetype.VM, "shared")
+		addProfileInstance(t, tx, "b", instancetype.Container, "shared")
+		addProfileInstance(t, tx, "e", instancetype.Container, "default")
+		return nil
+	})
+	require.NoError(t, err)
+
+	users, total, err := cluster.GetProfileUsedBySorted("default", "shared", 0, 3, "name")
+	require.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Equal(t, []db.ProfileUser{
+		{Project: "default", Name: "a", Type: instancetype.VM},
+		{Project: "default", Name: "b", Type: instancetype.Container},
+		{Project: "default", Name: "c", Type: instancetype.VM},
+	}, users)
+
+	users, total, err = cluster.GetProfileUsedBySorted("default", "shared", 3, 3, "name")
+	require.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Equal(t, []db.ProfileUser{{Project: "default", Name: "d", Type: instancetype.Container}}, users)
+
+	users, _, err = cluster.GetProfileUsedBySorted("default", "shared", 1, 2, "type")
+	require.NoError(t, err)
+	assert.Equal(t, []db.ProfileUser{
+		{Project: "default", Name: "d", Type: instancetype.Container},
+		{Project: "default", Name: "a", Type: instancetype.VM},
+	}, users)
+
+	users, _, err = cluster.GetProfileUsedBySorted("default", "shared", 10, 2, "type")
+	require.NoError(t, err)
+	assert.Equal(t, []db.ProfileUser{}, users)
+
+	_, _, err = cluster.GetProfileUsedBySorted("default", "shared", 0, 2, "architecture")
+	assert.EqualError(t, err, `Invalid sort field "architecture"`)
+
+	_, _, err = cluster.GetProfileUsedBySorted("default", "shared", -1, 2, "name")
+	assert.EqualError(t, err, "Invalid offset -1")
+
+	_, _, err = cluster.GetProfileUsedBySorted("default", "shared", 0, 0, "name")
+	assert.EqualError(t, err, "Invalid limit 0")
+
+	_, _, err = cluster.GetProfileUsedBySorted("default", "missing", 0, 2, "name")
+	assert.Equal(t, db.ErrNoSuchObject, err)
+}
+
+func TestSearchProfilesByConfigRegex(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"limits.memory": "1GiB"},
+			"p2": {"limits.memory": "512MiB"},
+			"p3": {"limits.memory": "4GiB"},
+			"p4": {"limits.cpu": "1GiB"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	names, err := cluster.SearchProfilesByConfigRegex("default", "limits.memory", "^[0-9]+GiB$")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"p1", "p3"}, names)
+
+	names, err = cluster.SearchProfilesByConfigRegex("default", "limits.memory", "TiB")
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, names)
+
+	_, err = cluster.SearchProfilesByConfigRegex("default", "limits.memory", "[")
+	assert.Error(t, err)
+}
+
+func TestGetProfileDeltaFromDefault(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		err := tx.UpdateProfile("default", "default", db.Profile{
+			Project:     "default",
+			Name:        "default",
+			Description: "Default LXD profile",
+			Config:      map[string]string{"limits.cpu": "1", "boot.autostart": "true"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project:     "default",
+			Name:        "big",
+			Description: "Default LXD profile",
+			Config:      map[string]string{"limits.cpu": "8", "boot.autostart": "true", "limits.memory": "16GiB"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+				"eth0": {"type": "nic", "network": "lxdbr0"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	delta, err := cluster.GetProfileDeltaFromDefault("default", "big")
+	require.NoError(t, err)
+	assert.Nil(t, delta.Description)
+	assert.Equal(t, map[string]string{"limits.memory": "16GiB"}, delta.ConfigAdded)
+	assert.Equal(t, map[string]string{}, delta.ConfigRemoved)
+	assert.Equal(t, map[string]db.ProfileValueChange{"limits.cpu": {Old: "1", New: "8"}}, delta.ConfigChanged)
+	assert.Equal(t, map[string]map[string]string{"eth0": {"type": "nic", "network": "lxdbr0"}}, delta.DevicesAdded)
+	assert.Empty(t, delta.DevicesChanged)
+
+	delta, err = cluster.GetProfileDeltaFromDefault("default", "default")
+	require.NoError(t, err)
+	assert.True(t, delta.IsEmpty())
+
+	_, err = cluster.GetProfileDeltaFromDefault("default", "missing")
+	assert.Error(t, err)
+}
+
+func TestGetProfileResolvedIncludes(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles := []db.Profile{
+			{
+				Name:   "base",
+				Config: map[string]string{"limits.cpu": "1", "limits.memory": "1GiB", "boot.autostart": "true"},
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "default"},
+				},
+			},
+			{
+				Name:   "middle",
+				Config: map[string]string{db.ProfileIncludesKey: "base", "limits.cpu": "2"},
+				Devices: map[string]map[string]string{
+					"eth0": {"type": "nic", "network": "lxdbr0"},
+				},
+			},
+			{
+				Name:   "top",
+				Config: map[string]string{db.ProfileIncludesKey: "middle", "limits.memory": "4GiB"},
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "fast"},
+				},
+			},
+		}
+		for _, profile := range profiles {
+			profile.Project = "default"
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	profile, err := cluster.GetProfileResolvedIncludes("default", "top")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		db.ProfileIncludesKey: "middle",
+		"limits.cpu":          "2",
+		"limits.memory":       "4GiB",
+		"boot.autostart":      "true",
+	}, profile.Config)
+	assert.Equal(t, map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "fast"},
+		"eth0": {"type": "nic", "network": "lxdbr0"},
+	}, profile.Devices)
+}
+
+func TestGetProfileResolvedIncludes_Cycle(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		includes := map[string]string{"a": "b", "b": "c", "c": "a"}
+		for name, included := range includes {
+			_, err := tx.CreateProfile(db.Profile{
+				Project: "default",
+				Name:    name,
+				Config:  map[string]string{db.ProfileIncludesKey: included},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = cluster.GetProfileResolvedIncludes("default", "a")
+	assert.EqualError(t, err, "Profile include cycle: a -> b -> c -> a")
+}
+
+func TestGetProfilesSharingDevice(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		devices := map[string]map[string]map[string]string{
+			"p1": {"root": {"type": "disk", "path": "/", "pool": "default"}},
+			"p2": {"disk": {"type": "disk", "path": "/", "pool": "default"}},
+			"p3": {"root": {"type": "disk", "path": "/", "pool": "fast"}},
+		}
+		for name, devs := range devices {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Devices: devs})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	shared, err := cluster.GetProfilesSharingDevice("default")
+	require.NoError(t, err)
+	require.Len(t, shared, 1)
+
+	for signature, names := range shared {
+		assert.True(t, strings.HasPrefix(signature, "disk:"))
+		assert.Equal(t, []string{"p1", "p2"}, names)
+	}
+}
+
+func TestExpandInstanceConfigTraced(t *testing.T) {
+	profiles := []api.Profile{
+		{Name: "p1", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "1", "limits.memory": "1GiB"}}},
+		{Name: "p2", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "2"}}},
+	}
+	config := map[string]string{"limits.memory": "2GiB", "user.a": "x"}
+
+	trace := []string{}
+	expanded := db.ExpandInstanceConfigTraced(config, profiles, func(key, value, source string) {
+		trace = append(trace, fmt.Sprintf("%s: %s=%s", source, key, value))
+	})
+
+	assert.Equal(t, db.ExpandInstanceConfig(config, profiles), expanded)
+	assert.Equal(t, []string{
+		"p1: limits.cpu=1",
+		"p1: limits.memory=1GiB",
+		"p2: limits.cpu=2",
+		"instance: limits.memory=2GiB",
+		"instance: user.a=x",
+	}, trace)
+}
+
+// A nil trace function just expands the config.
+func TestExpandInstanceConfigTraced_NilTrace(t *testing.T) {
+	profiles := []api.Profile{
+		{Name: "p1", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "1"}}},
+	}
+	config := map[string]string{"user.a": "x"}
+
+	expanded := db.ExpandInstanceConfigTraced(config, profiles, nil)
+	assert.Equal(t, map[string]string{"limits.cpu": "1", "user.a": "x"}, expanded)
+}
+
+func TestValidateAllProfiles(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles := []db.Profile{
+			{
+				Name:   "good",
+				Config: map[string]string{"limits.cpu": "2", "security.nesting": "true", "user.note": "x"},
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "default"},
+				},
+			},
+			{
+				Name:   "bad-config",
+				Config: map[string]string{"limits.cpu": "3-1", "security.nesting": "maybe", "foo.bar": "x"},
+			},
+			{
+				Name: "bad-devices",
+				Devices: map[string]map[string]string{
+					"root":  {"type": "disk", "path": "/", "pool": "default"},
+					"root2": {"type": "disk", "path": "/", "pool": "fast"},
+				},
+			},
+		}
+		for _, profile := range profiles {
+			profile.Project = "default"
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	results, err := cluster.ValidateAllProfiles("default")
+	require.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, []string{
+		"Unknown configuration key: foo.bar",
+		`Invalid value "maybe" for security.nesting: Invalid value for a boolean: maybe`,
+		`Invalid CPU range "3-1" for limits.cpu`,
+	}, results["bad-config"])
+	assert.Equal(t, []string{`Devices "root" and "root2" are both mounted on /`}, results["bad-devices"])
+}
+
+func TestValidateProfileName(t *testing.T) {
+	for _, name := range []string{"web", "default", "my-profile_1.2", "x", strings.Repeat("x", db.ProfileNameMaxLength)} {
+		assert.NoError(t, db.ValidateProfileName(name), name)
+	}
+
+	assert.EqualError(t, db.ValidateProfileName(""), "No name provided")
+	assert.EqualError(t, db.ValidateProfileName("a/b"), "Profile names may not contain slashes")
+	assert.EqualError(t, db.ValidateProfileName("/"), "Profile names may not contain slashes")
+	assert.EqualError(t, db.ValidateProfileName("."), "Invalid profile name '.'")
+	assert.EqualError(t, db.ValidateProfileName(".."), "Invalid profile name '..'")
+	assert.EqualError(t, db.ValidateProfileName("has space"), "Profile names may not contain spaces or control characters")
+	assert.EqualError(t, db.ValidateProfileName("bell\a"), "Profile names may not contain spaces or control characters")
+	assert.EqualError(
+		t, db.ValidateProfileName(strings.Repeat("x", db.ProfileNameMaxLength+1)),
+		"Profile names may not be longer than 64 characters")
+}
+
+// All invalid names of a batch are reported at once.
+func TestValidateProfileNames(t *testing.T) {
+	long := strings.Repeat("x", db.ProfileNameMaxLength+1)
+
+	errs := db.ValidateProfileNames([]string{"web", "db", "a/b", "has space", long, "tab\there", "web", ""})
+
+	messages := map[string]string{}
+	for name, err := range errs {
+		messages[name] = err.Error()
+	}
+
+	assert.Equal(t, map[string]string{
+		"a/b":       "Profile names may not contain slashes",
+		"has space": "Profile names may not contain spaces or control characters",
+		long:        "Profile names may not be longer than 64 characters",
+		"tab\there": "Profile names may not contain spaces or control characters",
+		"web":       "Duplicate profile name 'web'",
+		"":          "No name provided",
+	}, messages)
+
+	assert.Empty(t, db.ValidateProfileNames([]string{"web", "db", strings.Repeat("x", db.ProfileNameMaxLength)}))
+}
+
+func TestBulkExpandForInstances(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	instances := seedBulkExpandInstances(t, cluster, 6)
+
+	expanded, err := cluster.BulkExpandForInstances("default", instances)
+	require.NoError(t, err)
+	require.Len(t, expanded, len(instances))
+
+	for _, instance := range instances {
+		config, err := cluster.GetExpandedInstanceConfig("default", instance)
+		require.NoError(t, err)
+		assert.Equal(t, config, expanded[instance], instance)
+	}
+
+	_, err = cluster.BulkExpandForInstances("default", []string{"missing"})
+	assert.EqualError(t, err, `Load instance "missing": No such object`)
+}
+
+// Instances that don't use the default profile don't get its config, and
+// don't share the cached layer of instances that do.
+func TestBulkExpandForInstances_NoDefaultProfile(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		err := tx.UpdateProfile("default", "default", db.Profile{
+			Project: "default",
+			Name:    "default",
+			Config:  map[string]string{"boot.autostart": "true"},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{Project: "default", Name: "p1", Config: map[string]string{"limits.cpu": "2"}})
+		if err != nil {
+			return err
+		}
+
+		for name, profiles := range map[string][]string{"c1": {"p1"}, "c2": {"default", "p1"}} {
+			_, err := tx.CreateInstance(db.Instance{
+				Project:      "default",
+				Name:         name,
+				Node:         "none",
+				Type:         instancetype.Container,
+				Architecture: 1,
+				Profiles:     profiles,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	expanded, err := cluster.BulkExpandForInstances("default", []string{"c1", "c2"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"limits.cpu": "2"}, expanded["c1"])
+	assert.Equal(t, map[string]string{"limits.cpu": "2", "boot.autostart": "true"}, expanded["c2"])
+}
+
+func BenchmarkBulkExpandForInstances(b *testing.B) {
+	cluster, cleanup := db.NewTestCluster(b)
+	defer cleanup()
+
+	instances := seedBulkExpandInstances(b, cluster, 100)
+
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := cluster.BulkExpandForInstances("default", instances)
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("per-instance", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, instance := range instances {
+				_, err := cluster.GetExpandedInstanceConfig("default", instance)
+				require.NoError(b, err)
+			}
+		}
+	})
+}
+
+func TestGetProfilesReferencingSecret(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProject(api.ProjectsPost{
+			Name: "p",
+			ProjectPut: api.ProjectPut{
+				Config: map[string]string{"features.profiles": "true"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		profiles := []db.Profile{
+			{Project: "default", Name: "p1", Config: map[string]string{"user.db-password": "secret:s-123"}},
+			{Project: "default", Name: "p2", Config: map[string]string{"user.token": "secret:s-456"}},
+			{Project: "p", Name: "p3", Config: map[string]string{"user.api-key": "secret:s-123", "user.x": "s-123"}},
+		}
+		for _, profile := range profiles {
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	results, err := cluster.GetProfilesReferencingSecret("s-123")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"default": {"p1"}, "p": {"p3"}}, results)
+
+	results, err = cluster.GetProfilesReferencingSecret("s-789")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{}, results)
+
+	_, err = cluster.GetProfilesReferencingSecret("")
+	assert.EqualError(t, err, "No secret ID provided")
+}
+
+func TestGetProfileForClone(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project:     "default",
+			Name:        "p1",
+			Description: "Original",
+			Config:      map[string]string{"limits.cpu": "2"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		addProfileInstance(t, tx, "c1", instancetype.Container, "p1")
+		return nil
+	})
+	require.NoError(t, err)
+
+	post, err := cluster.GetProfileForClone("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "p1", post.Name)
+	assert.Equal(t, "Original", post.Description)
+
+	post.Name = "p1-copy"
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project:     "default",
+			Name:        post.Name,
+			Description: post.Description,
+			Config:      post.Config,
+			Devices:     post.Devices,
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	_, original, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	_, clone, err := cluster.GetProfile("default", "p1-copy")
+	require.NoError(t, err)
+
+	assert.Equal(t, original.ProfilePut, clone.ProfilePut)
+	assert.Len(t, original.UsedBy, 1)
+	assert.Empty(t, clone.UsedBy)
+}
+
+func TestGetProfileConflictMatrix(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"limits.cpu": "1", "limits.memory": "1GiB", "user.a": "x"},
+			"p2": {"limits.cpu": "2", "limits.memory": "1GiB"},
+			"p3": {"limits.cpu": "1", "limits.memory": "2GiB", "user.a": "y"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	matrix, err := cluster.GetProfileConflictMatrix("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string][]string{
+		"p1": {
+			"p2": {"limits.cpu"},
+			"p3": {"limits.memory", "user.a"},
+		},
+		"p2": {
+			"p1": {"limits.cpu"},
+			"p3": {"limits.cpu", "limits.memory"},
+		},
+		"p3": {
+			"p1": {"limits.memory", "user.a"},
+			"p2": {"limits.cpu", "limits.memory"},
+		},
+	}, matrix)
+}
+
+func TestExpandInstanceDevicesWithSource(t *testing.T) {
+	profiles := []api.Profile{
+		{
+			Name: "p1",
+			ProfilePut: api.ProfilePut{
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "default"},
+					"eth0": {"type": "nic", "network": "lxdbr0"},
+				},
+			},
+		},
+		{
+			Name: "p2",
+			ProfilePut: api.ProfilePut{
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "fast"},
+				},
+			},
+		},
+	}
+	devices := deviceConfig.Devices{
+		"eth0": {"type": "nic", "network": "lxdbr1"},
+		"data": {"type": "disk", "path": "/data", "source": "/srv"},
+	}
+
+	expanded, sources := db.ExpandInstanceDevicesWithSource(devices, profiles)
+	assert.Equal(t, db.ExpandInstanceDevices(devices, profiles), expanded)
+	assert.Equal(t, map[string]string{
+		"root": "p2",
+		"eth0": "instance",
+		"data": "instance",
+	}, sources)
+}
+
+func TestGetProfileConfigByPrefix(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config: map[string]string{
+				"limits.cpu":       "2",
+				"limits.memory":    "1GiB",
+				"limitsXcpu":       "x",
+				"security.nesting": "true",
+				"user.a_b":         "1",
+				"user.aXb":         "2",
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	config, err := cluster.GetProfileConfigByPrefix("default", "p1", "limits.")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"limits.cpu": "2", "limits.memory": "1GiB"}, config)
+
+	// Wildcards in the prefix are matched literally.
+	config, err = cluster.GetProfileConfigByPrefix("default", "p1", "user.a_")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"user.a_b": "1"}, config)
+
+	_, err = cluster.GetProfileConfigByPrefix("default", "missing", "limits.")
+	assert.Equal(t, db.ErrNoSuchObject, err)
+}
+
+func TestExpandInstanceConfigWithSource(t *testing.T) {
+	profiles := []api.Profile{
+		{Name: "p1", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "1", "limits.memory": "1GiB", "boot.autostart": "true"}}},
+		{Name: "p2", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "2"}}},
+		{Name: "p3", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.memory": "2GiB", "user.a": "p3"}}},
+	}
+	config := map[string]string{"user.a": "instance", "user.b": "instance"}
+
+	expanded, sources := db.ExpandInstanceConfigWithSource(config, profiles)
+	assert.Equal(t, db.ExpandInstanceConfig(config, profiles), expanded)
+	assert.Equal(t, map[string]string{
+		"limits.cpu":     "2",
+		"limits.memory":  "2GiB",
+		"boot.autostart": "true",
+		"user.a":         "instance",
+		"user.b":         "instance",
+	}, expanded)
+	assert.Equal(t, map[string]string{
+		"limits.cpu":     "p2",
+		"limits.memory":  "p3",
+		"boot.autostart": "p1",
+		"user.a":         "instance",
+		"user.b":         "instance",
+	}, sources)
+}
+
+func TestGetProfilesWithBootConfig(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"boot.autostart": "true", "boot.autostart.priority": "10", "limits.cpu": "1"},
+			"p2": {"boot.autostart": "false"},
+			"p3": {"limits.cpu": "2"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	results, err := cluster.GetProfilesWithBootConfig("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"p1": {"boot.autostart": "true", "boot.autostart.priority": "10"},
+		"p2": {"boot.autostart": "false"},
+	}, results)
+}
+
+func TestGetProfiles(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"a", "b", "c"} {
+			_, err := tx.CreateProfile(db.Profile{
+				Project: "default",
+				Name:    name,
+				Config:  map[string]string{"user.name": name},
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": name},
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		addProfileInstance(t, tx, "c1", instancetype.Container, "b")
+		return nil
+	})
+	require.NoError(t, err)
+
+	profiles, err := cluster.GetProfiles("default", []string{"c", "a", "b"})
+	require.NoError(t, err)
+	require.Len(t, profiles, 3)
+
+	for i, name := range []string{"c", "a", "b"} {
+		_, expected, err := cluster.GetProfile("default", name)
+		require.NoError(t, err)
+		assert.Equal(t, *expected, profiles[i])
+	}
+	assert.Equal(t, []string{"/1.0/instances/c1?project=default"}, profiles[2].UsedBy)
+
+	_, err = cluster.GetProfiles("default", []string{"a", "missing"})
+	assert.EqualError(t, err, `Load profile "missing": No such object`)
+}
+
+func BenchmarkGetProfiles(b *testing.B) {
+	cluster, cleanup := db.NewTestCluster(b)
+	defer cleanup()
+
+	names := make([]string, 12)
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for i := range names {
+			names[i] = fmt.Sprintf("p%d", i)
+			_, err := tx.CreateProfile(db.Profile{
+				Project: "default",
+				Name:    names[i],
+				Config:  map[string]string{"limits.cpu": "1", "user.index": names[i]},
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "default"},
+				},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(b, err)
+
+	b.Run("by-names", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := cluster.Transaction(func(tx *db.ClusterTx) error {
+				_, err := tx.GetProfilesByNames("default", names)
+				return err
+			})
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("one-by-one", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := cluster.Transaction(func(tx *db.ClusterTx) error {
+				for _, name := range names {
+					_, err := tx.GetProfile("default", name)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			require.NoError(b, err)
+		}
+	})
+}
+
+// ClearProfileConfigOnly deletes the config of a profile but keeps its
+// devices.
+func TestClearProfileConfigOnly(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config:  map[string]string{"limits.cpu": "2"},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	id, _, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+
+	sqlTx, err := cluster.DB().Begin()
+	require.NoError(t, err)
+	require.NoError(t, db.ClearProfileConfigOnly(sqlTx, id))
+	require.NoError(t, sqlTx.Commit())
+
+	_, profile, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Empty(t, profile.Config)
+	assert.Equal(t, map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "default"},
+	}, profile.Devices)
+}
+
+// Renaming a profile to or from a reserved name is rejected with
+// ErrProfileNameReserved.
+func TestValidateProfileRename(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"p1", "p2"} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		err := tx.ValidateProfileRename("default", "p1", "default")
+		assert.Equal(t, db.ErrProfileNameReserved, errors.Cause(err))
+
+		err = tx.ValidateProfileRename("default", "default", "p3")
+		assert.Equal(t, db.ErrProfileNameReserved, errors.Cause(err))
+
+		err = tx.ValidateProfileRename("default", "p1", "a/b")
+		assert.EqualError(t, err, "Profile names may not contain slashes")
+
+		err = tx.ValidateProfileRename("default", "p1", "p2")
+		assert.EqualError(t, err, "Name 'p2' already in use")
+
+		err = tx.ValidateProfileRename("default", "p1", "p3")
+		assert.NoError(t, err)
+
+		// A name taken earlier in the same transaction is seen as in use.
+		_, err = tx.CreateProfile(db.Profile{Project: "default", Name: "p3"})
+		require.NoError(t, err)
+
+		err = tx.ValidateProfileRename("default", "p1", "p3")
+		assert.EqualError(t, err, "Name 'p3' already in use")
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// The config matrix contains only the requested keys that each profile sets.
+func TestGetConfigMatrix(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles := map[string]map[string]string{
+			"p1": {"limits.cpu": "1", "limits.memory": "1GB", "boot.autostart": "true"},
+			"p2": {"limits.cpu": "2"},
+			"p3": {"security.nesting": "true"},
+		}
+		for name, config := range profiles {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	matrix, err := cluster.GetConfigMatrix("default", []string{"limits.cpu", "limits.memory"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"p1": {"limits.cpu": "1", "limits.memory": "1GB"},
+		"p2": {"limits.cpu": "2"},
+	}, matrix)
+}
+
+// CreateProfileConfig rejects empty or whitespace-only keys without inserting
+// anything.
+func TestCreateProfileConfig_EmptyKey(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	id, _, err := cluster.GetProfile("default", "default")
+	require.NoError(t, err)
+
+	for _, key := range []string{"", "  "} {
+		sqlTx, err := cluster.DB().Begin()
+		require.NoError(t, err)
+
+		err = db.CreateProfileConfig(sqlTx, id, map[string]string{key: "x", "limits.cpu": "1"})
+		assert.EqualError(t, err, "Invalid empty config key")
+		require.NoError(t, sqlTx.Commit())
+	}
+
+	_, profile, err := cluster.GetProfile("default", "default")
+	require.NoError(t, err)
+	assert.Empty(t, profile.Config)
+}
+
+// The creation time of a profile is stored and returned.
+func TestGetProfileCreatedAt(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	now := time.Now().UTC().Truncate(time.Second)
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{Project: "default", Name: "p1", CreatedAt: now})
+		return err
+	})
+	require.NoError(t, err)
+
+	createdAt, err := cluster.GetProfileCreatedAt("default", "p1")
+	require.NoError(t, err)
+	assert.True(t, createdAt.Equal(now))
+
+	_, profile, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.True(t, profile.CreatedAt.Equal(now))
+
+	// The default profile gets its creation time when the cluster is
+	// bootstrapped.
+	createdAt, err = cluster.GetProfileCreatedAt("default", "default")
+	require.NoError(t, err)
+	assert.False(t, createdAt.IsZero())
+}
+
+// GetProfileNames returns the same names as a plain query against the
+// profiles table, falling back to the default project's profiles when the
+// project doesn't have the profiles feature enabled.
+func TestGetProfileNames(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProject(api.ProjectsPost{
+			Name: "p1",
+			ProjectPut: api.ProjectPut{
+				Config: map[string]string{"features.profiles": "true"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProject(api.ProjectsPost{Name: "p2"})
+		if err != nil {
+			return err
+		}
+
+		for _, profile := range []db.Profile{
+			{Project: "default", Name: "web"},
+			{Project: "default", Name: "db"},
+			{Project: "p1", Name: "default"},
+			{Project: "p1", Name: "other"},
+		} {
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	namesInProject := func(project string) []string {
+		tx, err := cluster.DB().Begin()
+		require.NoError(t, err)
+		defer tx.Rollback()
+
+		names, err := query.SelectStrings(tx, `
+SELECT profiles.name
+ FROM profiles
+ JOIN projects ON projects.id = profiles.project_id
+WHERE projects.name = ?`, project)
+		require.NoError(t, err)
+		return names
+	}
+
+	names, err := cluster.GetProfileNames("default")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, namesInProject("default"), names)
+	assert.Equal(t, []string{"db", "default", "web"}, names)
+
+	names, err = cluster.GetProfileNames("p1")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, namesInProject("p1"), names)
+	assert.Equal(t, []string{"default", "other"}, names)
+
+	// Project p2 doesn't have the profiles feature, so the profiles of the
+	// default project are returned.
+	names, err = cluster.GetProfileNames("p2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db", "default", "web"}, names)
+}
+
+// Only profiles created before the given age are returned.
+func TestGetProfilesOlderThan(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	now := time.Now().UTC()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, profile := range []db.Profile{
+			{Project: "default", Name: "recent", CreatedAt: now.Add(-time.Hour)},
+			{Project: "default", Name: "old2", CreatedAt: now.Add(-48 * time.Hour)},
+			{Project: "default", Name: "old1", CreatedAt: now.Add(-72 * time.Hour)},
+			{Project: "default", Name: "unknown"},
+		} {
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	names, err := cluster.GetProfilesOlderThan("default", 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old1", "old2"}, names)
+
+	names, err = cluster.GetProfilesOlderThan("default", 60*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old1"}, names)
+
+	names, err = cluster.GetProfilesOlderThan("default", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old1", "old2", "recent"}, names)
+}
+
+// Profiles can be filtered by the URLs of the instances using them.
+func TestGetProfilesByUsage(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"p1", "p2", "p3"} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name})
+			if err != nil {
+				return err
+			}
+		}
+		addProfileInstance(t, tx, "web1", instancetype.Container, "default", "p1")
+		addProfileInstance(t, tx, "web2", instancetype.Container, "default", "p2")
+		return nil
+	})
+	require.NoError(t, err)
+
+	profileNames := func(profiles []db.Profile) []string {
+		names := []string{}
+		for _, profile := range profiles {
+			names = append(names, profile.Name)
+		}
+		return names
+	}
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles, err := tx.GetProfilesByUsage(db.ProfileFilter{Project: "default", UsedBy: "/instances/web1"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"default", "p1"}, profileNames(profiles))
+
+		profiles, err = tx.GetProfilesByUsage(db.ProfileFilter{Project: "default", UsedBy: "web"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"default", "p1", "p2"}, profileNames(profiles))
+
+		profiles, err = tx.GetProfilesByUsage(db.ProfileFilter{Project: "default", UsedBy: "-"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"p3"}, profileNames(profiles))
+
+		profiles, err = tx.GetProfilesByUsage(db.ProfileFilter{Project: "default"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"default", "p1", "p2", "p3"}, profileNames(profiles))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Only the keys of the given device starting with the prefix are returned.
+func TestGetProfileDeviceConfigByPrefix(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Devices: map[string]map[string]string{
+				"data": {
+					"type":                  "disk",
+					"path":                  "/data",
+					"source":                "/srv/data",
+					"limits.read":           "10MB",
+					"limits.write":          "5MB",
+					"limits_underscore.max": "1",
+				},
+				"other": {"type": "disk", "path": "/other", "source": "/srv/other", "limits.read": "1MB"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	config, err := cluster.GetProfileDeviceConfigByPrefix("default", "p1", "data", "limits.")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"limits.read": "10MB", "limits.write": "5MB"}, config)
+
+	config, err = cluster.GetProfileDeviceConfigByPrefix("default", "p1", "data", "limits_")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"limits_underscore.max": "1"}, config)
+
+	_, err = cluster.GetProfileDeviceConfigByPrefix("default", "p1", "missing", "limits.")
+	assert.Equal(t, db.ErrNoSuchObject, errors.Cause(err))
+}
+
+// The context-aware profile getters give up as soon as the context is done,
+// instead of blocking on a held database lock.
+func TestGetProfileCtx_Cancel(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	_, profile, err := cluster.GetProfileCtx(ctx, "default", "default")
+	require.NoError(t, err)
+	assert.Equal(t, "default", profile.Name)
+
+	require.NoError(t, cluster.EnterExclusive())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err = cluster.GetProfileCtx(ctx, "default", "default")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	_, err = cluster.GetProfilesCtx(ctx, "default", []string{"default"})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	_, err = cluster.GetProfileNamesCtx(ctx, "default")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	require.NoError(t, cluster.ExitExclusive(func(*db.ClusterTx) error { return nil }))
+
+	// Once the lock is released, a cancelled context still makes the
+	// transaction fail.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	_, err = cluster.GetProfileNamesCtx(ctx, "default")
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+
+	names, err := cluster.GetProfileNames("default")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default"}, names)
+}
+
+// Cancelling the context interrupts a statement in flight.
+func TestGetProfileCtx_CancelInFlight(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	// Make loading the usage of profiles spin forever.
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.Tx().Exec(`
+DROP VIEW profiles_used_by_ref;
+CREATE VIEW profiles_used_by_ref (project, name, value) AS
+  WITH RECURSIVE spin(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM spin)
+  SELECT '' || n, '' || n, '' FROM spin WHERE n < 0;
+`)
+		return err
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(100*time.Millisecond, cancel)
+	defer timer.Stop()
+
+	_, _, err = cluster.GetProfileCtx(ctx, "default", "default")
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	timer = time.AfterFunc(100*time.Millisecond, cancel)
+	defer timer.Stop()
+
+	_, err = cluster.GetProfilesCtx(ctx, "default", []string{"default"})
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+}
+
+// A profile can be copied within its project or into another one.
+func TestCopyProfile(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	config := map[string]string{"limits.cpu": "2"}
+	devices := map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "default"},
+	}
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProject(api.ProjectsPost{
+			Name: "p1",
+			ProjectPut: api.ProjectPut{
+				Config: map[string]string{"features.profiles": "true"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProject(api.ProjectsPost{Name: "p2"})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProfile(db.Profile{
+			Project:     "default",
+			Name:        "web",
+			Description: "Web servers",
+			Config:      config,
+			Devices:     devices,
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		require.NoError(t, tx.CopyProfile("default", "web", "default", "web2"))
+		require.NoError(t, tx.CopyProfile("default", "web", "p1", "web"))
+
+		// Project p2 doesn't have profiles, so the target is the
+		// default project, where "web" already exists.
+		err := tx.CopyProfile("default", "web", "p2", "web")
+		assert.EqualError(t, err, `Profile "web" already exists in project "default"`)
+
+		err = tx.CopyProfile("default", "missing", "p1", "missing")
+		assert.Equal(t, db.ErrNoSuchObject, errors.Cause(err))
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	for _, target := range [][2]string{{"default", "web2"}, {"p1", "web"}} {
+		_, profile, err := cluster.GetProfile(target[0], target[1])
+		require.NoError(t, err)
+		assert.Equal(t, "Web servers", profile.Description)
+		assert.Equal(t, config, profile.Config)
+		assert.Equal(t, devices, profile.Devices)
+	}
+}
+
+// Config keys with a secret prefix are redacted, the others are left intact.
+func TestGetProfileRedacted(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	devices := map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "default"},
+	}
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config: map[string]string{
+				"limits.cpu":         "2",
+				"user.secret.token":  "abc",
+				"user.password":      "hunter2",
+				"user.note":          "hello",
+				"environment.APIKEY": "xyz",
+			},
+			Devices: devices,
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	profile, err := cluster.GetProfileRedacted("default", "p1", []string{"user.secret.", "user.password", "environment."})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"limits.cpu":         "2",
+		"user.secret.token":  db.ProfileRedactedValue,
+		"user.password":      db.ProfileRedactedValue,
+		"user.note":          "hello",
+		"environment.APIKEY": db.ProfileRedactedValue,
+	}, profile.Config)
+	assert.Equal(t, devices, profile.Devices)
+
+	// The stored profile is not affected.
+	_, profile, err = cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", profile.Config["user.secret.token"])
+}
+
+// The profile ETag doesn't depend on map ordering or on the profile name.
+func TestProfileETag(t *testing.T) {
+	p1 := &api.Profile{Name: "p1"}
+	p1.Description = "Web"
+	p1.Config = map[string]string{"limits.cpu": "2", "limits.memory": "1GiB", "user.a": "x"}
+	p1.Devices = map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "default"},
+		"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+	}
+
+	p2 := &api.Profile{Name: "p2"}
+	p2.Description = "Web"
+	p2.Config = map[string]string{"user.a": "x", "limits.memory": "1GiB", "limits.cpu": "2"}
+	p2.Devices = map[string]map[string]string{
+		"eth0": {"parent": "lxdbr0", "nictype": "bridged", "type": "nic"},
+		"root": {"pool": "default", "path": "/", "type": "disk"},
+	}
+
+	assert.Equal(t, db.ProfileETag(p1), db.ProfileETag(p2))
+
+	p2.Description = "Database"
+	assert.NotEqual(t, db.ProfileETag(p1), db.ProfileETag(p2))
+}
+
+// Profile updates are applied only if the given ETag matches the current one.
+func TestUpdateProfileIfMatch(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Owner:   "alice",
+			Config:  map[string]string{"limits.cpu": "1"},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	_, current, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	etag := db.ProfileETag(current)
+
+	update := api.Profile{}
+	update.Description = "Updated"
+	update.Config = map[string]string{"limits.cpu": "2"}
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.UpdateProfileIfMatch("default", "p1", etag, update)
+	})
+	require.NoError(t, err)
+
+	// The ETag is now stale.
+	update.Config = map[string]string{"limits.cpu": "4"}
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.UpdateProfileIfMatch("default", "p1", etag, update)
+	})
+	assert.Equal(t, db.ErrETagMismatch, err)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile, err := tx.GetProfile("default", "p1")
+		require.NoError(t, err)
+		assert.Equal(t, "Updated", profile.Description)
+		assert.Equal(t, "alice", profile.Owner)
+		assert.Equal(t, map[string]string{"limits.cpu": "2"}, profile.Config)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Config keys used by any profile are suggested by prefix.
+func TestSuggestProfileConfigKeys(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles := map[string]map[string]string{
+			"p1": {"limits.cpu": "1", "limits.memory": "1GiB", "security.nesting": "true"},
+			"p2": {"limits.cpu": "2", "limits.processes": "100"},
+			"p3": {"boot.autostart": "true"},
+		}
+		for name, config := range profiles {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	keys, err := cluster.SuggestProfileConfigKeys("default", "limits.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"limits.cpu", "limits.memory", "limits.processes"}, keys)
+
+	keys, err = cluster.SuggestProfileConfigKeys("default", "limits.m")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"limits.memory"}, keys)
+
+	keys, err = cluster.SuggestProfileConfigKeys("default", "")
+	require.NoError(t, err)
+	assert.Len(t, keys, 5)
+
+	keys, err = cluster.SuggestProfileConfigKeys("default", "user.")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+// ProfileDiff reports description, config and device changes between two
+// profiles.
+func TestProfileDiff(t *testing.T) {
+	a := &api.Profile{Name: "a"}
+	a.Description = "Old"
+	a.Config = map[string]string{"limits.cpu": "1", "limits.memory": "1GiB", "user.a": "x"}
+	a.Devices = map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "default"},
+		"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+		"data": {"type": "disk", "path": "/data", "source": "/srv/data"},
+	}
+
+	b := &api.Profile{Name: "b"}
+	b.Description = "New"
+	b.Config = map[string]string{"limits.cpu": "2", "user.a": "x", "user.b": "y"}
+	b.Devices = map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "fast", "size": "10GiB"},
+		"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+		"gpu":  {"type": "gpu"},
+	}
+
+	change := db.ProfileDiff(a, b)
+
+	assert.Equal(t, &db.ProfileValueChange{Old: "Old", New: "New"}, change.Description)
+	assert.Equal(t, map[string]string{"user.b": "y"}, change.ConfigAdded)
+	assert.Equal(t, map[string]string{"limits.memory": "1GiB"}, change.ConfigRemoved)
+	assert.Equal(t, map[string]db.ProfileValueChange{"limits.cpu": {Old: "1", New: "2"}}, change.ConfigChanged)
+	assert.Equal(t, map[string]map[string]string{"gpu": {"type": "gpu"}}, change.DevicesAdded)
+	assert.Equal(t, map[string]map[string]string{"data": a.Devices["data"]}, change.DevicesRemoved)
+	assert.Equal(t, map[string]db.ProfileDeviceChange{
+		"root": {
+			Added:   map[string]string{"size": "10GiB"},
+			Removed: map[string]string{},
+			Changed: map[string]db.ProfileValueChange{"pool": {Old: "default", New: "fast"}},
+		},
+	}, change.DevicesChanged)
+	assert.False(t, change.IsEmpty())
+
+	// Comparing a profile with itself yields no change, regardless of the
+	// name.
+	c := *a
+	c.Name = "c"
+	assert.True(t, db.ProfileDiff(a, &c).IsEmpty())
+}
+
+// Values used for a config key by any profile are suggested by prefix.
+func TestSuggestProfileConfigValues(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles := map[string]map[string]string{
+			"p1": {"limits.memory": "1GiB", "limits.cpu": "2"},
+			"p2": {"limits.memory": "2GiB"},
+			"p3": {"limits.memory": "1GiB"},
+			"p4": {"limits.memory": "512MiB", "user.note": "1GiB"},
+		}
+		for name, config := range profiles {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	values, err := cluster.SuggestProfileConfigValues("default", "limits.memory", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1GiB", "2GiB", "512MiB"}, values)
+
+	values, err = cluster.SuggestProfileConfigValues("default", "limits.memory", "1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1GiB"}, values)
+
+	values, err = cluster.SuggestProfileConfigValues("default", "limits.cpu", "4")
+	require.NoError(t, err)
+	assert.Empty(t, values)
+}
+
+// Orphaned profile config and devices are removed, and the number of deleted
+// rows is returned.
+func TestRemoveUnreferencedProfiles(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	conn, err := cluster.DB().Conn(ctx)
+	require.NoError(t, err)
+
+	for _, stmt := range []string{
+		"PRAGMA foreign_keys=OFF",
+		"INSERT INTO profiles_config (profile_id, key, value) VALUES (999, 'limits.cpu', '1')",
+		"INSERT INTO profiles_config (profile_id, key, value) VALUES (999, 'limits.memory', '1GiB')",
+		"INSERT INTO profiles_devices (id, profile_id, name, type) VALUES (999, 999, 'root', 2)",
+		"INSERT INTO profiles_devices_config (profile_device_id, key, value) VALUES (999, 'path', '/')",
+		"INSERT INTO profiles_devices_config (profile_device_id, key, value) VALUES (998, 'path', '/')",
+		"PRAGMA foreign_keys=ON",
+	} {
+		_, err := conn.ExecContext(ctx, stmt)
+		require.NoError(t, err)
+	}
+	require.NoError(t, conn.Close())
+
+	// The config of the orphaned device is removed by cascade when the
+	// device is deleted, so it's not counted.
+	deleted, err := cluster.RemoveUnreferencedProfiles()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), deleted)
+
+	deleted, err = cluster.RemoveUnreferencedProfiles()
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+}
+
+// Profiles with a schema version lower than the given one are listed.
+func TestGetProfilesBelowSchemaVersion(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, profile := range []db.Profile{
+			{Project: "default", Name: "legacy"},
+			{Project: "default", Name: "old", SchemaVersion: 1},
+			{Project: "default", Name: "current", SchemaVersion: 2},
+		} {
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	names, err := cluster.GetProfilesBelowSchemaVersion("default", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default", "legacy", "old"}, names)
+
+	names, err = cluster.GetProfilesBelowSchemaVersion("default", db.ProfileSchemaVersion)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"legacy"}, names)
+
+	// Conditional updates stamp the current version.
+	_, profile, err := cluster.GetProfile("default", "legacy")
+	require.NoError(t, err)
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.UpdateProfileIfMatch("default", "legacy", db.ProfileETag(profile), *profile)
+	})
+	require.NoError(t, err)
+
+	names, err = cluster.GetProfilesBelowSchemaVersion("default", db.ProfileSchemaVersion)
+	require.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+// Profiles of all projects are returned, with projects lacking the profiles
+// feature reporting the default project's profiles.
+func TestGetProfilesAllProjects(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProject(api.ProjectsPost{
+			Name: "p1",
+			ProjectPut: api.ProjectPut{
+				Config: map[string]string{"features.profiles": "true"},
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProject(api.ProjectsPost{Name: "p2"})
+		if err != nil {
+			return err
+		}
+
+		for _, profile := range []db.Profile{
+			{Project: "default", Name: "web", Config: map[string]string{"limits.cpu": "2"}},
+			{Project: "p1", Name: "default"},
+			{Project: "p1", Name: "db"},
+		} {
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	profiles, err := cluster.GetProfilesAllProjects(db.ProfileFilter{})
+	require.NoError(t, err)
+
+	names := map[string][]string{}
+	for project, list := range profiles {
+		names[project] = []string{}
+		for _, profile := range list {
+			names[project] = append(names[project], profile.Name)
+		}
+	}
+
+	assert.Equal(t, map[string][]string{
+		"default": {"default", "web"},
+		"p1":      {"db", "default"},
+		"p2":      {"default", "web"},
+	}, names)
+
+	assert.Equal(t, map[string]string{"limits.cpu": "2"}, profiles["p2"][1].Config)
+}
+
+// Dotted config keys are returned as nested maps.
+func TestGetProfileNested(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project:     "default",
+			Name:        "p1",
+			Description: "Web",
+			Config: map[string]string{
+				"limits.cpu":        "2",
+				"limits.memory":     "1GiB",
+				"security.nesting":  "true",
+				"user.a":            "leaf",
+				"user.a.b":          "branch",
+				"boot.autostart":    "true",
+				"boot.autostart.at": "1",
+			},
+			Devices: map[string]map[string]string{
+				"root": {"type": "disk", "path": "/", "pool": "default", "limits.read": "10MB"},
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	nested, err := cluster.GetProfileNested("default", "p1")
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{
+		"name":        "p1",
+		"description": "Web",
+		"config": map[string]interface{}{
+			"limits":   map[string]interface{}{"cpu": "2", "memory": "1GiB"},
+			"security": map[string]interface{}{"nesting": "true"},
+			"user": map[string]interface{}{
+				"a": map[string]interface{}{db.ProfileNestedValueKey: "leaf", "b": "branch"},
+			},
+			"boot": map[string]interface{}{
+				"autostart": map[string]interface{}{db.ProfileNestedValueKey: "true", "at": "1"},
+			},
+		},
+		"devices": map[string]interface{}{
+			"root": map[string]interface{}{
+				"type":   "disk",
+				"path":   "/",
+				"pool":   "default",
+				"limits": map[string]interface{}{"read": "10MB"},
+			},
+		},
+	}, nested)
+}
+
+func TestExpandInstanceConfig(t *testing.T) {
+	p1 := api.Profile{Name: "p1", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "1", "user.a": "x"}}}
+	p2 := api.Profile{Name: "p2", ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "2"}}}
+	empty := api.Profile{Name: "empty"}
+
+	cases := []struct {
+		name     string
+		config   map[string]string
+		profiles []api.Profile
+		expected map[string]string
+	}{
+		{
+			"nil config and profiles",
+			nil,
+			nil,
+			map[string]string{},
+		},
+		{
+			"nil profiles",
+			map[string]string{"limits.cpu": "4"},
+			nil,
+			map[string]string{"limits.cpu": "4"},
+		},
+		{
+			"nil config",
+			nil,
+			[]api.Profile{p1},
+			map[string]string{"limits.cpu": "1", "user.a": "x"},
+		},
+		{
+			"profile with nil config",
+			map[string]string{"user.b": "y"},
+			[]api.Profile{empty},
+			map[string]string{"user.b": "y"},
+		},
+		{
+			"later profiles win",
+			nil,
+			[]api.Profile{p1, p2},
+			map[string]string{"limits.cpu": "2", "user.a": "x"},
+		},
+		{
+			"earlier profiles lose regardless of order",
+			nil,
+			[]api.Profile{p2, p1},
+			map[string]string{"limits.cpu": "1", "user.a": "x"},
+		},
+		{
+			"instance config wins",
+			map[string]string{"limits.cpu": "4"},
+			[]api.Profile{p1, p2},
+			map[string]string{"limits.cpu": "4", "user.a": "x"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			expanded := db.ExpandInstanceConfig(c.config, c.profiles)
+			assert.Equal(t, c.expected, expanded)
+
+			// The result never aliases the given config.
+			expanded["user.new"] = "z"
+			_, ok := c.config["user.new"]
+			assert.False(t, ok)
+		})
+	}
+}
+
+// Profile config is converted to inventory variables with normalized types.
+func TestGetProfileAsInventoryVars(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config: map[string]string{
+				"security.nesting":     "true",
+				"security.privileged":  "false",
+				"limits.cpu":           "2",
+				"limits.cpu.allowance": "-10",
+				"limits.memory":        "1GiB",
+				"user.cpu-range":       "0-3",
+				"user.yes":             "yes",
+			},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	vars, err := cluster.GetProfileAsInventoryVars("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"security_nesting":     true,
+		"security_privileged":  false,
+		"limits_cpu":           int64(2),
+		"limits_cpu_allowance": int64(-10),
+		"limits_memory":        "1GiB",
+		"user_cpu_range":       "0-3",
+		"user_yes":             "yes",
+	}, vars)
+}
+
+// Instances using a profile can be filtered by type.
+func TestGetInstancesWithProfileByType(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{Project: "default", Name: "p1"})
+		if err != nil {
+			return err
+		}
+		addProfileInstance(t, tx, "c1", instancetype.Container, "default", "p1")
+		addProfileInstance(t, tx, "vm1", instancetype.VM, "default", "p1")
+		return nil
+	})
+	require.NoError(t, err)
+
+	instances, err := cluster.GetInstancesWithProfileByType("default", "p1", instancetype.Container)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"default": {"c1"}}, instances)
+
+	instances, err = cluster.GetInstancesWithProfileByType("default", "p1", instancetype.VM)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"default": {"vm1"}}, instances)
+
+	instances, err = cluster.GetInstancesWithProfileByType("default", "p1", instancetype.Any)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"c1", "vm1"}, instances["default"])
+
+	// The old method keeps returning containers only.
+	instances, err = cluster.GetInstancesWithProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"default": {"c1"}}, instances)
+}
+
+// Deprecated profiles can be excluded from listings.
+func TestSetProfileDeprecated(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"p1", "p2"} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name})
+			if err != nil {
+				return err
+			}
+		}
+		addProfileInstance(t, tx, "c1", instancetype.Container, "default", "p2")
+		return tx.SetProfileDeprecated("default", "p1", true)
+	})
+	require.NoError(t, err)
+
+	profileNames := func(profiles []db.Profile) []string {
+		names := []string{}
+		for _, profile := range profiles {
+			names = append(names, profile.Name)
+		}
+		return names
+	}
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile, err := tx.GetProfile("default", "p1")
+		require.NoError(t, err)
+		assert.True(t, profile.Deprecated)
+
+		profiles, err := tx.GetProfilesByUsage(db.ProfileFilter{Project: "default", ExcludeDeprecated: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"default", "p2"}, profileNames(profiles))
+
+		profiles, err = tx.GetProfilesByUsage(db.ProfileFilter{Project: "default", UsedBy: "-", ExcludeDeprecated: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{}, profileNames(profiles))
+
+		profiles, err = tx.GetProfilesByUsage(db.ProfileFilter{Project: "default"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"default", "p1", "p2"}, profileNames(profiles))
+
+		require.NoError(t, tx.SetProfileDeprecated("default", "p1", false))
+
+		profile, err = tx.GetProfile("default", "p1")
+		require.NoError(t, err)
+		assert.False(t, profile.Deprecated)
+
+		err = tx.SetProfileDeprecated("default", "missing", true)
+		assert.Equal(t, db.ErrNoSuchObject, errors.Cause(err))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Numeric limits are exported as metrics, other values are skipped.
+func TestGetProfileConfigMetrics(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles := map[string]map[string]string{
+			"p1": {
+				"limits.cpu":           "2",
+				"limits.memory":        "1GiB",
+				"limits.cpu.allowance": "50%",
+				"security.nesting":     "true",
+			},
+			"p2": {
+				"limits.cpu":       "0-3",
+				"limits.processes": "500",
+				"user.count":       "3",
+			},
+		}
+		for name, config := range profiles {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	metrics, err := cluster.GetProfileConfigMetrics("default")
+	require.NoError(t, err)
+	assert.Equal(t, []db.ProfileMetric{
+		{Profile: "p1", Key: "limits.cpu", Value: 2},
+		{Profile: "p1", Key: "limits.memory", Value: 1024 * 1024 * 1024},
+		{Profile: "p2", Key: "limits.processes", Value: 500},
+	}, metrics)
+}
+
+// Many config keys are inserted in batches that stay below the parameters
+// limit.
+func TestCreateProfileConfig_ManyKeys(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	id, _, err := cluster.GetProfile("default", "default")
+	require.NoError(t, err)
+
+	config := map[string]string{"user.empty": ""}
+	for i := 0; i < 500; i++ {
+		config[fmt.Sprintf("user.key%03d", i)] = fmt.Sprintf("%d", i)
+	}
+
+	sqlTx, err := cluster.DB().Begin()
+	require.NoError(t, err)
+	require.NoError(t, db.CreateProfileConfig(sqlTx, id, config))
+	require.NoError(t, sqlTx.Commit())
+
+	_, profile, err := cluster.GetProfile("default", "default")
+	require.NoError(t, err)
+	assert.Len(t, profile.Config, 500)
+	assert.Equal(t, "0", profile.Config["user.key000"])
+	assert.Equal(t, "499", profile.Config["user.key499"])
+	assert.NotContains(t, profile.Config, "user.empty")
+}
+
+func BenchmarkCreateProfileConfig(b *testing.B) {
+	cluster, cleanup := db.NewTestCluster(b)
+	defer cleanup()
+
+	id, _, err := cluster.GetProfile("default", "default")
+	require.NoError(b, err)
+
+	config := map[string]string{}
+	for i := 0; i < 100; i++ {
+		config[fmt.Sprintf("user.key%03d", i)] = fmt.Sprintf("%d", i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sqlTx, err := cluster.DB().Begin()
+		require.NoError(b, err)
+		require.NoError(b, db.CreateProfileConfig(sqlTx, id, config))
+		require.NoError(b, sqlTx.Rollback())
+	}
+}
+
+// Conflicting devices get rename, merge and drop suggestions.
+func TestSuggestDeviceConflictResolution(t *testing.T) {
+	a := api.Profile{Name: "a"}
+	a.Devices = map[string]map[string]string{
+		"data": {"type": "disk", "path": "/data", "source": "/srv/a"},
+		"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+		"gpu":  {"type": "gpu"},
+	}
+
+	b := api.Profile{Name: "b"}
+	b.Devices = map[string]map[string]string{
+		"data":   {"type": "disk", "path": "/data", "source": "/srv/b", "readonly": "true"},
+		"data-b": {"type": "disk", "path": "/other", "source": "/srv/other"},
+		"eth0":   {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+		"gpu":    {"type": "unix-char", "path": "/dev/gpu"},
+	}
+
+	suggestions := db.SuggestDeviceConflictResolution(a, b)
+	assert.Equal(t, []db.ConflictSuggestion{
+		{Device: "data", Action: db.ConflictActionRename, Profile: "b", NewName: "data-b1"},
+		{
+			Device: "data",
+			Action: db.ConflictActionMerge,
+			Config: map[string]string{"type": "disk", "path": "/data", "source": "/srv/b", "readonly": "true"},
+		},
+		{Device: "data", Action: db.ConflictActionDrop, Profile: "a"},
+		{Device: "gpu", Action: db.ConflictActionRename, Profile: "b", NewName: "gpu-b"},
+		{Device: "gpu", Action: db.ConflictActionDrop, Profile: "a"},
+	}, suggestions)
+
+	assert.Empty(t, db.SuggestDeviceConflictResolution(a, a))
+}
+
+// Walking profiles can be stopped early by the callback.
+func TestWalkProfiles(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, profile := range []db.Profile{
+			{Project: "default", Name: "p1", Config: map[string]string{"limits.cpu": "1"}},
+			{
+				Project: "default",
+				Name:    "p2",
+				Config:  map[string]string{"limits.cpu": "2"},
+				Devices: map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "default"}},
+			},
+			{Project: "default", Name: "p3"},
+		} {
+			_, err := tx.CreateProfile(profile)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	stop := fmt.Errorf("stop")
+	walked := []api.Profile{}
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.WalkProfiles("default", func(profile api.Profile) error {
+			walked = append(walked, profile)
+			if len(walked) == 2 {
+				return stop
+			}
+			return nil
+		})
+	})
+	assert.Equal(t, stop, err)
+
+	require.Len(t, walked, 2)
+	assert.Equal(t, "default", walked[0].Name)
+	assert.Equal(t, "p1", walked[1].Name)
+	assert.Equal(t, map[string]string{"limits.cpu": "1"}, walked[1].Config)
+
+	walked = []api.Profile{}
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.WalkProfiles("default", func(profile api.Profile) error {
+			walked = append(walked, profile)
+			return nil
+		})
+	})
+	require.NoError(t, err)
+	require.Len(t, walked, 4)
+	assert.Equal(t, "p2", walked[2].Name)
+	assert.Equal(t, map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "default"}}, walked[2].Devices)
+	assert.Equal(t, "p3", walked[3].Name)
+}
+
+// WalkProfiles loads profiles in batches, so the callback sees changes made
+// to profiles of later batches while walking earlier ones.
+func TestWalkProfiles_Batches(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	defer db.SetWalkProfilesBatchSize(2)()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"p1", "p2", "p3", "p4"} {
+			_, err := tx.CreateProfile(db.Profile{
+				Project: "default",
+				Name:    name,
+				Config:  map[string]string{"user.name": name},
+				Devices: map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": name}},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	walked := []api.Profile{}
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.WalkProfiles("default", func(profile api.Profile) error {
+			walked = append(walked, profile)
+			if profile.Name != "default" {
+				return nil
+			}
+
+			// The third batch hasn't been loaded yet.
+			p4, err := tx.GetProfile("default", "p4")
+			if err != nil {
+				return err
+			}
+			p4.Config = map[string]string{"user.name": "changed"}
+			return tx.UpdateProfile("default", "p4", *p4)
+		})
+	})
+	require.NoError(t, err)
+
+	require.Len(t, walked, 5)
+	for i, name := range []string{"default", "p1", "p2", "p3"} {
+		assert.Equal(t, name, walked[i].Name)
+	}
+	assert.Equal(t, map[string]string{"user.name": "p2"}, walked[2].Config)
+	assert.Equal(t, map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "p2"}}, walked[2].Devices)
+	assert.Equal(t, "p4", walked[4].Name)
+	assert.Equal(t, map[string]string{"user.name": "changed"}, walked[4].Config)
+}
+
+// The profile config schema describes the well-known keys and their types.
+func TestGetProfileConfigSchema(t *testing.T) {
+	data, err := db.GetProfileConfigSchema()
+	require.NoError(t, err)
+
+	schema := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &schema))
+
+	assert.Equal(t, "object", schema["type"])
+	properties := schema["properties"].(map[string]interface{})
+
+	nesting := properties["security.nesting"].(map[string]interface{})
+	assert.Equal(t, "string", nesting["type"])
+	assert.Equal(t, "boolean", nesting["x-lxd-type"])
+	assert.Contains(t, nesting["enum"], "true")
+
+	processes := properties["limits.processes"].(map[string]interface{})
+	assert.Equal(t, "integer", processes["x-lxd-type"])
+	assert.Equal(t, "^(-?[0-9]+)?$", processes["pattern"])
+
+	priority := properties["limits.cpu.priority"].(map[string]interface{})
+	assert.Equal(t, "integer", priority["x-lxd-type"])
+	assert.Equal(t, float64(10), priority["x-lxd-maximum"])
+
+	cpu := properties["limits.cpu"].(map[string]interface{})
+	assert.Equal(t, "string", cpu["x-lxd-type"])
+
+	patterns := schema["patternProperties"].(map[string]interface{})
+	assert.Contains(t, patterns, "^user\\.")
+}
+
+// A profile can be compared against an export of it.
+func TestCompareProfileWithExport(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project:     "default",
+			Name:        "p1",
+			Description: "web",
+			Config:      map[string]string{"limits.cpu": "2", "limits.memory": "1GiB"},
+			Devices:     map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "default"}},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	exp := db.ProfileExport{
+		Name:        "p1",
+		Description: "web",
+		Config:      map[string]string{"limits.cpu": "2", "limits.memory": "1GiB"},
+		Devices:     map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "default"}},
+	}
+
+	change, err := cluster.CompareProfileWithExport("default", "p1", exp)
+	require.NoError(t, err)
+	assert.True(t, change.IsEmpty())
+
+	exp.Config = map[string]string{"limits.cpu": "4", "limits.memory": "1GiB"}
+
+	change, err = cluster.CompareProfileWithExport("default", "p1", exp)
+	require.NoError(t, err)
+	assert.Nil(t, change.Description)
+	assert.Empty(t, change.ConfigAdded)
+	assert.Empty(t, change.ConfigRemoved)
+	assert.Equal(t, map[string]db.ProfileValueChange{"limits.cpu": {Old: "2", New: "4"}}, change.ConfigChanged)
+	assert.Empty(t, change.DevicesChanged)
+
+	_, err = cluster.CompareProfileWithExport("default", "missing", exp)
+	assert.Equal(t, db.ErrNoSuchObject, err)
+}
+
+// The modification time of a profile advances whenever it gets changed.
+func TestProfileUpdatedAt(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	var created db.Profile
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		now := time.Now().UTC()
+		_, err := tx.CreateProfile(db.Profile{
+			Project:   "default",
+			Name:      "p1",
+			CreatedAt: now,
+			UpdatedAt: now,
+			Config:    map[string]string{"limits.cpu": "1"},
+		})
+		if err != nil {
+			return err
+		}
+
+		profile, err := tx.GetProfile("default", "p1")
+		if err != nil {
+			return err
+		}
+		created = *profile
+
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, created.CreatedAt, created.UpdatedAt)
+
+	// Return the current modification time of the given profile.
+	updatedAt := func(name string) time.Time {
+		var profile *db.Profile
+		err := cluster.Transaction(func(tx *db.ClusterTx) error {
+			var err error
+			profile, err = tx.GetProfile("default", name)
+			return err
+		})
+		require.NoError(t, err)
+		assert.Equal(t, created.CreatedAt, profile.CreatedAt)
+		return profile.UpdatedAt
+	}
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		current, err := tx.GetProfile("default", "p1")
+		if err != nil {
+			return err
+		}
+
+		return tx.UpdateProfileIfMatch("default", "p1", db.ProfileETag(db.ProfileToAPI(current)), api.Profile{
+			ProfilePut: api.ProfilePut{Config: map[string]string{"limits.cpu": "2"}},
+		})
+	})
+	require.NoError(t, err)
+	afterUpdate := updatedAt("p1")
+	assert.True(t, afterUpdate.After(created.UpdatedAt))
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		id, err := tx.GetProfileID("default", "p1")
+		if err != nil {
+			return err
+		}
+
+		return db.ClearProfileConfigOnly(tx.Tx(), id)
+	})
+	require.NoError(t, err)
+	afterClear := updatedAt("p1")
+	assert.True(t, afterClear.After(afterUpdate))
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		err := tx.RenameProfile("default", "p1", "p2")
+		if err != nil {
+			return err
+		}
+
+		return tx.TouchProfile("default", "p2")
+	})
+	require.NoError(t, err)
+	assert.True(t, updatedAt("p2").After(afterClear))
+
+	_, profile, err := cluster.GetProfile("default", "p2")
+	require.NoError(t, err)
+	assert.False(t, profile.UpdatedAt.IsZero())
+}
+
+func TestGetProfilesWithProxyDevices(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		devices := map[string]map[string]map[string]string{
+			"p1": {
+				"web":  {"type": "proxy", "listen": "tcp:0.0.0.0:80", "connect": "tcp:127.0.0.1:8080"},
+				"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+			},
+			"p2": {
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+		}
+		for name, devices := range devices {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Devices: devices})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	results, err := cluster.GetProfilesWithProxyDevices("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]map[string]string{
+		"p1": {
+			"web": {"type": "proxy", "listen": "tcp:0.0.0.0:80", "connect": "tcp:127.0.0.1:8080"},
+		},
+	}, results)
+}
+
+// GetProfileID returns the same ID as GetProfile, falling back to the
+// default project if needed.
+func TestGetProfileID(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{Project: "default", Name: "p1", Config: map[string]string{"limits.cpu": "1"}})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProject(api.ProjectsPost{Name: "blah"})
+		return err
+	})
+	require.NoError(t, err)
+
+	for _, project := range []string{"default", "blah"} {
+		expected, _, err := cluster.GetProfile(project, "p1")
+		require.NoError(t, err)
+
+		id, err := cluster.GetProfileID(project, "p1")
+		require.NoError(t, err)
+		assert.Equal(t, expected, id, project)
+	}
+
+	_, err = cluster.GetProfileID("default", "missing")
+	assert.Equal(t, db.ErrNoSuchObject, err)
+}
+
+// Instances of projects without their own profiles are reported under their
+// own project when using a profile of the default project.
+func TestGetInstancesWithProfile_AcrossProjects(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{Project: "default", Name: "p1"})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateProject(api.ProjectsPost{Name: "blah"})
+		if err != nil {
+			return err
+		}
+
+		addProfileInstance(t, tx, "c1", instancetype.Container, "p1")
+		addProfileInstance(t, tx, "vm1", instancetype.VM, "p1")
+
+		_, err = tx.CreateInstance(db.Instance{
+			Project:      "blah",
+			Name:         "c2",
+			Node:         "none",
+			Type:         instancetype.Container,
+			Architecture: 1,
+			Profiles:     []string{"p1"},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	results, err := cluster.GetInstancesWithProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"default": {"c1"},
+		"blah":    {"c2"},
+	}, results)
+
+	// Looking up from the project without profiles falls back to the
+	// default project.
+	results, err = cluster.GetInstancesWithProfile("blah", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"default": {"c1"},
+		"blah":    {"c2"},
+	}, results)
+}
+
+// Containers and VMs get different defaults for unset keys.
+func TestGetProfileWithTypeDefaults(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "p1",
+			Config:  map[string]string{"limits.cpu": "4", "security.nesting": "true"},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	profile, err := cluster.GetProfileWithTypeDefaults("default", "p1", instancetype.Container)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"limits.cpu":          "4",
+		"security.devlxd":     "true",
+		"security.nesting":    "true",
+		"security.privileged": "false",
+	}, profile.Config)
+
+	profile, err = cluster.GetProfileWithTypeDefaults("default", "p1", instancetype.VM)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"limits.cpu":          "4",
+		"limits.memory":       "1GiB",
+		"security.nesting":    "true",
+		"security.secureboot": "true",
+	}, profile.Config)
+
+	profile, err = cluster.GetProfileWithTypeDefaults("default", "p1", instancetype.Any)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"limits.cpu": "4", "security.nesting": "true"}, profile.Config)
+
+	_, err = cluster.GetProfileWithTypeDefaults("default", "missing", instancetype.VM)
+	assert.Equal(t, db.ErrNoSuchObject, err)
+}
+
+// Merging a stack of profiles matches expanding an empty instance with it.
+func TestMergeProfiles(t *testing.T) {
+	profiles := []api.Profile{
+		{
+			Name: "base",
+			ProfilePut: api.ProfilePut{
+				Config: map[string]string{"limits.cpu": "1", "limits.memory": "1GiB", "boot.autostart": "true"},
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "default"},
+					"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+				},
+			},
+		},
+		{
+			Name: "web",
+			ProfilePut: api.ProfilePut{
+				Config: map[string]string{"limits.cpu": "2", "user.role": "web"},
+				Devices: map[string]map[string]string{
+					"eth0": {"type": "nic", "nictype": "macvlan", "parent": "eno1"},
+				},
+			},
+		},
+		{
+			Name: "big",
+			ProfilePut: api.ProfilePut{
+				Config: map[string]string{"limits.cpu": "8", "limits.memory": "16GiB"},
+				Devices: map[string]map[string]string{
+					"root": {"type": "disk", "path": "/", "pool": "fast"},
+				},
+			},
+		},
+	}
+
+	config, devices := db.MergeProfiles(profiles)
+	assert.Equal(t, map[string]string{
+		"limits.cpu":     "8",
+		"limits.memory":  "16GiB",
+		"boot.autostart": "true",
+		"user.role":      "web",
+	}, config)
+	assert.Equal(t, deviceConfig.Devices{
+		"root": {"type": "disk", "path": "/", "pool": "fast"},
+		"eth0": {"type": "nic", "nictype": "macvlan", "parent": "eno1"},
+	}, devices)
+
+	assert.Equal(t, db.ExpandInstanceConfig(nil, profiles), config)
+	assert.Equal(t, db.ExpandInstanceDevices(nil, profiles), devices)
+
+	config, devices = db.MergeProfiles(nil)
+	assert.Empty(t, config)
+	assert.Empty(t, devices)
+}
+
+func TestGetProfilesWithGPUDevices(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		devices := map[string]map[string]map[string]string{
+			"ml": {
+				"gpu1": {"type": "gpu", "pci": "0000:01:00.0"},
+				"gpu0": {"type": "gpu", "vendorid": "10de"},
+				"root": {"type": "disk", "path": "/", "pool": "default"},
+			},
+			"web": {
+				"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+			},
+		}
+		for name, devices := range devices {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Devices: devices})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	results, err := cluster.GetProfilesWithGPUDevices("default")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"ml": {"gpu0", "gpu1"}}, results)
+}
+
+// A rename pre-flight check reports the instances using the profile, or an
+// error if the new name is taken.
+func TestCanRenameProfile(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"p1", "p2", "p3"} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name})
+			if err != nil {
+				return err
+			}
+		}
+
+		addProfileInstance(t, tx, "c1", instancetype.Container, "p1")
+		addProfileInstance(t, tx, "c2", instancetype.Container, "p1", "p2")
+
+		// In use.
+		users, err := tx.CanRenameProfile("default", "p1", "new")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/1.0/instances/c1?project=default", "/1.0/instances/c2?project=default"}, users)
+
+		// Not in use.
+		users, err = tx.CanRenameProfile("default", "p3", "new")
+		require.NoError(t, err)
+		assert.Equal(t, []string{}, users)
+
+		// Collision.
+		_, err = tx.CanRenameProfile("default", "p1", "p2")
+		assert.EqualError(t, err, `Profile "p2" already exists in project "default"`)
+
+		// Missing profile.
+		_, err = tx.CanRenameProfile("default", "missing", "new")
+		assert.EqualError(t, err, `Load profile "missing": No such object`)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Nothing was renamed.
+	names, err := cluster.GetProfileNames("default")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default", "p1", "p2", "p3"}, names)
+}
+
+// The normalization preview matches the changes actually made by applying
+// NormalizeProfile.
+func TestPreviewProfileNormalization(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"p1": {"security.nesting": "Yes", "boot.autostart": "0", "limits.cpu": "2"},
+			"p2": {"user.note": "", "limits.memory": "1GiB"},
+			"p3": {"security.privileged": "true", "user.flag": "yes"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	preview, err := cluster.PreviewProfileNormalization("default")
+	require.NoError(t, err)
+	require.Len(t, preview, 2)
+	assert.Equal(t, map[string]db.ProfileValueChange{
+		"security.nesting": {Old: "Yes", New: "true"},
+		"boot.autostart":   {Old: "0", New: "false"},
+	}, preview["p1"].ConfigChanged)
+	assert.Equal(t, map[string]string{"user.note": ""}, preview["p2"].ConfigRemoved)
+
+	// Nothing was applied.
+	_, profile, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "Yes", profile.Config["security.nesting"])
+
+	// Apply the normalization and compare the actual changes.
+	before := map[string]*api.Profile{}
+	for _, name := range []string{"default", "p1", "p2", "p3"} {
+		_, profile, err := cluster.GetProfile("default", name)
+		require.NoError(t, err)
+		before[name] = profile
+
+		normalized := db.NormalizeProfile(*profile)
+		err = cluster.Transaction(func(tx *db.ClusterTx) error {
+			return tx.UpdateProfileIfMatch("default", name, db.ProfileETag(profile), normalized)
+		})
+		require.NoError(t, err)
+	}
+
+	for name, profile := range before {
+		_, after, err := cluster.GetProfile("default", name)
+		require.NoError(t, err)
+
+		change := db.ProfileDiff(profile, after)
+		expected, ok := preview[name]
+		if !ok {
+			assert.True(t, change.IsEmpty(), name)
+			continue
+		}
+		assert.Equal(t, expected, change, name)
+	}
+
+	preview, err = cluster.PreviewProfileNormalization("default")
+	require.NoError(t, err)
+	assert.Empty(t, preview)
+}
+
+func TestValidateProfileConfig(t *testing.T) {
+	config := map[string]string{
+		"limits.cpu":          "2",
+		"limits.memory":       "1GiB",
+		"environment.HTTP":    "proxy",
+		"security.privileged": "true",
+		"raw.lxc":             "lxc.aa_profile=unconfined",
+	}
+
+	cases := []struct {
+		prefixes []string
+		err      string
+	}{
+		{[]string{"limits.", "environment.", "security.", "raw."}, ""},
+		{[]string{"limits.*", "environment.*"}, "Config keys not allowed by policy: raw.lxc, security.privileged"},
+		{[]string{"limits."}, "Config keys not allowed by policy: environment.HTTP, raw.lxc, security.privileged"},
+		{[]string{"*"}, "Config keys not allowed by policy: environment.HTTP, limits.cpu, limits.memory, raw.lxc, security.privileged"},
+		{[]string{"", "limits."}, "Config keys not allowed by policy: environment.HTTP, raw.lxc, security.privileged"},
+		{nil, "Config keys not allowed by policy: environment.HTTP, limits.cpu, limits.memory, raw.lxc, security.privileged"},
+	}
+
+	for _, c := range cases {
+		err := db.ValidateProfileConfig(config, c.prefixes)
+		if c.err == "" {
+			assert.NoError(t, err, c.prefixes)
+		} else {
+			assert.EqualError(t, err, c.err, c.prefixes)
+		}
+	}
+
+	assert.NoError(t, db.ValidateProfileConfig(nil, nil))
+}
+
+func TestBuildProfileChangePayload(t *testing.T) {
+	a := &api.Profile{Name: "p1"}
+	a.Description = "old"
+	a.Config = map[string]string{"limits.cpu": "1", "user.foo": "bar"}
+	a.Devices = map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "default"},
+		"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"},
+	}
+
+	b := &api.Profile{Name: "p1"}
+	b.Description = "new"
+	b.Config = map[string]string{"limits.cpu": "2", "limits.memory": "1GiB"}
+	b.Devices = map[string]map[string]string{
+		"root": {"type": "disk", "path": "/", "pool": "fast"},
+		"gpu0": {"type": "gpu"},
+	}
+
+	data, err := db.BuildProfileChangePayload("default", "p1", db.ProfileDiff(a, b))
+	require.NoError(t, err)
+
+	assert.JSONEq(t, `{
+  "project": "default",
+  "name": "p1",
+  "type": "updated",
+  "description": {"old": "old", "new": "new"},
+  "config": {
+    "added": {"limits.memory": "1GiB"},
+    "removed": {"user.foo": "bar"},
+    "changed": {"limits.cpu": {"old": "1", "new": "2"}}
+  },
+  "devices": {
+    "added": {"gpu0": {"type": "gpu"}},
+    "removed": {"eth0": {"type": "nic", "nictype": "bridged", "parent": "lxdbr0"}},
+    "changed": {
+      "root": {"added": {}, "removed": {}, "changed": {"pool": {"old": "default", "new": "fast"}}}
+    }
+  }
+}`, string(data))
+
+	// The payload is stable.
+	again, err := db.BuildProfileChangePayload("default", "p1", db.ProfileDiff(a, b))
+	require.NoError(t, err)
+	assert.Equal(t, data, again)
+
+	data, err = db.BuildProfileChangePayload("default", "p1", db.ProfileDiff(a, a))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+  "project": "default",
+  "name": "p1",
+  "type": "unchanged",
+  "description": null,
+  "config": {"added": {}, "removed": {}, "changed": {}},
+  "devices": {"added": {}, "removed": {}, "changed": {}}
+}`, string(data))
+}
+
+// The ETag served by GetProfileETag is accepted by UpdateProfileIfMatch.
+func TestUpdateProfileIfMatch_GetProfileETag(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		now := time.Now().UTC()
+		_, err := tx.CreateProfile(db.Profile{
+			Project:   "default",
+			Name:      "p1",
+			CreatedAt: now,
+			UpdatedAt: now,
+			Config:    map[string]string{"limits.cpu": "1"},
+		})
+		return err
+	})
+	require.NoError(t, err)
+
+	etag, err := cluster.GetProfileETag("default", "p1")
+	require.NoError(t, err)
+
+	update := api.Profile{}
+	update.Config = map[string]string{"limits.cpu": "2"}
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.UpdateProfileIfMatch("default", "p1", etag, update)
+	})
+	require.NoError(t, err)
+
+	_, profile, err := cluster.GetProfile("default", "p1")
+	require.NoError(t, err)
+	assert.Equal(t, "2", profile.Config["limits.cpu"])
+
+	// The served ETag changed along with the profile, so the old one is
+	// now rejected.
+	current, err := cluster.GetProfileETag("default", "p1")
+	require.NoError(t, err)
+	assert.NotEqual(t, etag, current)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		return tx.UpdateProfileIfMatch("default", "p1", etag, update)
+	})
+	assert.Equal(t, db.ErrETagMismatch, err)
+}
+
+// Immutable profiles can't be modified by any of the profile writers, until
+// the immutable mark is cleared.
+func TestUpdateProfile_Immutable(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		_, err := tx.CreateProfile(db.Profile{
+			Project: "default",
+			Name:    "base",
+			Config:  map[string]string{"limits.cpu": "1"},
+			Devices: map[string]map[string]string{"root": {"type": "disk", "path": "/", "pool": "old"}},
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.SetProfileImmutable("default", "base", true)
+	})
+	require.NoError(t, err)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		profile, err := tx.GetProfile("default", "base")
+		if err != nil {
+			return err
+		}
+		profile.Config = map[string]string{"limits.cpu": "2"}
+		return tx.UpdateProfile("default", "base", *profile)
+	})
+	assert.Equal(t, db.ErrProfileImmutable, errors.Cause(err))
+
+	err = cluster.ImportProfileFromCanonicalText("default", "base", "limits.cpu=\"2\"\n")
+	assert.Equal(t, db.ErrProfileImmutable, errors.Cause(err))
+
+	_, err = cluster.CompactProfileConfig("default", "base", map[string]string{"limits.cpu": "1"})
+	assert.Equal(t, db.ErrProfileImmutable, errors.Cause(err))
+
+	err = cluster.SetProfileLabels("default", "base", []string{"prod"})
+	assert.Equal(t, db.ErrProfileImmutable, errors.Cause(err))
+
+	_, err = cluster.UpdateProfilePoolReferences("old", "new")
+	assert.Equal(t, db.ErrProfileImmutable, errors.Cause(err))
+
+	_, profile, err := cluster.GetProfile("default", "base")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"limits.cpu": "1"}, profile.Config)
+	assert.Equal(t, "old", profile.Devices["root"]["pool"])
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		err := tx.SetProfileImmutable("default", "base", false)
+		if err != nil {
+			return err
+		}
+
+		profile, err := tx.GetProfile("default", "base")
+		if err != nil {
+			return err
+		}
+		profile.Config = map[string]string{"limits.cpu": "2"}
+		return tx.UpdateProfile("default", "base", *profile)
+	})
+	require.NoError(t, err)
+}
+
+// The ExcludeDeprecated flag is honored by all profile listings.
+func TestGetProfiles_ExcludeDeprecated(t *testing.T) {
+	cluster, cleanup := db.NewTestCluster(t)
+	defer cleanup()
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		for _, name := range []string{"p1", "p2"} {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.SetProfileDeprecated("default", "p1", true)
+	})
+	require.NoError(t, err)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		profiles, err := tx.GetProfiles(db.ProfileFilter{Project: "default", ExcludeDeprecated: true})
+		require.NoError(t, err)
+		require.Len(t, profiles, 2)
+		assert.Equal(t, "default", profiles[0].Name)
+		assert.Equal(t, "p2", profiles[1].Name)
+
+		profiles, err = tx.GetProfiles(db.ProfileFilter{Project: "default", Name: "p1", ExcludeDeprecated: true})
+		require.NoError(t, err)
+		assert.Len(t, profiles, 0)
+
+		profiles, err = tx.GetProfiles(db.ProfileFilter{Project: "default"})
+		require.NoError(t, err)
+		assert.Len(t, profiles, 3)
+
+		uris, err := tx.GetProfileURIs(db.ProfileFilter{Project: "default", ExcludeDeprecated: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/1.0/profiles/default", "/1.0/profiles/p2"}, uris)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = cluster.Transaction(func(tx *db.ClusterTx) error {
+		names, err := tx.GetProfileNames(db.ProfileFilter{Project: "default", ExcludeDeprecated: true})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"default", "p2"}, names)
+		return nil
+	})
+	require.NoError(t, err)
+
+	names, err := cluster.GetProfileNames("default")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default", "p1", "p2"}, names)
+
+	all, err := cluster.GetProfilesAllProjects(db.ProfileFilter{ExcludeDeprecated: true})
+	require.NoError(t, err)
+	require.Len(t, all["default"], 2)
+	assert.Equal(t, "default", all["default"][0].Name)
+	assert.Equal(t, "p2", all["default"][1].Name)
+}
+
+// Create an instance of the given type in the default project, using the
+// given profiles.
+func addProfileInstance(t *testing.T, tx *db.ClusterTx, name string, typ instancetype.Type, profiles ...string) {
+	instance := db.Instance{
+		Project:      "default",
+		Name:         name,
+		Node:         "none",
+		Type:         typ,
+		Architecture: 1,
+		Profiles:     profiles,
+	}
+	_, err := tx.CreateInstance(instance)
+	require.NoError(t, err)
+}
+
+// Create n instances using a few different stacks of overlapping profiles, and
+// return their names.
+func seedBulkExpandInstances(t testing.TB, cluster *db.Cluster, n int) []string {
+	stacks := [][]string{{"base"}, {"base", "web"}, {"base", "db"}, {"web", "db"}}
+	instances := make([]string, n)
+
+	err := cluster.Transaction(func(tx *db.ClusterTx) error {
+		configs := map[string]map[string]string{
+			"base": {"limits.cpu": "1", "boot.autostart": "true"},
+			"web":  {"limits.cpu": "2", "user.role": "web"},
+			"db":   {"limits.memory": "4GiB", "user.role": "db"},
+		}
+		for name, config := range configs {
+			_, err := tx.CreateProfile(db.Profile{Project: "default", Name: name, Config: config})
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := range instances {
+			instances[i] = fmt.Sprintf("c%d", i)
+			_, err := tx.CreateInstance(db.Instance{
+				Project:      "default",
+				Name:         instances[i],
+				Node:         "none",
+				Type:         instancetype.Container,
+				Architecture: 1,
+				Profiles:     stacks[i%len(stacks)],
+				Config:       map[string]string{"user.index": fmt.Sprintf("%d", i)},
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	return instances
+}
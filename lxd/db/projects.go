@@ -3,6 +3,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -51,7 +52,7 @@ type ProjectFilter struct {
 // ProjectHasProfiles is a helper to check if a project has the profiles
 // feature enabled.
 func (c *ClusterTx) ProjectHasProfiles(name string) (bool, error) {
-	return projectHasProfiles(c.tx, name)
+	return projectHasProfilesCtx(c.ctx, c.tx, name)
 }
 
 // GetProjectNames returns the names of all available projects.
@@ -99,13 +100,19 @@ func (c *ClusterTx) GetProjectIDsToNames() (map[int64]string, error) {
 }
 
 func projectHasProfiles(tx *sql.Tx, name string) (bool, error) {
+	return projectHasProfilesCtx(context.Background(), tx, name)
+}
+
+// Like projectHasProfiles, but interrupts the query as soon as the given
+// context is done.
+func projectHasProfilesCtx(ctx context.Context, tx *sql.Tx, name string) (bool, error) {
 	stmt := `
 SELECT projects_config.value
   FROM projects_config
   JOIN projects ON projects.id=projects_config.project_id
  WHERE projects.name=? AND projects_config.key='features.profiles'
 `
-	values, err := query.SelectStrings(tx, stmt, name)
+	values, err := query.SelectStringsCtx(ctx, tx, stmt, name)
 	if err != nil {
 		return false, errors.Wrap(err, "Fetch project config")
 	}
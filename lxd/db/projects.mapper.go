@@ -109,7 +109,7 @@ func (c *ClusterTx) GetProjectURIs(filter ProjectFilter) ([]string, error) {
 	code := cluster.EntityTypes["project"]
 	formatter := cluster.EntityFormatURIs[code]
 
-	return query.SelectURIs(stmt, formatter, args...)
+	return query.SelectURIsCtx(c.ctx, stmt, formatter, args...)
 }
 
 // GetProjects returns all available projects.
@@ -147,7 +147,7 @@ func (c *ClusterTx) GetProjects(filter ProjectFilter) ([]api.Project, error) {
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch projects")
 	}
@@ -247,7 +247,7 @@ func (c *ClusterTx) ProjectConfigRef(filter ProjectFilter) (map[string]map[strin
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch  ref for projects")
 	}
@@ -302,7 +302,7 @@ func (c *ClusterTx) CreateProject(object api.ProjectsPost) (int64, error) {
 	stmt := c.stmt(projectCreate)
 
 	// Execute the statement.
-	result, err := stmt.Exec(args...)
+	result, err := stmt.ExecContext(c.ctx, args...)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to create project")
 	}
@@ -315,7 +315,7 @@ func (c *ClusterTx) CreateProject(object api.ProjectsPost) (int64, error) {
 	// Insert config reference.
 	stmt = c.stmt(projectCreateConfigRef)
 	for key, value := range object.Config {
-		_, err := stmt.Exec(id, key, value)
+		_, err := stmt.ExecContext(c.ctx, id, key, value)
 		if err != nil {
 			return -1, errors.Wrap(err, "Insert config for project")
 		}
@@ -365,7 +365,7 @@ func (c *ClusterTx) ProjectUsedByRef(filter ProjectFilter) (map[string][]string,
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch string ref for projects")
 	}
@@ -388,7 +388,7 @@ func (c *ClusterTx) ProjectUsedByRef(filter ProjectFilter) (map[string][]string,
 // GetProjectID return the ID of the project with the given key.
 func (c *ClusterTx) GetProjectID(name string) (int64, error) {
 	stmt := c.stmt(projectID)
-	rows, err := stmt.Query(name)
+	rows, err := stmt.QueryContext(c.ctx, name)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to get project ID")
 	}
@@ -417,7 +417,7 @@ func (c *ClusterTx) GetProjectID(name string) (int64, error) {
 // RenameProject renames the project matching the given key parameters.
 func (c *ClusterTx) RenameProject(name string, to string) error {
 	stmt := c.stmt(projectRename)
-	result, err := stmt.Exec(to, name)
+	result, err := stmt.ExecContext(c.ctx, to, name)
 	if err != nil {
 		return errors.Wrap(err, "Rename project")
 	}
@@ -435,7 +435,7 @@ func (c *ClusterTx) RenameProject(name string, to string) error {
 // DeleteProject deletes the project matching the given key parameters.
 func (c *ClusterTx) DeleteProject(name string) error {
 	stmt := c.stmt(projectDelete)
-	result, err := stmt.Exec(name)
+	result, err := stmt.ExecContext(c.ctx, name)
 	if err != nil {
 		return errors.Wrap(err, "Delete project")
 	}
@@ -1,6 +1,7 @@
 package query
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -9,7 +10,13 @@ import (
 // SelectObjects executes a statement which must yield rows with a specific
 // columns schema. It invokes the given Dest hook for each yielded row.
 func SelectObjects(stmt *sql.Stmt, dest Dest, args ...interface{}) error {
-	rows, err := stmt.Query(args...)
+	return SelectObjectsCtx(context.Background(), stmt, dest, args...)
+}
+
+// SelectObjectsCtx is like SelectObjects, but interrupts the statement as soon
+// as the given context is done.
+func SelectObjectsCtx(ctx context.Context, stmt *sql.Stmt, dest Dest, args ...interface{}) error {
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		return err
 	}
@@ -1,8 +1,10 @@
 package query_test
 
 import (
+	"context"
 	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/lxc/lxd/lxd/db/query"
 	"github.com/mpvl/subtest"
@@ -60,6 +62,28 @@ func TestSelectObjects(t *testing.T) {
 	assert.Equal(t, "bar", object.Name)
 }
 
+// Cancelling the context interrupts the statement while it's executing.
+func TestSelectObjectsCtx_Cancel(t *testing.T) {
+	tx := newTxForObjects(t)
+
+	stmt, err := tx.Prepare(`
+WITH RECURSIVE spin(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM spin)
+SELECT n, '' FROM spin WHERE n < 0`)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(100*time.Millisecond, cancel)
+	defer timer.Stop()
+
+	dest := func(int) []interface{} {
+		t.Fatal("no row is expected to be yielded")
+		return nil
+	}
+
+	err = query.SelectObjectsCtx(ctx, stmt, dest)
+	assert.Equal(t, context.Canceled, err)
+}
+
 // Exercise possible failure modes.
 func TestUpsertObject_Error(t *testing.T) {
 	cases := []struct {
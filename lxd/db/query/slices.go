@@ -1,6 +1,7 @@
 package query
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"strings"
@@ -14,7 +15,13 @@ import (
 // The f argument must be a function that formats the entity URI using the
 // columns yielded by the query.
 func SelectURIs(stmt *sql.Stmt, f func(a ...interface{}) string, args ...interface{}) ([]string, error) {
-	rows, err := stmt.Query(args...)
+	return SelectURIsCtx(context.Background(), stmt, f, args...)
+}
+
+// SelectURIsCtx is like SelectURIs, but interrupts the statement as soon as
+// the given context is done.
+func SelectURIsCtx(ctx context.Context, stmt *sql.Stmt, f func(a ...interface{}) string, args ...interface{}) ([]string, error) {
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to query URIs")
 	}
@@ -56,6 +63,12 @@ func SelectURIs(stmt *sql.Stmt, f func(a ...interface{}) string, args ...interfa
 // SelectStrings executes a statement which must yield rows with a single string
 // column. It returns the list of column values.
 func SelectStrings(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	return SelectStringsCtx(context.Background(), tx, query, args...)
+}
+
+// SelectStringsCtx is like SelectStrings, but interrupts the statement as
+// soon as the given context is done.
+func SelectStringsCtx(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
 	values := []string{}
 	scan := func(rows *sql.Rows) error {
 		var value string
@@ -67,7 +80,7 @@ func SelectStrings(tx *sql.Tx, query string, args ...interface{}) ([]string, err
 		return nil
 	}
 
-	err := scanSingleColumn(tx, query, args, "TEXT", scan)
+	err := scanSingleColumn(ctx, tx, query, args, "TEXT", scan)
 	if err != nil {
 		return nil, err
 	}
@@ -89,7 +102,7 @@ func SelectIntegers(tx *sql.Tx, query string, args ...interface{}) ([]int, error
 		return nil
 	}
 
-	err := scanSingleColumn(tx, query, args, "INTEGER", scan)
+	err := scanSingleColumn(context.Background(), tx, query, args, "INTEGER", scan)
 	if err != nil {
 		return nil, err
 	}
@@ -123,8 +136,8 @@ func InsertStrings(tx *sql.Tx, stmt string, values []string) error {
 // Execute the given query and ensure that it yields rows with a single column
 // of the given database type. For every row yielded, execute the given
 // scanner.
-func scanSingleColumn(tx *sql.Tx, query string, args []interface{}, typeName string, scan scanFunc) error {
-	rows, err := tx.Query(query, args...)
+func scanSingleColumn(ctx context.Context, tx *sql.Tx, query string, args []interface{}, typeName string, scan scanFunc) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
 		return err
 	}
@@ -1,6 +1,7 @@
 package query
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/lxc/lxd/shared/logger"
@@ -9,7 +10,14 @@ import (
 
 // Transaction executes the given function within a database transaction.
 func Transaction(db *sql.DB, f func(*sql.Tx) error) error {
-	tx, err := db.Begin()
+	return TransactionCtx(context.Background(), db, f)
+}
+
+// TransactionCtx is like Transaction, but the transaction is bound to the
+// given context: if the context is done before the transaction is committed,
+// the transaction gets rolled back and any further query in it fails.
+func TransactionCtx(ctx context.Context, db *sql.DB, f func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return errors.Wrap(err, "failed to begin transaction")
 	}
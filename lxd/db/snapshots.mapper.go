@@ -144,7 +144,7 @@ func (c *ClusterTx) GetInstanceSnapshots(filter InstanceSnapshotFilter) ([]Insta
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch instance_snapshots")
 	}
@@ -229,7 +229,7 @@ func (c *ClusterTx) GetInstanceSnapshot(project string, instance string, name st
 // GetInstanceSnapshotID return the ID of the instance_snapshot with the given key.
 func (c *ClusterTx) GetInstanceSnapshotID(project string, instance string, name string) (int64, error) {
 	stmt := c.stmt(instanceSnapshotID)
-	rows, err := stmt.Query(project, instance, name)
+	rows, err := stmt.QueryContext(c.ctx, project, instance, name)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to get instance_snapshot ID")
 	}
@@ -294,7 +294,7 @@ func (c *ClusterTx) CreateInstanceSnapshot(object InstanceSnapshot) (int64, erro
 	stmt := c.stmt(instanceSnapshotCreate)
 
 	// Execute the statement.
-	result, err := stmt.Exec(args...)
+	result, err := stmt.ExecContext(c.ctx, args...)
 	if err != nil {
 		return -1, errors.Wrap(err, "Failed to create instance_snapshot")
 	}
@@ -307,7 +307,7 @@ func (c *ClusterTx) CreateInstanceSnapshot(object InstanceSnapshot) (int64, erro
 	// Insert config reference.
 	stmt = c.stmt(instanceSnapshotCreateConfigRef)
 	for key, value := range object.Config {
-		_, err := stmt.Exec(id, key, value)
+		_, err := stmt.ExecContext(c.ctx, id, key, value)
 		if err != nil {
 			return -1, errors.Wrap(err, "Insert config for instance_snapshot")
 		}
@@ -324,7 +324,7 @@ func (c *ClusterTx) CreateInstanceSnapshot(object InstanceSnapshot) (int64, erro
 			return -1, errors.Wrapf(err, "Device type code for %s", typ)
 		}
 		stmt = c.stmt(instanceSnapshotCreateDevicesRef)
-		result, err := stmt.Exec(id, name, typCode)
+		result, err := stmt.ExecContext(c.ctx, id, name, typCode)
 		if err != nil {
 			return -1, errors.Wrapf(err, "Insert device %s", name)
 		}
@@ -334,7 +334,7 @@ func (c *ClusterTx) CreateInstanceSnapshot(object InstanceSnapshot) (int64, erro
 		}
 		stmt = c.stmt(instanceSnapshotCreateDevicesConfigRef)
 		for key, value := range config {
-			_, err := stmt.Exec(deviceID, key, value)
+			_, err := stmt.ExecContext(c.ctx, deviceID, key, value)
 			if err != nil {
 				return -1, errors.Wrap(err, "Insert config for instance_snapshot")
 			}
@@ -408,7 +408,7 @@ func (c *ClusterTx) InstanceSnapshotConfigRef(filter InstanceSnapshotFilter) (ma
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch  ref for instance_snapshots")
 	}
@@ -511,7 +511,7 @@ func (c *ClusterTx) InstanceSnapshotDevicesRef(filter InstanceSnapshotFilter) (m
 	}
 
 	// Select.
-	err := query.SelectObjects(stmt, dest, args...)
+	err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to fetch  ref for instance_snapshots")
 	}
@@ -562,7 +562,7 @@ func (c *ClusterTx) InstanceSnapshotDevicesRef(filter InstanceSnapshotFilter) (m
 // RenameInstanceSnapshot renames the instance_snapshot matching the given key parameters.
 func (c *ClusterTx) RenameInstanceSnapshot(project string, instance string, name string, to string) error {
 	stmt := c.stmt(instanceSnapshotRename)
-	result, err := stmt.Exec(to, project, instance, name)
+	result, err := stmt.ExecContext(c.ctx, to, project, instance, name)
 	if err != nil {
 		return errors.Wrap(err, "Rename instance_snapshot")
 	}
@@ -580,7 +580,7 @@ func (c *ClusterTx) RenameInstanceSnapshot(project string, instance string, name
 // DeleteInstanceSnapshot deletes the instance_snapshot matching the given key parameters.
 func (c *ClusterTx) DeleteInstanceSnapshot(project string, instance string, name string) error {
 	stmt := c.stmt(instanceSnapshotDelete)
-	result, err := stmt.Exec(project, instance, name)
+	result, err := stmt.ExecContext(c.ctx, project, instance, name)
 	if err != nil {
 		return errors.Wrap(err, "Delete instance_snapshot")
 	}
@@ -57,7 +57,7 @@ func NewTestNodeTx(t *testing.T) (*NodeTx, func()) {
 
 // NewTestCluster creates a new Cluster for testing purposes, along with a function
 // that can be used to clean it up when done.
-func NewTestCluster(t *testing.T) (*Cluster, func()) {
+func NewTestCluster(t testing.TB) (*Cluster, func()) {
 	// Create an in-memory dqlite SQL server and associated store.
 	dir, store, serverCleanup := NewTestDqliteServer(t)
 
@@ -87,7 +87,7 @@ func NewTestClusterTx(t *testing.T) (*ClusterTx, func()) {
 
 	var err error
 
-	clusterTx := &ClusterTx{nodeID: cluster.nodeID, stmts: cluster.stmts}
+	clusterTx := &ClusterTx{ctx: context.Background(), nodeID: cluster.nodeID, stmts: cluster.stmts}
 	clusterTx.tx, err = cluster.db.Begin()
 	require.NoError(t, err)
 
@@ -104,7 +104,7 @@ func NewTestClusterTx(t *testing.T) (*ClusterTx, func()) {
 //
 // Return the directory backing the test server and a newly created server
 // store that can be used to connect to it.
-func NewTestDqliteServer(t *testing.T) (string, driver.NodeStore, func()) {
+func NewTestDqliteServer(t testing.TB) (string, driver.NodeStore, func()) {
 	t.Helper()
 
 	listener, err := net.Listen("unix", "")
@@ -138,7 +138,7 @@ func NewTestDqliteServer(t *testing.T) (string, driver.NodeStore, func()) {
 }
 
 // Return a new temporary directory.
-func newDir(t *testing.T) (string, func()) {
+func newDir(t testing.TB) (string, func()) {
 	t.Helper()
 
 	dir, err := ioutil.TempDir("", "dqlite-replication-test-")
@@ -156,7 +156,7 @@ func newDir(t *testing.T) (string, func()) {
 	return dir, cleanup
 }
 
-func newLogFunc(t *testing.T) client.LogFunc {
+func newLogFunc(t testing.TB) client.LogFunc {
 	return func(l client.LogLevel, format string, a ...interface{}) {
 		format = fmt.Sprintf("%s: %s", l.String(), format)
 		t.Logf(format, a...)
@@ -3,6 +3,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
@@ -31,6 +32,7 @@ func (n *NodeTx) Tx() *sql.Tx {
 // update data.
 type ClusterTx struct {
 	tx     *sql.Tx           // Handle to a transaction in the cluster dqlite database.
+	ctx    context.Context   // Context interrupting the transaction's statements when done.
 	nodeID int64             // Node ID of this LXD instance.
 	stmts  map[int]*sql.Stmt // Prepared statements by code.
 }
@@ -45,5 +47,5 @@ func (c *ClusterTx) stmt(code int) *sql.Stmt {
 	if !ok {
 		panic(fmt.Sprintf("No prepared statement registered with code %d", code))
 	}
-	return c.tx.Stmt(stmt)
+	return c.tx.StmtContext(c.ctx, stmt)
 }
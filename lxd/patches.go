@@ -270,7 +270,16 @@ func patchRenameCustomVolumeLVs(name string, d *Daemon) error {
 }
 
 func patchLeftoverProfileConfig(name string, d *Daemon) error {
-	return d.cluster.RemoveUnreferencedProfiles()
+	deleted, err := d.cluster.RemoveUnreferencedProfiles()
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		logger.Info("Removed leftover profile config", log.Ctx{"rows": deleted})
+	}
+
+	return nil
 }
 
 func patchInvalidProfileNames(name string, d *Daemon) error {
@@ -1951,11 +1960,22 @@ func updatePoolPropertyForAllObjects(d *Daemon, poolName string, allcontainers [
 			// devices in order to add the new root device including the
 			// newly added storage pool.
 			err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
+				current, err := tx.GetProfile("default", pName)
+				if err != nil {
+					return err
+				}
+
 				return tx.UpdateProfile("default", pName, db.Profile{
-					Project: "default",
-					Name:    pName,
-					Config:  p.Config,
-					Devices: p.Devices,
+					Project:       "default",
+					Name:          pName,
+					Owner:         current.Owner,
+					CreatedAt:     current.CreatedAt,
+					UpdatedAt:     time.Now().UTC(),
+					SchemaVersion: db.ProfileSchemaVersion,
+					Deprecated:    current.Deprecated,
+					Immutable:     current.Immutable,
+					Config:        p.Config,
+					Devices:       p.Devices,
 				})
 			})
 			if err != nil {
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -85,6 +86,36 @@ func profilesGet(d *Daemon, r *http.Request) response.Response {
 	return response.SyncResponse(true, result)
 }
 
+// Check the given profile config against the profiles.allowed_config_prefixes
+// server setting, returning a Forbidden response naming the keys it doesn't
+// allow. Nothing is checked if the setting is empty.
+func profileConfigPolicyCheck(d *Daemon, config map[string]string) response.Response {
+	var prefixes []string
+	err := d.cluster.Transaction(func(tx *db.ClusterTx) error {
+		clusterConfig, err := cluster.ConfigLoad(tx)
+		if err != nil {
+			return err
+		}
+
+		prefixes = clusterConfig.ProfilesAllowedConfigPrefixes()
+		return nil
+	})
+	if err != nil {
+		return response.SmartError(err)
+	}
+
+	if prefixes == nil {
+		return nil
+	}
+
+	err = db.ValidateProfileConfig(config, prefixes)
+	if err != nil {
+		return response.Forbidden(err)
+	}
+
+	return nil
+}
+
 func profilesPost(d *Daemon, r *http.Request) response.Response {
 	projectName := projectParam(r)
 	req := api.ProfilesPost{}
@@ -93,19 +124,17 @@ func profilesPost(d *Daemon, r *http.Request) response.Response {
 	}
 
 	// Sanity checks
-	if req.Name == "" {
-		return response.BadRequest(fmt.Errorf("No name provided"))
-	}
-
-	if strings.Contains(req.Name, "/") {
-		return response.BadRequest(fmt.Errorf("Profile names may not contain slashes"))
+	err := db.ValidateProfileName(req.Name)
+	if err != nil {
+		return response.BadRequest(err)
 	}
 
-	if shared.StringInSlice(req.Name, []string{".", ".."}) {
-		return response.BadRequest(fmt.Errorf("Invalid profile name '%s'", req.Name))
+	resp := profileConfigPolicyCheck(d, req.Config)
+	if resp != nil {
+		return resp
 	}
 
-	err := instance.ValidConfig(d.os, req.Config, true, false)
+	err = instance.ValidConfig(d.os, req.Config, true, false)
 	if err != nil {
 		return response.BadRequest(err)
 	}
@@ -132,12 +161,16 @@ func profilesPost(d *Daemon, r *http.Request) response.Response {
 			return fmt.Errorf("The profile already exists")
 		}
 
+		now := time.Now().UTC()
 		profile := db.Profile{
-			Project:     projectName,
-			Name:        req.Name,
-			Description: req.Description,
-			Config:      req.Config,
-			Devices:     req.Devices,
+			Project:       projectName,
+			Name:          req.Name,
+			Description:   req.Description,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			SchemaVersion: db.ProfileSchemaVersion,
+			Config:        req.Config,
+			Devices:       req.Devices,
 		}
 		_, err = tx.CreateProfile(profile)
 		return err
@@ -252,6 +285,11 @@ func profilePut(d *Daemon, r *http.Request) response.Response {
 		return response.BadRequest(err)
 	}
 
+	resp := profileConfigPolicyCheck(d, req.Config)
+	if resp != nil {
+		return resp
+	}
+
 	err = doProfileUpdate(d, projectName, name, id, profile, req)
 
 	if err == nil && !isClusterNotification(r) {
@@ -361,6 +399,11 @@ func profilePatch(d *Daemon, r *http.Request) response.Response {
 		}
 	}
 
+	resp := profileConfigPolicyCheck(d, req.Config)
+	if resp != nil {
+		return resp
+	}
+
 	return response.SmartError(doProfileUpdate(d, projectName, name, id, profile, req))
 }
 
@@ -369,28 +412,12 @@ func profilePost(d *Daemon, r *http.Request) response.Response {
 	projectName := projectParam(r)
 	name := mux.Vars(r)["name"]
 
-	if name == "default" {
-		return response.Forbidden(errors.New("The 'default' profile cannot be renamed"))
-	}
-
 	req := api.ProfilePost{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		return response.BadRequest(err)
 	}
 
-	// Sanity checks
-	if req.Name == "" {
-		return response.BadRequest(fmt.Errorf("No name provided"))
-	}
-
-	if strings.Contains(req.Name, "/") {
-		return response.BadRequest(fmt.Errorf("Profile names may not contain slashes"))
-	}
-
-	if shared.StringInSlice(req.Name, []string{".", ".."}) {
-		return response.BadRequest(fmt.Errorf("Invalid profile name '%s'", req.Name))
-	}
-
+	var resp response.Response
 	err := d.cluster.Transaction(func(tx *db.ClusterTx) error {
 		hasProfiles, err := tx.ProjectHasProfiles(projectName)
 		if err != nil {
@@ -401,14 +428,27 @@ func profilePost(d *Daemon, r *http.Request) response.Response {
 			projectName = project.Default
 		}
 
-		// Check that the name isn't already in use
-		_, err = tx.GetProfile(projectName, req.Name)
-		if err == nil {
-			return fmt.Errorf("Name '%s' already in use", req.Name)
+		// Sanity checks
+		err = tx.ValidateProfileRename(projectName, name, req.Name)
+		if err != nil {
+			if errors.Cause(err) == db.ErrProfileNameReserved {
+				resp = response.Forbidden(err)
+			} else {
+				resp = response.BadRequest(err)
+			}
+			return err
 		}
 
-		return tx.RenameProfile(projectName, name, req.Name)
+		err = tx.RenameProfile(projectName, name, req.Name)
+		if err != nil {
+			return err
+		}
+
+		return tx.TouchProfile(projectName, req.Name)
 	})
+	if resp != nil {
+		return resp
+	}
 	if err != nil {
 		return response.SmartError(err)
 	}
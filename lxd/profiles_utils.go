@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/lxc/lxd/lxd/db"
 	deviceConfig "github.com/lxc/lxd/lxd/device/config"
@@ -77,12 +78,23 @@ func doProfileUpdate(d *Daemon, project, name string, id int64, profile *api.Pro
 
 	// Update the database
 	err = d.cluster.Transaction(func(tx *db.ClusterTx) error {
+		current, err := tx.GetProfile(project, name)
+		if err != nil {
+			return err
+		}
+
 		return tx.UpdateProfile(project, name, db.Profile{
-			Project:     project,
-			Name:        name,
-			Description: req.Description,
-			Config:      req.Config,
-			Devices:     req.Devices,
+			Project:       project,
+			Name:          name,
+			Description:   req.Description,
+			Owner:         current.Owner,
+			CreatedAt:     current.CreatedAt,
+			UpdatedAt:     time.Now().UTC(),
+			SchemaVersion: db.ProfileSchemaVersion,
+			Deprecated:    current.Deprecated,
+			Immutable:     current.Immutable,
+			Config:        req.Config,
+			Devices:       req.Devices,
 		})
 	})
 	if err != nil {
@@ -1,5 +1,9 @@
 package api
 
+import (
+	"time"
+)
+
 // ProfilesPost represents the fields of a new LXD profile
 type ProfilesPost struct {
 	ProfilePut `yaml:",inline"`
@@ -27,6 +31,12 @@ type Profile struct {
 
 	// API extension: profile_usedby
 	UsedBy []string `json:"used_by" yaml:"used_by"`
+
+	// API extension: profile_created_at
+	CreatedAt time.Time `json:"created_at" yaml:"created_at"`
+
+	// API extension: profile_updated_at
+	UpdatedAt time.Time `json:"updated_at" yaml:"updated_at"`
 }
 
 // Writable converts a full Profile struct into a ProfilePut struct (filters read-only fields)
@@ -140,7 +140,7 @@ func (m *Method) uris(buf *file.Buffer) error {
 	buf.L("code := %s.EntityTypes[%q]", m.db, m.entity)
 	buf.L("formatter := %s.EntityFormatURIs[code]", m.db)
 	buf.N()
-	buf.L("return query.SelectURIs(stmt, formatter, args...)")
+	buf.L("return query.SelectURIsCtx(c.ctx, stmt, formatter, args...)")
 
 	return nil
 }
@@ -232,7 +232,7 @@ func (m *Method) list(buf *file.Buffer) error {
 	buf.L("dest := %s", destFunc("objects", typ, mapping.ColumnFields()))
 	buf.N()
 	buf.L("// Select.")
-	buf.L("err := query.SelectObjects(stmt, dest, args...)")
+	buf.L("err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)")
 	buf.L("if err != nil {")
 	buf.L("        return nil, errors.Wrap(err, \"Failed to fetch %s\")", lex.Plural(m.entity))
 	buf.L("}")
@@ -438,7 +438,7 @@ func (m *Method) ref(buf *file.Buffer) error {
 	buf.L("dest := %s", destFunc("objects", destType, destFields))
 	buf.N()
 	buf.L("// Select.")
-	buf.L("err := query.SelectObjects(stmt, dest, args...)")
+	buf.L("err := query.SelectObjectsCtx(c.ctx, stmt, dest, args...)")
 	buf.L("if err != nil {")
 	buf.L("        return nil, errors.Wrap(err, \"Failed to fetch %s ref for %s\")", typ, lex.Plural(m.entity))
 	buf.L("}")
@@ -560,7 +560,7 @@ func (m *Method) id(buf *file.Buffer) error {
 	defer m.end(buf)
 
 	buf.L("stmt := c.stmt(%s)", stmtCodeVar(m.entity, "ID"))
-	buf.L("rows, err := stmt.Query(%s)", FieldParams(nk))
+	buf.L("rows, err := stmt.QueryContext(c.ctx, %s)", FieldParams(nk))
 	buf.L("if err != nil {")
 	buf.L("        return -1, errors.Wrap(err, \"Failed to get %s ID\")", m.entity)
 	buf.L("}")
@@ -675,7 +675,7 @@ func (m *Method) create(buf *file.Buffer) error {
 	buf.L("stmt := c.stmt(%s)", stmtCodeVar(m.entity, "create"))
 	buf.N()
 	buf.L("// Execute the statement. ")
-	buf.L("result, err := stmt.Exec(args...)")
+	buf.L("result, err := stmt.ExecContext(c.ctx, args...)")
 	buf.L("if err != nil {")
 	buf.L("        return -1, errors.Wrap(err, \"Failed to create %s\")", m.entity)
 	buf.L("}")
@@ -692,7 +692,7 @@ func (m *Method) create(buf *file.Buffer) error {
 			buf.L("// Insert config reference. ")
 			buf.L("stmt = c.stmt(%s)", stmtCodeVar(m.entity, "createConfigRef"))
 			buf.L("for key, value := range object.%s {", field.Name)
-			buf.L("        _, err := stmt.Exec(id, key, value)")
+			buf.L("        _, err := stmt.ExecContext(c.ctx, id, key, value)")
 			buf.L("        if err != nil {")
 			buf.L("                return -1, errors.Wrap(err, \"Insert config for %s\")", m.entity)
 			buf.L("        }")
@@ -711,7 +711,7 @@ func (m *Method) create(buf *file.Buffer) error {
 			buf.L("                return -1, errors.Wrapf(err, \"Device type code for %%s\", typ)")
 			buf.L("        }")
 			buf.L("        stmt = c.stmt(%s)", stmtCodeVar(m.entity, "createDevicesRef"))
-			buf.L("        result, err := stmt.Exec(id, name, typCode)")
+			buf.L("        result, err := stmt.ExecContext(c.ctx, id, name, typCode)")
 			buf.L("        if err != nil {")
 			buf.L("                return -1, errors.Wrapf(err, \"Insert device %%s\", name)")
 			buf.L("        }")
@@ -721,7 +721,7 @@ func (m *Method) create(buf *file.Buffer) error {
 			buf.L("        }")
 			buf.L("        stmt = c.stmt(%s)", stmtCodeVar(m.entity, "createDevicesConfigRef"))
 			buf.L("        for key, value := range config {")
-			buf.L("                _, err := stmt.Exec(deviceID, key, value)")
+			buf.L("                _, err := stmt.ExecContext(c.ctx, deviceID, key, value)")
 			buf.L("                if err != nil {")
 			buf.L("                        return -1, errors.Wrap(err, \"Insert config for %s\")", m.entity)
 			buf.L("                }")
@@ -760,7 +760,7 @@ func (m *Method) rename(buf *file.Buffer) error {
 	defer m.end(buf)
 
 	buf.L("stmt := c.stmt(%s)", stmtCodeVar(m.entity, "rename"))
-	buf.L("result, err := stmt.Exec(%s)", "to, "+FieldParams(nk))
+	buf.L("result, err := stmt.ExecContext(c.ctx, %s)", "to, "+FieldParams(nk))
 	buf.L("if err != nil {")
 	buf.L("        return errors.Wrap(err, \"Rename %s\")", m.entity)
 	buf.L("}")
@@ -818,7 +818,7 @@ func (m *Method) update(buf *file.Buffer) error {
 	buf.L("}")
 	buf.N()
 	buf.L("stmt := c.stmt(%s)", stmtCodeVar(m.entity, "update"))
-	buf.L("result, err := stmt.Exec(%s)", strings.Join(params, ", ")+", id")
+	buf.L("result, err := stmt.ExecContext(c.ctx, %s)", strings.Join(params, ", ")+", id")
 	buf.L("if err != nil {")
 	buf.L("        return errors.Wrap(err, \"Update %s\")", m.entity)
 	buf.L("}")
@@ -838,7 +838,7 @@ func (m *Method) update(buf *file.Buffer) error {
 		case "Config":
 			buf.L("// Delete current config. ")
 			buf.L("stmt = c.stmt(%s)", stmtCodeVar(m.entity, "deleteConfigRef"))
-			buf.L("_, err = stmt.Exec(id)")
+			buf.L("_, err = stmt.ExecContext(c.ctx, id)")
 			buf.L("if err != nil {")
 			buf.L("        return errors.Wrap(err, \"Delete current config\")")
 			buf.L("}")
@@ -849,7 +849,7 @@ func (m *Method) update(buf *file.Buffer) error {
 			buf.L("        if value == \"\" {")
 			buf.L("                continue")
 			buf.L("        }")
-			buf.L("        _, err := stmt.Exec(id, key, value)")
+			buf.L("        _, err := stmt.ExecContext(c.ctx, id, key, value)")
 			buf.L("        if err != nil {")
 			buf.L("                return errors.Wrap(err, \"Insert config for %s\")", m.entity)
 			buf.L("        }")
@@ -858,7 +858,7 @@ func (m *Method) update(buf *file.Buffer) error {
 		case "Devices":
 			buf.L("// Delete current devices. ")
 			buf.L("stmt = c.stmt(%s)", stmtCodeVar(m.entity, "deleteDevicesRef"))
-			buf.L("_, err = stmt.Exec(id)")
+			buf.L("_, err = stmt.ExecContext(c.ctx, id)")
 			buf.L("if err != nil {")
 			buf.L("        return errors.Wrap(err, \"Delete current devices\")")
 			buf.L("}")
@@ -874,7 +874,7 @@ func (m *Method) update(buf *file.Buffer) error {
 			buf.L("                return errors.Wrapf(err, \"Device type code for %%s\", typ)")
 			buf.L("        }")
 			buf.L("        stmt = c.stmt(%s)", stmtCodeVar(m.entity, "createDevicesRef"))
-			buf.L("        result, err := stmt.Exec(id, name, typCode)")
+			buf.L("        result, err := stmt.ExecContext(c.ctx, id, name, typCode)")
 			buf.L("        if err != nil {")
 			buf.L("                return errors.Wrapf(err, \"Insert device %%s\", name)")
 			buf.L("        }")
@@ -887,7 +887,7 @@ func (m *Method) update(buf *file.Buffer) error {
 			buf.L("                if value == \"\" {")
 			buf.L("                        continue")
 			buf.L("                }")
-			buf.L("                _, err := stmt.Exec(deviceID, key, value)")
+			buf.L("                _, err := stmt.ExecContext(c.ctx, deviceID, key, value)")
 			buf.L("                if err != nil {")
 			buf.L("                        return errors.Wrap(err, \"Insert config for %s\")", m.entity)
 			buf.L("                }")
@@ -897,7 +897,7 @@ func (m *Method) update(buf *file.Buffer) error {
 		case "Profiles":
 			buf.L("// Delete current profiles. ")
 			buf.L("stmt = c.stmt(%s)", stmtCodeVar(m.entity, "deleteProfilesRef"))
-			buf.L("_, err = stmt.Exec(id)")
+			buf.L("_, err = stmt.ExecContext(c.ctx, id)")
 			buf.L("if err != nil {")
 			buf.L("        return errors.Wrap(err, \"Delete current profiles\")")
 			buf.L("}")
@@ -931,7 +931,7 @@ func (m *Method) delete(buf *file.Buffer) error {
 	defer m.end(buf)
 
 	buf.L("stmt := c.stmt(%s)", stmtCodeVar(m.entity, "delete"))
-	buf.L("result, err := stmt.Exec(%s)", FieldParams(nk))
+	buf.L("result, err := stmt.ExecContext(c.ctx, %s)", FieldParams(nk))
 	buf.L("if err != nil {")
 	buf.L("        return errors.Wrap(err, \"Delete %s\")", m.entity)
 	buf.L("}")
@@ -974,6 +974,14 @@ func (m *Method) begin(buf *file.Buffer, comment string, args string, rets strin
 	default:
 		name = fmt.Sprintf("%s%s", entity, m.kind)
 	}
+
+	// Support overriding the method name, for example to wrap the
+	// generated method with a hand-written one.
+	custom, ok := m.config["name"]
+	if ok {
+		name = custom
+	}
+
 	receiver := fmt.Sprintf("c %s", dbTxType(m.db))
 
 	buf.L("// %s %s", name, comment)
@@ -119,6 +119,16 @@ func Criteria(pkg *ast.Package, entity string) ([]string, error) {
 			return nil, fmt.Errorf("Unexported field name")
 		}
 
+		// Ignore fields that are marked with a tag of `db:"ignore"`,
+		// since they are handled by hand-written code.
+		if f.Tag != nil {
+			tag := f.Tag.Value
+			tagValue := reflect.StructTag(tag[1 : len(tag)-1]).Get("db")
+			if tagValue == "ignore" {
+				continue
+			}
+		}
+
 		criteria = append(criteria, f.Names[0].Name)
 	}
 
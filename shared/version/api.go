@@ -211,6 +211,9 @@ var APIExtensions = []string{
 	"resources_system",
 	"images_push_relay",
 	"network_dns_search",
+	"profile_created_at",
+	"profile_updated_at",
+	"profile_config_policy",
 }
 
 // APIExtensionsCount returns the number of available API extensions.